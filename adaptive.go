@@ -0,0 +1,131 @@
+package netlimit
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidAdaptive is returned when the bounds of Adaptive are not valid.
+	ErrInvalidAdaptive = errors.New("adaptive limit requires 0 < min <= max")
+)
+
+const (
+	defaultAdaptiveInterval  = time.Second
+	defaultAdaptiveDecrease  = 0.7
+	defaultAdaptiveThreshold = 2.0
+
+	// adaptiveUtilization is the fraction of the limit that has to be used before the limit is increased
+	adaptiveUtilization = 0.9
+
+	// adaptiveBaselineDrift is the factor the baseline latency grows by every interval,
+	// so that a baseline measured on a faster path is eventually forgotten
+	adaptiveBaselineDrift = 1.01
+)
+
+// Adaptive configures the AIMD controller adjusting the global limit to the measured capacity of the link.
+// The controller additively increases the limit while the link is fully used and write latency stays close
+// to the lowest latency observed, it multiplicatively decreases the limit once the latency grows, which means
+// that queues are building up somewhere along the path.
+type Adaptive struct {
+	// Min is the lowest global limit the controller may set
+	Min int
+
+	// Max is the highest global limit the controller may set
+	Max int
+
+	// Interval is the time between adjustments, one second by default
+	Interval time.Duration
+
+	// Increase is the number of bytes per second the limit grows by, 5% of Max by default
+	Increase int
+
+	// Decrease is the factor the limit is multiplied by when latency grows, 0.7 by default
+	Decrease float64
+
+	// Threshold is the ratio of the current to the lowest observed write latency that counts as congestion, 2 by default
+	Threshold float64
+}
+
+func (a Adaptive) withDefaults() (Adaptive, error) {
+	if a.Min <= 0 || a.Min > a.Max {
+		return a, ErrInvalidAdaptive
+	}
+	if a.Interval <= 0 {
+		a.Interval = defaultAdaptiveInterval
+	}
+	if a.Increase <= 0 {
+		a.Increase = a.Max / 20
+		if a.Increase == 0 {
+			a.Increase = 1
+		}
+	}
+	if a.Decrease <= 0 || a.Decrease >= 1 {
+		a.Decrease = defaultAdaptiveDecrease
+	}
+	if a.Threshold <= 1 {
+		a.Threshold = defaultAdaptiveThreshold
+	}
+	return a, nil
+}
+
+// AdaptiveController computes the global limit from samples of throughput and write latency.
+type AdaptiveController struct {
+	cfg Adaptive
+
+	// limit is the current global limit
+	limit int
+
+	// baseline is the lowest write latency observed, slowly drifting up
+	baseline time.Duration
+}
+
+// NewAdaptiveController returns a controller starting at limit, clamped to the bounds of cfg.
+func NewAdaptiveController(cfg Adaptive, limit int) (*AdaptiveController, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &AdaptiveController{cfg: cfg}
+	c.limit = c.clamp(limit)
+	return c, nil
+}
+
+// Update feeds the controller with the throughput, in bytes per second, and the average write latency
+// measured over the last interval and returns the new global limit.
+// latency equal to 0 means that nothing was written and the limit is kept.
+func (c *AdaptiveController) Update(throughput int, latency time.Duration) int {
+	if latency <= 0 {
+		return c.limit
+	}
+
+	if c.baseline == 0 || latency < c.baseline {
+		c.baseline = latency
+	}
+	congested := float64(latency) > float64(c.baseline)*c.cfg.Threshold
+	c.baseline = time.Duration(float64(c.baseline) * adaptiveBaselineDrift)
+
+	switch {
+	case congested:
+		c.limit = c.clamp(int(float64(c.limit) * c.cfg.Decrease))
+	case float64(throughput) >= float64(c.limit)*adaptiveUtilization:
+		c.limit = c.clamp(c.limit + c.cfg.Increase)
+	}
+	return c.limit
+}
+
+// Limit returns the current global limit.
+func (c *AdaptiveController) Limit() int {
+	return c.limit
+}
+
+func (c *AdaptiveController) clamp(limit int) int {
+	if limit < c.cfg.Min {
+		return c.cfg.Min
+	}
+	if limit > c.cfg.Max {
+		return c.cfg.Max
+	}
+	return limit
+}
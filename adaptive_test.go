@@ -0,0 +1,107 @@
+package netlimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+func TestAdaptiveController_Update(t *testing.T) {
+	type sample struct {
+		throughput int
+		latency    time.Duration
+	}
+	tests := []struct {
+		name    string
+		cfg     netlimit.Adaptive
+		limit   int
+		samples []sample
+		want    []int
+	}{
+		{
+			name:  "increase additively while the link is fully used",
+			cfg:   netlimit.Adaptive{Min: 100, Max: 1000, Increase: 100},
+			limit: 500,
+			samples: []sample{
+				{throughput: 500, latency: time.Millisecond},
+				{throughput: 600, latency: time.Millisecond},
+			},
+			want: []int{600, 700},
+		},
+		{
+			name:  "keep limit while the link is underused",
+			cfg:   netlimit.Adaptive{Min: 100, Max: 1000, Increase: 100},
+			limit: 500,
+			samples: []sample{
+				{throughput: 100, latency: time.Millisecond},
+			},
+			want: []int{500},
+		},
+		{
+			name:  "decrease multiplicatively once latency grows",
+			cfg:   netlimit.Adaptive{Min: 100, Max: 1000, Increase: 100, Decrease: 0.5},
+			limit: 800,
+			samples: []sample{
+				{throughput: 800, latency: time.Millisecond},
+				{throughput: 900, latency: 10 * time.Millisecond},
+				{throughput: 450, latency: 10 * time.Millisecond},
+			},
+			want: []int{900, 450, 225},
+		},
+		{
+			name:  "stay within bounds",
+			cfg:   netlimit.Adaptive{Min: 100, Max: 1000, Increase: 500, Decrease: 0.1},
+			limit: 800,
+			samples: []sample{
+				{throughput: 800, latency: time.Millisecond},
+				{throughput: 1000, latency: 10 * time.Millisecond},
+			},
+			want: []int{1000, 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := netlimit.NewAdaptiveController(tt.cfg, tt.limit)
+			if err != nil {
+				t.Fatalf("NewAdaptiveController() error = %v", err)
+			}
+			for i, s := range tt.samples {
+				if got := c.Update(s.throughput, s.latency); got != tt.want[i] {
+					t.Errorf("Update() = %v, want %v", got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListener_SetAdaptive(t *testing.T) {
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 5000, 10)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	if err := ln.SetAdaptive(&netlimit.Adaptive{Min: 100, Max: 10}); err != netlimit.ErrInvalidAdaptive {
+		t.Errorf("SetAdaptive() error = %v, wantErr %v", err, netlimit.ErrInvalidAdaptive)
+	}
+	// the controller could otherwise push the global limit below the local one
+	if err := ln.SetAdaptive(&netlimit.Adaptive{Min: 5, Max: 1000}); err != netlimit.ErrLimitGreaterThanTotal {
+		t.Errorf("SetAdaptive() error = %v, wantErr %v", err, netlimit.ErrLimitGreaterThanTotal)
+	}
+	err = ln.SetAdaptive(&netlimit.Adaptive{Min: 100, Max: 1000, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("SetAdaptive() error = %v", err)
+	}
+	// the initial limit is clamped to the bounds
+	deadline := time.Now().Add(time.Second)
+	for ln.GlobalLimit() != 1000 {
+		if time.Now().After(deadline) {
+			t.Fatalf("GlobalLimit() = %v, want %v", ln.GlobalLimit(), 1000)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ln.SetAdaptive(nil); err != nil {
+		t.Errorf("SetAdaptive() error = %v", err)
+	}
+}
@@ -0,0 +1,452 @@
+// Package admin provides an HTTP handler exposing a JSON API for live management of a netlimit.Listener:
+// listing connections with their stats, reading and updating limits, pinning and closing connections,
+// and reading and updating the schedule of limits.
+//
+// Endpoints, relative to where the handler is mounted:
+//
+//	GET    /limits            global and local limits
+//	PUT    /limits            update limits, {"global": 10485760, "local": 1048576}, either may be omitted
+//	GET    /conns             active connections with their stats
+//	GET    /conns/{id}        a single connection
+//	DELETE /conns/{id}        close a connection
+//	PUT    /conns/{id}/limit  update the limit of a connection, {"limit": 65536, "pin": true}
+//	DELETE /conns/{id}/limit  unpin the limit of a connection
+//	GET    /policy            the schedule of limits, null if there is none
+//	PUT    /policy            replace the schedule of limits
+//	DELETE /policy            stop applying the schedule of limits
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+var (
+	// ErrUnauthorized is returned by Authenticators for requests that are not allowed to use the API.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrNoAuthenticator is returned by NewHandler without an Authenticator.
+	ErrNoAuthenticator = errors.New("authenticator cannot be nil, use AllowAll to disable authentication")
+)
+
+// maxBodySize is the maximum size of request bodies in bytes
+const maxBodySize = 1 << 20
+
+// Authenticator decides whether a request is allowed to use the API.
+type Authenticator interface {
+	// Authenticate returns an error if r is not allowed to use the API
+	Authenticate(r *http.Request) error
+}
+
+// AuthenticatorFunc is an Authenticator implemented by a function.
+type AuthenticatorFunc func(r *http.Request) error
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) error {
+	return f(r)
+}
+
+// AllowAll allows every request, it is meant for handlers reachable only from trusted networks.
+var AllowAll Authenticator = AuthenticatorFunc(func(*http.Request) error { return nil })
+
+// BearerToken returns an Authenticator that allows requests with the header "Authorization: Bearer <token>".
+func BearerToken(token string) Authenticator {
+	want := []byte("Bearer " + token)
+	return AuthenticatorFunc(func(r *http.Request) error {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			return ErrUnauthorized
+		}
+		return nil
+	})
+}
+
+// Handler is an http.Handler serving the admin API of a Listener.
+// Mount it under a prefix with http.StripPrefix, e.g. mux.Handle("/admin/", http.StripPrefix("/admin", h)).
+type Handler struct {
+	ln   *netlimit.Listener
+	auth Authenticator
+}
+
+// NewHandler returns a Handler serving the admin API of ln to requests allowed by auth.
+func NewHandler(ln *netlimit.Listener, auth Authenticator) (*Handler, error) {
+	if auth == nil {
+		return nil, ErrNoAuthenticator
+	}
+	return &Handler{ln: ln, auth: auth}, nil
+}
+
+// statusError is an error with the HTTP status it is served with.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return &statusError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// ServeHTTP serves the admin API.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.auth.Authenticate(r); err != nil {
+		writeError(w, &statusError{status: http.StatusUnauthorized, err: err})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	v, err := h.route(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if v == nil && r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) route(r *http.Request) (interface{}, error) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "limits":
+		switch r.Method {
+		case http.MethodGet:
+			return h.limits(), nil
+		case http.MethodPut:
+			return h.setLimits(r)
+		}
+	case len(path) == 1 && path[0] == "conns":
+		if r.Method == http.MethodGet {
+			return h.conns(), nil
+		}
+	case len(path) == 2 && path[0] == "conns":
+		conn, err := h.conn(path[1])
+		if err != nil {
+			return nil, err
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return newConnJSON(conn), nil
+		case http.MethodDelete:
+			if err := conn.Close(); err != nil {
+				return nil, fmt.Errorf("failed to close connection: %w", err)
+			}
+			return nil, nil
+		}
+	case len(path) == 3 && path[0] == "conns" && path[2] == "limit":
+		conn, err := h.conn(path[1])
+		if err != nil {
+			return nil, err
+		}
+		switch r.Method {
+		case http.MethodPut:
+			return setConnLimit(conn, r)
+		case http.MethodDelete:
+			conn.Unpin()
+			return newConnJSON(conn), nil
+		}
+	case len(path) == 1 && path[0] == "policy":
+		switch r.Method {
+		case http.MethodGet:
+			return newPolicyJSON(h.ln.Schedule()), nil
+		case http.MethodPut:
+			return h.setPolicy(r)
+		case http.MethodDelete:
+			if err := h.ln.SetSchedule(nil); err != nil {
+				return nil, fmt.Errorf("failed to stop schedule: %w", err)
+			}
+			return nil, nil
+		}
+	default:
+		return nil, errorf(http.StatusNotFound, "not found: %s", r.URL.Path)
+	}
+	return nil, errorf(http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+}
+
+type limitsJSON struct {
+	Global *int `json:"global,omitempty"`
+	Local  *int `json:"local,omitempty"`
+}
+
+func (h *Handler) limits() limitsJSON {
+	global, local := h.ln.GlobalLimit(), h.ln.LocalLimit()
+	return limitsJSON{Global: &global, Local: &local}
+}
+
+func (h *Handler) setLimits(r *http.Request) (interface{}, error) {
+	var limits limitsJSON
+	if err := decode(r, &limits); err != nil {
+		return nil, err
+	}
+	if (limits.Global != nil && *limits.Global <= 0) || (limits.Local != nil && *limits.Local <= 0) {
+		return nil, errorf(http.StatusBadRequest, "limits must be positive")
+	}
+
+	// limits are validated as a pair before any of them is applied, omitted limits keep their current values
+	global, local := h.ln.GlobalLimit(), h.ln.LocalLimit()
+	if limits.Global != nil {
+		global = *limits.Global
+	}
+	if limits.Local != nil {
+		local = *limits.Local
+	}
+	if local > global {
+		return nil, errorf(http.StatusBadRequest, "%v", netlimit.ErrLimitGreaterThanTotal)
+	}
+
+	// the local limit is lowered first, so that it never exceeds the global one in between
+	setGlobal := func() error {
+		if limits.Global == nil {
+			return nil
+		}
+		if err := h.ln.SetGlobalLimit(*limits.Global); err != nil {
+			if errors.Is(err, netlimit.ErrLimitGreaterThanTotal) {
+				return errorf(http.StatusBadRequest, "%v", err)
+			}
+			return fmt.Errorf("failed to set global limit: %w", err)
+		}
+		return nil
+	}
+	setLocal := func() error {
+		if limits.Local == nil {
+			return nil
+		}
+		if err := h.ln.SetLocalLimit(*limits.Local); err != nil {
+			if errors.Is(err, netlimit.ErrLimitGreaterThanTotal) {
+				return errorf(http.StatusBadRequest, "%v", err)
+			}
+			return fmt.Errorf("failed to set local limit: %w", err)
+		}
+		return nil
+	}
+	steps := []func() error{setGlobal, setLocal}
+	if limits.Global != nil && *limits.Global < h.ln.GlobalLimit() {
+		steps = []func() error{setLocal, setGlobal}
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+	return h.limits(), nil
+}
+
+type connJSON struct {
+	ID           uint64    `json:"id"`
+	Remote       string    `json:"remote"`
+	Local        string    `json:"local"`
+	Limit        int       `json:"limit"`
+	Pinned       bool      `json:"pinned"`
+	Opened       time.Time `json:"opened"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+	Writes       int64     `json:"writes"`
+	WriteTime    string    `json:"write_time"`
+	AllocWait    string    `json:"alloc_wait"`
+}
+
+func newConnJSON(c *netlimit.Conn) connJSON {
+	stats := c.Stats()
+	return connJSON{
+		ID:           c.ID(),
+		Remote:       c.RemoteAddr().String(),
+		Local:        c.LocalAddr().String(),
+		Limit:        c.Limit(),
+		Pinned:       c.Pinned(),
+		Opened:       stats.Opened,
+		BytesRead:    stats.BytesRead,
+		BytesWritten: stats.BytesWritten,
+		Writes:       stats.Writes,
+		WriteTime:    stats.WriteTime.String(),
+		AllocWait:    stats.AllocWait.String(),
+	}
+}
+
+func (h *Handler) conns() []connJSON {
+	conns := []connJSON{}
+	for _, c := range h.ln.Conns() {
+		conns = append(conns, newConnJSON(c))
+	}
+	return conns
+}
+
+func (h *Handler) conn(id string) (*netlimit.Conn, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid connection id %q", id)
+	}
+	for _, c := range h.ln.Conns() {
+		if c.ID() == n {
+			return c, nil
+		}
+	}
+	return nil, errorf(http.StatusNotFound, "no connection %d", n)
+}
+
+type connLimitJSON struct {
+	Limit int  `json:"limit"`
+	Pin   bool `json:"pin"`
+}
+
+func setConnLimit(c *netlimit.Conn, r *http.Request) (interface{}, error) {
+	var limit connLimitJSON
+	if err := decode(r, &limit); err != nil {
+		return nil, err
+	}
+	if limit.Limit <= 0 {
+		return nil, errorf(http.StatusBadRequest, "limit must be positive")
+	}
+
+	set := c.SetLimit
+	if limit.Pin {
+		set = c.Pin
+	}
+	if err := set(limit.Limit); err != nil {
+		return nil, errorf(http.StatusBadRequest, "failed to set limit: %v", err)
+	}
+	return newConnJSON(c), nil
+}
+
+type periodJSON struct {
+	// Start is the time of day the period starts at, e.g. "09:30"
+	Start  string   `json:"start"`
+	Days   []string `json:"days,omitempty"`
+	Global int      `json:"global"`
+	Local  int      `json:"local"`
+}
+
+type policyJSON struct {
+	Periods []periodJSON `json:"periods"`
+
+	// Location is the name of the time zone of the schedule, e.g. "Europe/Warsaw", the local time zone if empty
+	Location string `json:"location,omitempty"`
+
+	// Ramp is the duration limits change over, e.g. "5m"
+	Ramp string `json:"ramp,omitempty"`
+}
+
+func newPolicyJSON(s *netlimit.Schedule) *policyJSON {
+	if s == nil {
+		return nil
+	}
+	p := &policyJSON{Periods: []periodJSON{}}
+	for _, period := range s.Periods {
+		start := time.Time{}.Add(period.Start)
+		pj := periodJSON{Start: start.Format("15:04"), Global: period.GlobalLimit, Local: period.LocalLimit}
+		for _, d := range period.Days {
+			pj.Days = append(pj.Days, d.String())
+		}
+		p.Periods = append(p.Periods, pj)
+	}
+	if s.Location != nil {
+		p.Location = s.Location.String()
+	}
+	if s.Ramp > 0 {
+		p.Ramp = s.Ramp.String()
+	}
+	return p
+}
+
+func (h *Handler) setPolicy(r *http.Request) (interface{}, error) {
+	var p policyJSON
+	if err := decode(r, &p); err != nil {
+		return nil, err
+	}
+	s, err := p.schedule()
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid policy: %v", err)
+	}
+	if err := h.ln.SetSchedule(s); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid policy: %v", err)
+	}
+	return newPolicyJSON(s), nil
+}
+
+func (p policyJSON) schedule() (*netlimit.Schedule, error) {
+	s := &netlimit.Schedule{}
+	for _, pj := range p.Periods {
+		start, err := time.Parse("15:04", pj.Start)
+		if err != nil {
+			return nil, fmt.Errorf("start %q is not a time of day", pj.Start)
+		}
+		if pj.Global <= 0 || pj.Local <= 0 || pj.Local > pj.Global {
+			return nil, fmt.Errorf("limits of a period must be positive and local cannot exceed global")
+		}
+		period := netlimit.SchedulePeriod{
+			Start:       time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+			GlobalLimit: pj.Global,
+			LocalLimit:  pj.Local,
+		}
+		for _, name := range pj.Days {
+			day, err := parseWeekday(name)
+			if err != nil {
+				return nil, err
+			}
+			period.Days = append(period.Days, day)
+		}
+		s.Periods = append(s.Periods, period)
+	}
+	if p.Location != "" {
+		loc, err := time.LoadLocation(p.Location)
+		if err != nil {
+			return nil, fmt.Errorf("unknown location %q", p.Location)
+		}
+		s.Location = loc
+	}
+	if p.Ramp != "" {
+		ramp, err := time.ParseDuration(p.Ramp)
+		if err != nil || ramp < 0 {
+			return nil, fmt.Errorf("ramp %q is not a duration", p.Ramp)
+		}
+		s.Ramp = ramp
+	}
+	return s, nil
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), name) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", name)
+}
+
+func decode(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var se *statusError
+	if errors.As(err, &se) {
+		status = se.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,200 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/admin"
+	"github.com/charconstpointer/netlimit/netlimittest"
+)
+
+const token = "secret"
+
+// newHandler returns a Handler over a Listener with a single accepted connection.
+func newHandler(t *testing.T) (*admin.Handler, *netlimit.Listener, *netlimit.Conn) {
+	t.Helper()
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := inner.Dial("pipe", "")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn := (<-accepted).(*netlimit.Conn)
+
+	h, err := admin.NewHandler(ln, admin.BearerToken(token))
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	return h, ln, conn
+}
+
+func serve(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"get limits", http.MethodGet, "/limits", "", http.StatusOK, `{"global":10000,"local":1000}`},
+		{"raise limits", http.MethodPut, "/limits", `{"global":20000,"local":15000}`, http.StatusOK, `{"global":20000,"local":15000}`},
+		{"lower limits", http.MethodPut, "/limits", `{"global":800,"local":500}`, http.StatusOK, `{"global":800,"local":500}`},
+		{"local above global", http.MethodPut, "/limits", `{"local":20000}`, http.StatusBadRequest, ""},
+		{"global below local", http.MethodPut, "/limits", `{"global":500}`, http.StatusBadRequest, ""},
+		{"unknown field", http.MethodPut, "/limits", `{"total":500}`, http.StatusBadRequest, ""},
+		{"local above lowered global", http.MethodPut, "/limits", `{"global":500,"local":800}`, http.StatusBadRequest, ""},
+		{"body too large", http.MethodPut, "/limits", `{"global":` + strings.Repeat(" ", 1<<20) + `20000}`, http.StatusBadRequest, ""},
+		{"list conns", http.MethodGet, "/conns", "", http.StatusOK, `"id":1`},
+		{"get conn", http.MethodGet, "/conns/1", "", http.StatusOK, `"limit":1000`},
+		{"unknown conn", http.MethodGet, "/conns/2", "", http.StatusNotFound, ""},
+		{"invalid conn id", http.MethodGet, "/conns/x", "", http.StatusBadRequest, ""},
+		{"set conn limit", http.MethodPut, "/conns/1/limit", `{"limit":500}`, http.StatusOK, `"limit":500,"pinned":false`},
+		{"pin conn limit", http.MethodPut, "/conns/1/limit", `{"limit":500,"pin":true}`, http.StatusOK, `"limit":500,"pinned":true`},
+		{"conn limit above global", http.MethodPut, "/conns/1/limit", `{"limit":50000}`, http.StatusBadRequest, ""},
+		{"unpin conn limit", http.MethodDelete, "/conns/1/limit", "", http.StatusOK, `"pinned":false`},
+		{"get empty policy", http.MethodGet, "/policy", "", http.StatusOK, `null`},
+		{
+			"set policy", http.MethodPut, "/policy",
+			`{"periods":[{"start":"09:00","days":["monday"],"global":5000,"local":500},{"start":"18:00","global":10000,"local":1000}],"location":"UTC","ramp":"5m0s"}`,
+			http.StatusOK,
+			`{"periods":[{"start":"09:00","days":["Monday"],"global":5000,"local":500},{"start":"18:00","global":10000,"local":1000}],"location":"UTC","ramp":"5m0s"}`,
+		},
+		{"invalid policy", http.MethodPut, "/policy", `{"periods":[{"start":"25:00","global":5000,"local":500}]}`, http.StatusBadRequest, ""},
+		{"empty policy", http.MethodPut, "/policy", `{"periods":[]}`, http.StatusBadRequest, ""},
+		{"stop policy", http.MethodDelete, "/policy", "", http.StatusNoContent, ""},
+		{"close conn", http.MethodDelete, "/conns/1", "", http.StatusNoContent, ""},
+		{"unknown path", http.MethodGet, "/metrics", "", http.StatusNotFound, ""},
+		{"method not allowed", http.MethodPost, "/limits", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, _ := newHandler(t)
+			w := serve(h, tt.method, tt.path, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, w.Code, w.Body, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("%s %s = %s, want %s", tt.method, tt.path, w.Body, tt.wantBody)
+			}
+			if w.Code >= 400 && !json.Valid(w.Body.Bytes()) {
+				t.Errorf("%s %s error body %q is not JSON", tt.method, tt.path, w.Body)
+			}
+		})
+	}
+}
+
+func TestHandler_InvalidLimitsNotApplied(t *testing.T) {
+	h, ln, _ := newHandler(t)
+	if w := serve(h, http.MethodPut, "/limits", `{"global":500,"local":800}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("PUT /limits = %d %s, want %d", w.Code, w.Body, http.StatusBadRequest)
+	}
+	if global, local := ln.GlobalLimit(), ln.LocalLimit(); global != 10000 || local != 1000 {
+		t.Errorf("limits = %d, %d after a rejected change, want the unchanged 10000, 1000", global, local)
+	}
+}
+
+func TestHandler_PinnedLimitKept(t *testing.T) {
+	h, ln, conn := newHandler(t)
+	if w := serve(h, http.MethodPut, "/conns/1/limit", `{"limit":300,"pin":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT /conns/1/limit = %d %s", w.Code, w.Body)
+	}
+	if err := ln.SetLocalLimit(2000); err != nil {
+		t.Fatalf("SetLocalLimit() error = %v", err)
+	}
+	if got := conn.Limit(); got != 300 {
+		t.Errorf("Limit() = %d after SetLocalLimit, want the pinned 300", got)
+	}
+
+	serve(h, http.MethodDelete, "/conns/1/limit", "")
+	if err := ln.SetLocalLimit(1500); err != nil {
+		t.Fatalf("SetLocalLimit() error = %v", err)
+	}
+	if got := conn.Limit(); got != 1500 {
+		t.Errorf("Limit() = %d after unpinning, want 1500", got)
+	}
+}
+
+func TestHandler_CloseConn(t *testing.T) {
+	h, ln, _ := newHandler(t)
+	if w := serve(h, http.MethodDelete, "/conns/1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /conns/1 = %d %s", w.Code, w.Body)
+	}
+	if conns := ln.Conns(); len(conns) != 0 {
+		t.Errorf("Conns() = %d connections after close, want none", len(conns))
+	}
+	if w := serve(h, http.MethodGet, "/conns", ""); w.Body.String() != "[]\n" {
+		t.Errorf("GET /conns = %s, want an empty list", w.Body)
+	}
+}
+
+func TestHandler_Auth(t *testing.T) {
+	h, _, _ := newHandler(t)
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"token", "Bearer " + token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/limits", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("GET /limits = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	ln, err := netlimit.NewListener(netlimittest.Listen(netlimittest.Shape{}), 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	if _, err := admin.NewHandler(ln, nil); !errors.Is(err, admin.ErrNoAuthenticator) {
+		t.Errorf("NewHandler() error = %v, want %v", err, admin.ErrNoAuthenticator)
+	}
+	h, err := admin.NewHandler(ln, admin.AllowAll)
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /limits = %d, want %d with AllowAll", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,134 @@
+package netlimit_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+// layout32 returns the size and the alignment of t on 32-bit platforms, where 64-bit integers are 4-byte aligned.
+func layout32(t reflect.Type) (size, align uintptr) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1, 1
+	case reflect.Int16, reflect.Uint16:
+		return 2, 2
+	case reflect.Int64, reflect.Uint64, reflect.Float64, reflect.Complex64:
+		return 8, 4
+	case reflect.Complex128:
+		return 16, 4
+	case reflect.String, reflect.Interface:
+		return 8, 4
+	case reflect.Slice:
+		return 12, 4
+	case reflect.Array:
+		size, align := layout32(t.Elem())
+		return size * uintptr(t.Len()), align
+	case reflect.Struct:
+		size, align := uintptr(0), uintptr(1)
+		for i := 0; i < t.NumField(); i++ {
+			s, a := layout32(t.Field(i).Type)
+			size = alignUp(size, a) + s
+			if a > align {
+				align = a
+			}
+		}
+		return alignUp(size, align), align
+	default:
+		// int, uint, uintptr, float32 and pointer-shaped kinds
+		return 4, 4
+	}
+}
+
+func alignUp(n, align uintptr) uintptr {
+	return (n + align - 1) / align * align
+}
+
+// offset32 returns the offset of the field at path, e.g. "stats.bytesRead", within t on 32-bit platforms.
+func offset32(t *testing.T, typ reflect.Type, path string) uintptr {
+	t.Helper()
+	offset := uintptr(0)
+	for _, name := range strings.Split(path, ".") {
+		found := false
+		fieldOffset := uintptr(0)
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			size, align := layout32(f.Type)
+			fieldOffset = alignUp(fieldOffset, align)
+			if f.Name == name {
+				offset += fieldOffset
+				typ = f.Type
+				found = true
+				break
+			}
+			fieldOffset += size
+		}
+		if !found {
+			t.Fatalf("%v has no field %s", typ, name)
+		}
+	}
+	return offset
+}
+
+// structOf returns the struct type of the named field of typ, e.g. of unexported types behind pointers or slices.
+func structOf(typ reflect.Type, name string) reflect.Type {
+	f, _ := typ.FieldByName(name)
+	t := f.Type
+	for t.Kind() != reflect.Struct {
+		t = t.Elem()
+	}
+	return t
+}
+
+func TestAtomicAlignment(t *testing.T) {
+	tests := []struct {
+		typ    reflect.Type
+		fields []string
+	}{
+		{
+			typ:    reflect.TypeOf(netlimit.Conn{}),
+			fields: []string{"stats.bytesRead", "stats.bytesWritten", "stats.writes", "stats.writeTime", "stats.allocWait", "limit"},
+		},
+		{
+			typ:    reflect.TypeOf(netlimit.PrefetchAllocator{}),
+			fields: []string{"available", "block", "calls", "leasedAt", "idleAt"},
+		},
+		{
+			typ:    structOf(reflect.TypeOf(netlimit.Conn{}), "events"),
+			fields: []string{"slowAlloc"},
+		},
+		{
+			typ:    reflect.TypeOf(netlimit.LeaseLimiter{}),
+			fields: []string{"reserved"},
+		},
+		{
+			typ:    reflect.TypeOf(netlimit.ShardedLimiter{}),
+			fields: []string{"limit"},
+		},
+		{
+			typ:    structOf(reflect.TypeOf(netlimit.ShardedLimiter{}), "shards"),
+			fields: []string{"demand", "pool.bytes", "pool.until"},
+		},
+		{
+			typ:    reflect.TypeOf(netlimit.DefaultAllocator{}),
+			fields: []string{"pool.bytes", "pool.until"},
+		},
+		{
+			typ:    reflect.TypeOf(netlimit.NewGlobalLimiter(1000)).Elem(),
+			fields: []string{"pool.bytes", "pool.until"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ.Name(), func(t *testing.T) {
+			// the first word of an allocated struct is 64-bit aligned, fields accessed with 64-bit atomics
+			// have to be 64-bit aligned relative to it
+			for _, field := range tt.fields {
+				if offset := offset32(t, tt.typ, field); offset%8 != 0 {
+					t.Errorf("%s.%s is at offset %d on 32-bit platforms, want a multiple of 8", tt.typ.Name(), field, offset)
+				}
+			}
+		})
+	}
+}
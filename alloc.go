@@ -20,110 +20,234 @@ var (
 // DefaultAllocator is responsible for controlling requested allocations and ensuring that they not exceed requested limits.
 // DefaultAllocator controls a single connection
 type DefaultAllocator struct {
+	// pool keeps bytes given back by release while allocations wait on the local limiter
+	pool releasePool
+
 	mu sync.Mutex
 	// global is the global limiter responsible for maintaining the global bandwidth in the requested range
-	global *rate.Limiter
+	global GlobalLimiter
 
 	// local is the local limiter responsible for maintaining the local bandwidth in the requested range
 	local *rate.Limiter
 
 	// limitUpdates is a channel used to signal that the local limit has changed
 	limitUpdates chan struct{}
+
+	// clock tells the time reservations are made at and waits for them
+	clock Clock
+
+	// logger logs retries and failures of allocations
+	logger Logger
 }
 
 // NewDefaultAllocator creates a new allocator with the given global and local limits.
 // Allocator controls requested bandwidth allocations and ensures that they not exceed requested limits.
 func NewDefaultAllocator(global *rate.Limiter, limit int) *DefaultAllocator {
+	return NewDefaultAllocatorWithLimiter(WrapLimiter(global), limit)
+}
+
+// NewDefaultAllocatorWithLimiter does the same as NewDefaultAllocator but accepts any GlobalLimiter,
+// e.g. one whose budget is shared with other processes.
+func NewDefaultAllocatorWithLimiter(global GlobalLimiter, limit int) *DefaultAllocator {
 	return &DefaultAllocator{
 		local:        rate.NewLimiter(rate.Limit(limit), limit),
 		global:       global,
 		limitUpdates: make(chan struct{}, 1),
+		clock:        realClock{},
+		logger:       nopLogger{},
 	}
 }
 
+// SetClock replaces the clock of the allocator, e.g. with a fake clock in tests.
+// SetClock must be called before the first allocation.
+func (a *DefaultAllocator) SetClock(c Clock) {
+	a.clock = c
+}
+
+// SetLogger makes the allocator log retries and failures of allocations to lg, nil discards them.
+// SetLogger must be called before the first allocation.
+func (a *DefaultAllocator) SetLogger(lg Logger) {
+	a.logger = loggerOrNop(lg)
+}
+
 // Alloc blocks until it is allowed to allocate requested quota.
 func (a *DefaultAllocator) Alloc(ctx context.Context, requestedQuota int) (int, error) {
 	grantedQuota, err := a.TryAlloc(ctx, requestedQuota)
-	// this looks like a busy loop, but it's not, most of the time it waits on WaitN or on a time.Timer.C channel
+	// this looks like a busy loop, but it's not, most of the time it waits on a time.Timer.C channel
 	for err == ErrLimitChangedInflight {
+		a.logger.Debug("allocation retried after limit change", "requested", requestedQuota)
 		grantedQuota, err = a.TryAlloc(ctx, requestedQuota)
 	}
 
+	switch {
+	case err == nil:
+	case err == ErrCouldNotReserveGlobal:
+		a.logger.Warn("could not reserve quota in global limiter", "requested", requestedQuota)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		a.logger.Debug("allocation cancelled", "requested", requestedQuota, "err", err)
+	default:
+		a.logger.Error("allocation failed", "requested", requestedQuota, "err", err)
+	}
 	return grantedQuota, err
 }
 
-// TryAlloc reserves quota in a global limiter and then blocks until it is allowed to allocate the quota in the local limiter.
-// Once the local limiter allows allocation, TryAlloc waits for the readiness or the global reservation
+// TryAlloc reserves quota in both the global and the local limiter and then blocks until both reservations are ready.
+// TryAlloc neither starts goroutines nor allocates timers per call, waiting is done on a pooled time.Timer
+// and does not happen at all when both limiters allow the allocation right away.
 func (a *DefaultAllocator) TryAlloc(ctx context.Context, quota int) (int, error) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	grantedQuota, reservation := a.reserveGlobal(quota)
-	if !reservation.OK() {
+	now := a.clock.Now()
+	grantedQuota, global := a.reserveGlobal(now, quota)
+	if !global.OK() {
 		return 0, ErrCouldNotReserveGlobal
 	}
 
-	availableAt := time.NewTimer(reservation.DelayFrom(time.Now()))
-	err := a.tryAllocLocal(ctx, grantedQuota)
-	if err != nil {
-		reservation.Cancel()
-		return 0, err
+	released := a.pool.take(now, grantedQuota)
+	var local *rate.Reservation
+	if released < grantedQuota {
+		local = a.local.ReserveN(now, grantedQuota-released)
+		if !local.OK() {
+			// the burst of the local limiter was lowered by SetLimit since grantedQuota was capped to it
+			a.cancel(now, local, global, released)
+			return 0, ErrLimitChangedInflight
+		}
+	}
+
+	delay := global.DelayFrom(now)
+	if local != nil {
+		if localDelay := local.DelayFrom(now); localDelay > delay {
+			delay = localDelay
+		}
+	}
+
+	if delay <= 0 {
+		select {
+		case <-a.limitUpdates:
+			a.cancel(now, local, global, released)
+			return 0, ErrLimitChangedInflight
+		default:
+			return grantedQuota, nil
+		}
 	}
 
+	availableAt := newTimer(a.clock, delay)
+	defer stopTimer(availableAt)
 	select {
+	case <-availableAt.C():
+		return grantedQuota, nil
 	case <-a.limitUpdates:
-		reservation.Cancel()
+		a.cancel(a.clock.Now(), local, global, released)
 		return 0, ErrLimitChangedInflight
-	default:
+	case <-ctx.Done():
+		a.cancel(a.clock.Now(), local, global, released)
+		return 0, ctx.Err()
 	}
+}
 
-	<-availableAt.C
-	return grantedQuota, nil
+// cancel reverses the reservations of an allocation and gives the released bytes it took back.
+func (a *DefaultAllocator) cancel(now time.Time, local *rate.Reservation, global Reservation, released int) {
+	if local != nil {
+		local.CancelAt(now)
+	}
+	global.Cancel()
+	a.pool.put(released, a.local.Burst())
 }
 
-func (a *DefaultAllocator) reserveGlobal(quota int) (int, *rate.Reservation) {
+func (a *DefaultAllocator) reserveGlobal(now time.Time, quota int) (int, Reservation) {
 	if quota > int(a.local.Limit()) {
 		quota = int(a.local.Limit())
 	}
+	if burst := a.local.Burst(); quota > burst {
+		quota = burst
+	}
+	if burst := a.global.Burst(); quota > burst {
+		quota = burst
+	}
 
-	return quota, a.global.ReserveN(time.Now(), quota)
+	return quota, a.global.ReserveN(now, quota)
 }
 
-func (a *DefaultAllocator) tryAllocLocal(ctx context.Context, quota int) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	allowedLocal := make(chan bool, 1)
+// release gives n allocated but unused bytes back to the local limiter, see releaseTo, and, if it implements Releaser,
+// to the global limiter.
+func (a *DefaultAllocator) release(n int) {
+	releaseTo(a.local, &a.pool, a.clock.Now(), n)
+	if r, ok := a.global.(Releaser); ok {
+		r.Release(n)
+	}
+}
 
-	go func() {
-		if err := a.local.WaitN(ctx, quota); err != nil {
-			allowedLocal <- false
-		}
-		allowedLocal <- true
-	}()
+// waitN blocks until lim allows n bytes on the time of c, like rate.Limiter.WaitN does on the real time.
+func waitN(ctx context.Context, lim *rate.Limiter, c Clock, n int) error {
+	now := c.Now()
+	r := lim.ReserveN(now, n)
+	if !r.OK() {
+		return fmt.Errorf("failed to wait for %d bytes exceeding the burst of %d", n, lim.Burst())
+	}
+	delay := r.DelayFrom(now)
+	if delay <= 0 {
+		return nil
+	}
 
+	t := newTimer(c, delay)
+	defer stopTimer(t)
 	select {
-	case allowed := <-allowedLocal:
-		if !allowed {
-			return fmt.Errorf("could not allocate quota in local limiter")
-		}
+	case <-t.C():
 		return nil
-	case <-a.limitUpdates:
-		return ErrLimitChangedInflight
 	case <-ctx.Done():
+		r.CancelAt(c.Now())
 		return ctx.Err()
 	}
 }
 
+// newTimer returns a Timer of c, timers of the real clock come from the pool.
+func newTimer(c Clock, d time.Duration) Timer {
+	if _, ok := c.(realClock); ok {
+		return acquireTimer(d)
+	}
+	return c.NewTimer(d)
+}
+
+// stopTimer stops t and returns it to the pool if it is a timer of the real clock.
+func stopTimer(t Timer) {
+	if rt, ok := t.(*realTimer); ok {
+		releaseTimer(rt)
+		return
+	}
+	t.Stop()
+}
+
+// timers are reused between allocations, so that waiting for quota does not allocate a time.Timer per call
+var timers sync.Pool
+
+func acquireTimer(d time.Duration) *realTimer {
+	if t, ok := timers.Get().(*realTimer); ok {
+		t.timer.Reset(d)
+		return t
+	}
+	return &realTimer{timer: time.NewTimer(d)}
+}
+
+func releaseTimer(t *realTimer) {
+	if !t.timer.Stop() {
+		// the timer has fired, drain the channel unless the value has already been received
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+	timers.Put(t)
+}
+
 // SetLimit sets the limit of the local limiter.
 // setting new limit will attempt to cancel inflight allocations.
 func (a *DefaultAllocator) SetLimit(limit int) error {
-	if limit > int(a.global.Limit()) {
+	if limit > a.global.Limit() {
 		return fmt.Errorf("local limit cannot be higher than global limit")
 	}
 
 	a.mu.Lock()
-	a.local.SetLimit(rate.Limit(limit))
-	a.local.SetBurst(limit)
+	now := a.clock.Now()
+	a.local.SetLimitAt(now, rate.Limit(limit))
+	a.local.SetBurstAt(now, limit)
 	a.mu.Unlock()
 
 	select {
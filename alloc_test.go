@@ -2,9 +2,12 @@ package netlimit_test
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
 	"golang.org/x/time/rate"
 )
 
@@ -119,3 +122,145 @@ func TestAllocator_Alloc(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkDefaultAllocator_Alloc(b *testing.B) {
+	a := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1<<30), 1<<30)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Alloc(ctx, 1024); err != nil {
+			b.Fatalf("Alloc() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkDefaultAllocator_AllocParallel(b *testing.B) {
+	global := rate.NewLimiter(rate.Inf, 1<<30)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// every goroutine models a separate connection sharing the global limiter
+		a := netlimit.NewDefaultAllocator(global, 1<<30)
+		for pb.Next() {
+			if _, err := a.Alloc(ctx, 1024); err != nil {
+				b.Errorf("Alloc() error = %v", err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkDefaultAllocator_AllocWaiting(b *testing.B) {
+	// the local limit is high enough for every Alloc to wait a little
+	a := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1<<30), 1<<20)
+	ctx := context.Background()
+	a.Alloc(ctx, 1<<20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Alloc(ctx, 64); err != nil {
+			b.Fatalf("Alloc() error = %v", err)
+		}
+	}
+}
+
+func TestDefaultAllocator_Clock(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	global := netlimit.NewGlobalLimiterWithClock(1000, clock)
+	a := netlimit.NewDefaultAllocatorWithLimiter(global, 1000)
+	a.SetClock(clock)
+
+	// the burst is available right away
+	if got, err := a.Alloc(context.Background(), 1000); err != nil || got != 1000 {
+		t.Fatalf("Alloc() = %d, %v, want 1000", got, err)
+	}
+
+	done := make(chan int)
+	go func() {
+		got, _ := a.Alloc(context.Background(), 500)
+		done <- got
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(499 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("Alloc() returned before quota was available")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if got := <-done; got != 500 {
+		t.Errorf("Alloc() = %d, want 500", got)
+	}
+}
+
+// lowerOnReserve is a GlobalLimiter that lowers the local limit of alloc on its first reservation,
+// between the global and the local reservation of an allocation.
+type lowerOnReserve struct {
+	netlimit.GlobalLimiter
+	alloc *netlimit.DefaultAllocator
+	limit int
+	once  sync.Once
+}
+
+func (l *lowerOnReserve) ReserveN(now time.Time, n int) netlimit.Reservation {
+	l.once.Do(func() {
+		l.alloc.SetLimit(l.limit)
+	})
+	return l.GlobalLimiter.ReserveN(now, n)
+}
+
+func TestDefaultAllocator_LimitLoweredBetweenReservations(t *testing.T) {
+	global := &lowerOnReserve{GlobalLimiter: netlimit.NewGlobalLimiter(1000), limit: 100}
+	a := netlimit.NewDefaultAllocatorWithLimiter(global, 1000)
+	global.alloc = a
+
+	got, err := a.Alloc(context.Background(), 1000)
+	if err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	if got != 100 {
+		t.Errorf("Alloc() = %d, want the lowered limit %d", got, 100)
+	}
+}
+
+func TestDefaultAllocator_SetLimitInflight(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	global := netlimit.NewGlobalLimiterWithClock(10000, clock)
+	a := netlimit.NewDefaultAllocatorWithLimiter(global, 100)
+	a.SetClock(clock)
+	if _, err := a.Alloc(context.Background(), 100); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+
+	// the allocation waits 1s at the old limit, it is cancelled and retried at the new one
+	start := clock.Now()
+	done := make(chan int, 1)
+	go func() {
+		got, _ := a.Alloc(context.Background(), 100)
+		done <- got
+	}()
+	clock.BlockUntil(1)
+	if err := a.SetLimit(1000); err != nil {
+		t.Fatalf("SetLimit() error = %v", err)
+	}
+	// wait for the allocation to be retried
+	for {
+		next, ok := clock.Next()
+		if ok && next.Before(start.Add(time.Second)) {
+			break
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	clock.Advance(99 * time.Millisecond)
+	select {
+	case got := <-done:
+		t.Fatalf("Alloc() = %d returned before quota was available at the new limit", got)
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if got := <-done; got != 100 {
+		t.Errorf("Alloc() = %d, want %d", got, 100)
+	}
+}
@@ -0,0 +1,182 @@
+package netlimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var _ Allocator = (*BoostAllocator)(nil)
+
+var (
+	// ErrInvalidBoost is returned when a Boost never ends or is slower than the limit it boosts.
+	ErrInvalidBoost = errors.New("boost must be bounded by bytes or duration and faster than the local limit")
+)
+
+// Boost describes the ISP-style "boost then throttle" behaviour of a connection, the connection starts at Rate
+// and, once it transferred Bytes or Duration elapsed, whichever comes first, drops smoothly to its local limit.
+type Boost struct {
+	// Rate is the bytes per second limit of the connection while it is boosted
+	Rate int
+
+	// Bytes is the number of bytes transferred at Rate, 0 means the boost is not bounded by bytes
+	Bytes int64
+
+	// Duration is the time the connection runs at Rate, 0 means the boost is not bounded by time
+	Duration time.Duration
+
+	// Ramp is the time over which the limit drops linearly from Rate to the local limit, 0 drops it at once
+	Ramp time.Duration
+}
+
+func (b *Boost) validate(limit int) error {
+	if b.Bytes <= 0 && b.Duration <= 0 {
+		return ErrInvalidBoost
+	}
+	if b.Rate < limit {
+		return ErrInvalidBoost
+	}
+	return nil
+}
+
+// BoostAllocator is an Allocator that lets a connection run at a boosted rate for its first bytes or seconds
+// and then throttles it smoothly down to its local limit. Small responses feel instant, long transfers are still
+// throttled. The wrapped Allocator has to allow at least the boosted rate.
+type BoostAllocator struct {
+	Allocator
+
+	mu sync.Mutex
+
+	// boost is the boost of the connection
+	boost Boost
+
+	// limit is the steady-state bytes per second limit of the connection
+	limit int
+
+	// limiter throttles the connection once the boost ends
+	limiter *rate.Limiter
+
+	// start is the time the connection started at
+	start time.Time
+
+	// transferred is the number of bytes granted so far
+	transferred int64
+
+	// ended is the time the boost ended at, zero while the connection is boosted
+	ended time.Time
+
+	// clock tells the time the boost starts, ends and ramps down at and waits for the throttled rate
+	clock Clock
+}
+
+// NewBoostAllocator returns an Allocator that boosts the connection according to b and then throttles it down to
+// limit bytes per second. a has to allow at least b.Rate bytes per second.
+func NewBoostAllocator(a Allocator, b Boost, limit int) (*BoostAllocator, error) {
+	if err := b.validate(limit); err != nil {
+		return nil, err
+	}
+
+	ba := &BoostAllocator{
+		Allocator: a,
+		boost:     b,
+		limit:     limit,
+		limiter:   rate.NewLimiter(rate.Limit(b.Rate), b.Rate),
+		clock:     realClock{},
+	}
+	ba.start = ba.clock.Now()
+	return ba, nil
+}
+
+// SetClock replaces the clock of the allocator, e.g. with a fake clock in tests, the boost starts over at its time.
+// SetClock must be called before the first allocation.
+func (a *BoostAllocator) SetClock(c Clock) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clock = c
+	a.start = c.Now()
+}
+
+// Alloc blocks until it is allowed to allocate requested quota at the current, possibly boosted, rate.
+func (a *BoostAllocator) Alloc(ctx context.Context, requestedQuota int) (int, error) {
+	a.mu.Lock()
+	clock := a.clock
+	now := clock.Now()
+	current := a.rate(now)
+	boosted := a.ended.IsZero()
+	if !boosted {
+		a.limiter.SetLimitAt(now, rate.Limit(current))
+		a.limiter.SetBurstAt(now, current)
+		if requestedQuota > current {
+			requestedQuota = current
+		}
+	}
+	if boosted && a.boost.Bytes > 0 {
+		// do not overshoot the boosted bytes
+		if left := a.boost.Bytes - a.transferred; int64(requestedQuota) > left {
+			requestedQuota = int(left)
+		}
+	}
+	a.mu.Unlock()
+
+	if !boosted {
+		if err := waitN(ctx, a.limiter, clock, requestedQuota); err != nil {
+			return 0, err
+		}
+	}
+
+	granted, err := a.Allocator.Alloc(ctx, requestedQuota)
+	if err != nil {
+		return 0, err
+	}
+
+	a.mu.Lock()
+	a.transferred += int64(granted)
+	a.mu.Unlock()
+	return granted, nil
+}
+
+// rate returns the bytes per second limit in effect at now and ends the boost once it is used up.
+// rate must be called with a.mu held.
+func (a *BoostAllocator) rate(now time.Time) int {
+	if a.ended.IsZero() {
+		bytesLeft := a.boost.Bytes <= 0 || a.transferred < a.boost.Bytes
+		timeLeft := a.boost.Duration <= 0 || now.Sub(a.start) < a.boost.Duration
+		if bytesLeft && timeLeft {
+			return a.boost.Rate
+		}
+		a.ended = now
+	}
+
+	elapsed := now.Sub(a.ended)
+	if a.boost.Ramp <= 0 || elapsed >= a.boost.Ramp {
+		return a.limit
+	}
+	progress := float64(elapsed) / float64(a.boost.Ramp)
+	return interpolate(a.boost.Rate, a.limit, progress)
+}
+
+// Boosted reports whether the connection still runs at the boosted rate.
+func (a *BoostAllocator) Boosted() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rate(a.clock.Now())
+	return a.ended.IsZero()
+}
+
+// SetLimit sets the steady-state limit the connection is throttled down to once the boost ends.
+func (a *BoostAllocator) SetLimit(limit int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if limit > a.boost.Rate {
+		// the wrapped allocator only allows the boosted rate
+		if err := a.Allocator.SetLimit(limit); err != nil {
+			return err
+		}
+		a.boost.Rate = limit
+	}
+	a.limit = limit
+	return nil
+}
@@ -0,0 +1,155 @@
+package netlimit_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+	"golang.org/x/time/rate"
+)
+
+func TestBoostAllocator_Alloc(t *testing.T) {
+	tests := []struct {
+		name     string
+		boost    netlimit.Boost
+		limit    int
+		requests []int
+		want     []int
+		wantWait time.Duration
+	}{
+		{
+			name: "boosted bytes are not throttled by the local limit",
+			boost: netlimit.Boost{
+				Rate:  1000,
+				Bytes: 500,
+			},
+			limit:    10,
+			requests: []int{200, 200},
+			want:     []int{200, 200},
+		},
+		{
+			name: "alloc is truncated to the boosted bytes left",
+			boost: netlimit.Boost{
+				Rate:  1000,
+				Bytes: 300,
+			},
+			limit:    10,
+			requests: []int{200, 200},
+			want:     []int{200, 100},
+		},
+		{
+			name: "throttled to the local limit once the boost is used up",
+			boost: netlimit.Boost{
+				Rate:  1000,
+				Bytes: 100,
+			},
+			limit:    100,
+			requests: []int{100, 100, 50},
+			want:     []int{100, 100, 50},
+			wantWait: 500 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+			next := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1000), tt.boost.Rate)
+			next.SetClock(clock)
+			a, err := netlimit.NewBoostAllocator(next, tt.boost, tt.limit)
+			if err != nil {
+				t.Fatalf("NewBoostAllocator() error = %v", err)
+			}
+			a.SetClock(clock)
+			done := make(chan struct{})
+			defer close(done)
+			go clock.AdvanceUntil(done, 10*time.Millisecond)
+
+			now := clock.Now()
+			for i, requested := range tt.requests {
+				got, err := a.Alloc(context.Background(), requested)
+				if err != nil {
+					t.Fatalf("Alloc() error = %v", err)
+				}
+				if got != tt.want[i] {
+					t.Errorf("Alloc() got = %v, want %v", got, tt.want[i])
+				}
+			}
+			if elapsed := clock.Now().Sub(now); elapsed != tt.wantWait {
+				t.Errorf("Alloc() waited %v, want %v", elapsed, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestBoostAllocator_Boosted(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	next := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1000), 1000)
+	a, err := netlimit.NewBoostAllocator(next, netlimit.Boost{Rate: 1000, Duration: 50 * time.Millisecond}, 10)
+	if err != nil {
+		t.Fatalf("NewBoostAllocator() error = %v", err)
+	}
+	a.SetClock(clock)
+	clock.Advance(49 * time.Millisecond)
+	if !a.Boosted() {
+		t.Errorf("Boosted() = false, want true")
+	}
+	clock.Advance(time.Millisecond)
+	if a.Boosted() {
+		t.Errorf("Boosted() = true, want false")
+	}
+
+	if _, err := netlimit.NewBoostAllocator(next, netlimit.Boost{Rate: 1000}, 10); err != netlimit.ErrInvalidBoost {
+		t.Errorf("NewBoostAllocator() error = %v, wantErr %v", err, netlimit.ErrInvalidBoost)
+	}
+}
+
+func TestListener_SetBoost(t *testing.T) {
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 1000, 10)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	ln.SetClock(clock)
+	done := make(chan struct{})
+	defer close(done)
+	go clock.AdvanceUntil(done, 10*time.Millisecond)
+	if err := ln.SetBoost(&netlimit.Boost{Rate: 1000, Bytes: 100, Ramp: time.Second}); err != nil {
+		t.Fatalf("SetBoost() error = %v", err)
+	}
+	if err := ln.SetBurstCredits(100, time.Hour); err == nil {
+		t.Errorf("SetBurstCredits() error = nil, want error")
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Errorf("Dial() error = %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 100))
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer c.Close()
+
+	now := clock.Now()
+	b := make([]byte, 100)
+	read := 0
+	for read < len(b) {
+		n, err := c.Read(b[read:])
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		read += n
+	}
+	// the local limit of 10 bytes per second would take 9s of virtual time
+	if elapsed := clock.Now().Sub(now); elapsed != 0 {
+		t.Errorf("Read() took %v of virtual time, want boosted read", elapsed)
+	}
+}
@@ -0,0 +1,65 @@
+package netlimit
+
+import "time"
+
+var _ Clock = realClock{}
+
+// Clock tells the time and waits for it to pass. Allocators, limiters and listeners use the real clock by default,
+// netlimittest provides a fake clock that makes rate behaviour deterministic in tests and simulations.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer returns a Timer that fires after d.
+	NewTimer(d time.Duration) Timer
+
+	// Sleep blocks until d has passed.
+	Sleep(d time.Duration)
+}
+
+// Timer is a single event created by a Clock, it behaves like time.Timer.
+type Timer interface {
+	// C returns the channel the current time is sent on when the Timer fires.
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing, it returns false if the Timer has already fired or been stopped.
+	Stop() bool
+
+	// Reset changes the Timer to fire after d, it returns true if the Timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// RealClock returns the Clock backed by the time package.
+func RealClock() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{timer: time.NewTimer(d)}
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t *realTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
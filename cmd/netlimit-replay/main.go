@@ -0,0 +1,54 @@
+// Command netlimit-replay replays a trace recorded with netlimit.TraceWriter against a pair of limits
+// and prints the resulting latency and throughput.
+//
+// Usage:
+//
+//	netlimit-replay -global 10485760 -local 1048576 trace.nltr
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+func main() {
+	global := flag.Int("global", 10*1024*1024, "bytes per second limit of all connections combined")
+	local := flag.Int("local", 1024*1024, "bytes per second limit of every connection")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] trace\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to open trace: %v", err)
+	}
+	defer f.Close()
+
+	report, err := netlimit.Replay(netlimit.NewTraceReader(f), *global, *local)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if report.Truncated {
+		log.Printf("trace %s is truncated, replaying its complete events", flag.Arg(0))
+	}
+	fmt.Printf("conns       %d\n", report.Conns)
+	fmt.Printf("events      %d\n", report.Events)
+	fmt.Printf("bytes       %d\n", report.Bytes)
+	fmt.Printf("duration    %v\n", report.Duration)
+	fmt.Printf("throughput  %.0f B/s\n", report.Throughput)
+	fmt.Printf("wait mean   %v\n", report.MeanWait)
+	fmt.Printf("wait p50    %v\n", report.P50Wait)
+	fmt.Printf("wait p95    %v\n", report.P95Wait)
+	fmt.Printf("wait p99    %v\n", report.P99Wait)
+	fmt.Printf("wait max    %v\n", report.MaxWait)
+}
@@ -2,11 +2,28 @@ package netlimit
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var _ net.Conn = (*Conn)(nil)
+var (
+	_ net.Conn      = (*Conn)(nil)
+	_ io.ReaderFrom = (*Conn)(nil)
+	_ io.WriterTo   = (*Conn)(nil)
+)
+
+// ErrNoQuotaGranted is returned by copies in chunks of granted quota when the Allocator grants no bytes,
+// which would make them loop forever.
+var ErrNoQuotaGranted = errors.New("allocator granted no quota")
+
+// copyChunkSize is the maximum quota requested for a single chunk of ReadFrom and WriteTo,
+// allocators grant at most their burst, so chunks are usually smaller
+const copyChunkSize = 1 << 20
 
 type Allocator interface {
 	Alloc(ctx context.Context, n int) (int, error)
@@ -14,7 +31,14 @@ type Allocator interface {
 }
 
 // Conn is a net.Conn that obeys quota limits managed by Allocator
+// Fields accessed with 64-bit atomics come first, so that they are 64-bit aligned on 32-bit platforms.
 type Conn struct {
+	// stats are the traffic counters of this connection, updated atomically
+	stats connStats
+
+	// limit is the local limit of the connection, 0 if unknown, accessed atomically
+	limit int64
+
 	net.Conn
 
 	// a is the allocator that controls the quota requests and bandwidth allocations for this connection
@@ -22,6 +46,81 @@ type Conn struct {
 
 	// done is a channel used to signal that the connection is closed and ready to be gc'd
 	done chan struct{}
+
+	// opened is the time the connection was wrapped at
+	opened time.Time
+
+	// clock tells the time of stats, trace records and events of the connection
+	clock Clock
+
+	mu sync.Mutex
+
+	// prefetch is the PrefetchAllocator of the connection, if any, its leftovers are released on Close
+	prefetch *PrefetchAllocator
+
+	// quota is the QuotaAllocator of the connection, if any, quota granted but not transferred is given back to it
+	quota *QuotaAllocator
+
+	// pacing is set when the pacing rate of the underlying socket follows the limit of the connection
+	pacing bool
+
+	// trace records reads and writes of the connection as traceID, it is nil if the connection is not traced
+	trace   *TraceWriter
+	traceID uint64
+
+	// events publishes lifecycle events of the connection, it is nil unless the connection was accepted by a Listener
+	events *events
+
+	// throttled is set while allocations of the connection wait for quota, accessed atomically
+	throttled int32
+
+	// closed is set once the connection is closed, accessed atomically
+	closed int32
+
+	// logger logs the close of the connection
+	logger Logger
+
+	// id identifies the connection among connections of its Listener, 0 for connections not accepted by a Listener
+	id uint64
+
+	// limitMu serializes changes of the limit, so that a limit change of the Listener never overrides a pinned limit
+	limitMu sync.Mutex
+
+	// pinned is set while the limit of the connection is pinned, guarded by limitMu
+	pinned bool
+}
+
+// connStats are the traffic counters of a Conn, all fields are accessed atomically.
+type connStats struct {
+	bytesRead    int64
+	bytesWritten int64
+	writes       int64
+	writeTime    int64
+	allocWait    int64
+}
+
+// ConnStats is a snapshot of the traffic of a Conn.
+type ConnStats struct {
+	// Opened is the time the connection was wrapped at
+	Opened time.Time
+
+	// BytesRead is the number of bytes read from the connection
+	BytesRead int64
+
+	// BytesWritten is the number of bytes written to the connection
+	BytesWritten int64
+
+	// Writes is the number of writes issued to the underlying connection
+	Writes int64
+
+	// WriteTime is the time spent in writes to the underlying connection, excluding waiting for quota
+	WriteTime time.Duration
+
+	// AllocWait is the time spent waiting for quota granted by the Allocator
+	AllocWait time.Duration
+
+	// TCP is a sample of TCP_INFO of the underlying socket, nil where TCP_INFO is not supported
+	TCP *TCPInfo
 }
 
 // NewConn returns a new Conn
@@ -29,11 +128,21 @@ func NewConn(conn net.Conn, a Allocator) (*Conn, error) {
 	if a == nil {
 		return nil, fmt.Errorf("allocator cannot be nil")
 	}
-	return &Conn{
-		Conn: conn,
-		a:    a,
-		done: make(chan struct{}, 1),
-	}, nil
+	c := &Conn{
+		Conn:   conn,
+		a:      a,
+		done:   make(chan struct{}, 1),
+		clock:  realClock{},
+		logger: nopLogger{},
+	}
+	c.opened = c.clock.Now()
+	if p, ok := a.(*PrefetchAllocator); ok {
+		c.prefetch = p
+	}
+	if q, ok := a.(*QuotaAllocator); ok {
+		c.quota = q
+	}
+	return c, nil
 }
 
 // Read reads data from the connection.
@@ -42,12 +151,17 @@ func NewConn(conn net.Conn, a Allocator) (*Conn, error) {
 // Read will obey quota rules set by Listener
 func (c *Conn) Read(b []byte) (n int, err error) {
 	ctx := context.Background()
-	granted, err := c.a.Alloc(ctx, len(b))
+	start := c.clock.Now()
+	granted, err := c.alloc(ctx, len(b))
 	if err != nil {
 		return 0, fmt.Errorf("failed to allocate quota: %w", err)
 	}
 
-	return c.Conn.Read(b[:granted])
+	n, err = c.Conn.Read(b[:granted])
+	atomic.AddInt64(&c.stats.bytesRead, int64(n))
+	c.record(DirectionRead, start, n, granted)
+	c.refund(granted, n)
+	return n, err
 }
 
 // Write writes data to the connection.
@@ -56,10 +170,16 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 // Write will obey quota rules set by Listener
 func (c *Conn) Write(b []byte) (n int, err error) {
 	ctx := context.Background()
-	granted, err := c.a.Alloc(ctx, len(b))
+	start := c.clock.Now()
+	granted, err := c.alloc(ctx, len(b))
 	if err != nil {
 		return 0, fmt.Errorf("failed to allocate quota: %w", err)
 	}
+	totalGranted := granted
+	defer func() {
+		c.record(DirectionWrite, start, n, totalGranted)
+		c.refund(totalGranted, n)
+	}()
 
 	written := 0
 	total := len(b)
@@ -70,7 +190,7 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 			tail = total
 		}
 
-		n, err = c.Conn.Write(b[written:tail])
+		n, err = c.write(b[written:tail])
 		if err != nil {
 			return written, err
 		}
@@ -80,21 +200,335 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 		if quotaToRequest == 0 {
 			break
 		}
-		granted, err = c.a.Alloc(ctx, quotaToRequest)
+		granted, err = c.alloc(ctx, quotaToRequest)
+		if err != nil {
+			return written, fmt.Errorf("failed to allocate quota: %w", err)
+		}
+		totalGranted += granted
+	}
+	return written, err
+}
+
+// WriteBuffers writes the contents of v to the connection, like v.WriteTo(c) but with a single vectored write,
+// writev where the underlying connection supports it, per chunk of granted quota. Buffers are split along quota
+// boundaries without copying. v is consumed by the bytes written, as in net.Buffers.WriteTo.
+func (c *Conn) WriteBuffers(v *net.Buffers) (int64, error) {
+	ctx := context.Background()
+	written := int64(0)
+	for {
+		remaining := int64(0)
+		for _, b := range *v {
+			remaining += int64(len(b))
+		}
+		if remaining == 0 {
+			return written, nil
+		}
+
+		quota := copyChunkSize
+		if remaining < int64(quota) {
+			quota = int(remaining)
+		}
+		start := c.clock.Now()
+		granted, err := c.alloc(ctx, quota)
+		if err != nil {
+			return written, fmt.Errorf("failed to allocate quota: %w", err)
+		}
+		if granted <= 0 {
+			return written, ErrNoQuotaGranted
+		}
+
+		n, err := c.writeBuffers(headBuffers(*v, granted))
+		c.record(DirectionWrite, start, int(n), granted)
+		c.refund(granted, int(n))
+		written += n
+		consumeBuffers(v, n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// headBuffers returns buffers referencing the first n bytes of v.
+func headBuffers(v net.Buffers, n int) net.Buffers {
+	head := make(net.Buffers, 0, len(v))
+	for _, b := range v {
+		if n <= 0 {
+			break
+		}
+		if len(b) > n {
+			b = b[:n]
+		}
+		head = append(head, b)
+		n -= len(b)
+	}
+	return head
+}
+
+// consumeBuffers removes the first n bytes from v.
+func consumeBuffers(v *net.Buffers, n int64) {
+	for len(*v) > 0 {
+		l := int64(len((*v)[0]))
+		if l > n {
+			(*v)[0] = (*v)[0][n:]
+			return
+		}
+		n -= l
+		*v = (*v)[1:]
+	}
+}
+
+// ReadFrom writes data read from r to the connection until EOF, see io.ReaderFrom.
+// Data is copied in chunks of granted quota with io.CopyN, so that the underlying connection can still use
+// sendfile or splice, e.g. when copying from an *os.File or another TCP connection to a *net.TCPConn.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	ctx := context.Background()
+	// a single io.LimitedReader is unwrapped, so that the underlying connection does not see nested limits
+	lr, limited := r.(*io.LimitedReader)
+	written := int64(0)
+	for {
+		quota := copyChunkSize
+		if limited {
+			if lr.N <= 0 {
+				return written, nil
+			}
+			if lr.N < int64(quota) {
+				quota = int(lr.N)
+			}
+		}
+
+		start := c.clock.Now()
+		granted, err := c.alloc(ctx, quota)
 		if err != nil {
 			return written, fmt.Errorf("failed to allocate quota: %w", err)
 		}
+		if granted <= 0 {
+			return written, ErrNoQuotaGranted
+		}
+
+		var n int64
+		if limited {
+			n, err = c.copyFrom(lr.R, int64(granted))
+			lr.N -= n
+		} else {
+			n, err = c.copyFrom(r, int64(granted))
+		}
+		c.record(DirectionWrite, start, int(n), granted)
+		c.refund(granted, int(n))
+		written += n
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// WriteTo writes data read from the connection to w until EOF, see io.WriterTo.
+// Data is copied in chunks of granted quota with io.CopyN, so that w can still use sendfile or splice.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	ctx := context.Background()
+	read := int64(0)
+	for {
+		start := c.clock.Now()
+		granted, err := c.alloc(ctx, copyChunkSize)
+		if err != nil {
+			return read, fmt.Errorf("failed to allocate quota: %w", err)
+		}
+		if granted <= 0 {
+			return read, ErrNoQuotaGranted
+		}
+
+		n, err := io.CopyN(w, c.Conn, int64(granted))
+		atomic.AddInt64(&c.stats.bytesRead, n)
+		c.record(DirectionRead, start, int(n), granted)
+		c.refund(granted, int(n))
+		read += n
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// alloc requests quota from the Allocator and records the time spent waiting for it.
+func (c *Conn) alloc(ctx context.Context, n int) (int, error) {
+	start := c.clock.Now()
+	granted, err := c.a.Alloc(ctx, n)
+	wait := c.clock.Now().Sub(start)
+	atomic.AddInt64(&c.stats.allocWait, int64(wait))
+	if c.events != nil {
+		c.events.allocated(c, &c.throttled, wait, err)
+	}
+	return granted, err
+}
+
+// write writes b to the underlying connection and records the time spent writing.
+func (c *Conn) write(b []byte) (int, error) {
+	start := c.clock.Now()
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.stats.writeTime, int64(c.clock.Now().Sub(start)))
+	atomic.AddInt64(&c.stats.writes, 1)
+	atomic.AddInt64(&c.stats.bytesWritten, int64(n))
+	return n, err
+}
+
+// writeBuffers writes v to the underlying connection and records it as a single write.
+func (c *Conn) writeBuffers(v net.Buffers) (int64, error) {
+	start := c.clock.Now()
+	n, err := v.WriteTo(c.Conn)
+	atomic.AddInt64(&c.stats.writeTime, int64(c.clock.Now().Sub(start)))
+	atomic.AddInt64(&c.stats.writes, 1)
+	atomic.AddInt64(&c.stats.bytesWritten, n)
+	return n, err
+}
+
+// record records a read or write issued at start to the trace of the connection, if any.
+func (c *Conn) record(d Direction, start time.Time, size, granted int) {
+	if c.trace == nil {
+		return
+	}
+	c.trace.Record(TraceEvent{Time: start, Conn: c.traceID, Direction: d, Size: size, Granted: granted})
+}
+
+// refund gives quota granted but not transferred back to the QuotaAllocator of the connection, if any,
+// so that keys are charged only the bytes they transfer.
+func (c *Conn) refund(granted, n int) {
+	if c.quota != nil && n < granted {
+		c.quota.unused(granted - n)
 	}
+}
+
+// copyFrom copies n bytes from r to the underlying connection and records it as a single write.
+func (c *Conn) copyFrom(r io.Reader, n int64) (int64, error) {
+	start := c.clock.Now()
+	written, err := io.CopyN(c.Conn, r, n)
+	atomic.AddInt64(&c.stats.writeTime, int64(c.clock.Now().Sub(start)))
+	atomic.AddInt64(&c.stats.writes, 1)
+	atomic.AddInt64(&c.stats.bytesWritten, written)
 	return written, err
 }
 
+// SetClock replaces the clock the connection times its stats, trace records and events with,
+// e.g. with the fake clock of its Allocator in tests. SetClock must be called before the connection is used.
+func (c *Conn) SetClock(clock Clock) {
+	c.clock = clock
+	c.opened = clock.Now()
+}
+
+// SetTrace records every read and write of the connection to t, see TraceWriter and Replay.
+// SetTrace must be called before the connection is used.
+func (c *Conn) SetTrace(t *TraceWriter) {
+	c.trace = t
+	c.traceID = t.conn()
+}
+
+// Stats returns a snapshot of the traffic of the connection.
+// On Linux the snapshot includes a sample of TCP_INFO of the underlying TCP socket.
+func (c *Conn) Stats() ConnStats {
+	stats := ConnStats{
+		Opened:       c.opened,
+		BytesRead:    atomic.LoadInt64(&c.stats.bytesRead),
+		BytesWritten: atomic.LoadInt64(&c.stats.bytesWritten),
+		Writes:       atomic.LoadInt64(&c.stats.writes),
+		WriteTime:    time.Duration(atomic.LoadInt64(&c.stats.writeTime)),
+		AllocWait:    time.Duration(atomic.LoadInt64(&c.stats.allocWait)),
+	}
+	if info, err := c.TCPInfo(); err == nil {
+		stats.TCP = &info
+	}
+	return stats
+}
+
+// ID returns the id of the connection among connections of its Listener, 0 if it was not accepted by a Listener.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// Limit returns the local limit of the connection, 0 if it is not known, e.g. for connections made with NewConn.
+func (c *Conn) Limit() int {
+	return int(atomic.LoadInt64(&c.limit))
+}
+
+// Pin sets the limit of the connection and keeps it when the Listener changes the local limit of its connections,
+// until Unpin is called.
+func (c *Conn) Pin(limit int) error {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	if err := c.setLimit(limit); err != nil {
+		return err
+	}
+	c.pinned = true
+	return nil
+}
+
+// Unpin makes the connection follow local limit changes of its Listener again, its current limit is kept
+// until the next change.
+func (c *Conn) Unpin() {
+	c.limitMu.Lock()
+	c.pinned = false
+	c.limitMu.Unlock()
+}
+
+// Pinned reports whether the limit of the connection is pinned, see Pin.
+func (c *Conn) Pinned() bool {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	return c.pinned
+}
+
+// followLimit sets the limit of the connection to a local limit of its Listener unless the limit is pinned.
+func (c *Conn) followLimit(limit int) error {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	if c.pinned {
+		return nil
+	}
+	return c.setLimit(limit)
+}
+
 // SetLimit sets the limit of the local limiter.
+// If kernel pacing is enabled, the pacing rate of the underlying socket is updated as well.
 func (c *Conn) SetLimit(limit int) error {
-	return c.a.SetLimit(limit)
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	return c.setLimit(limit)
+}
+
+// setLimit does the same as SetLimit, it must be called with c.limitMu held.
+func (c *Conn) setLimit(limit int) error {
+	if err := c.a.SetLimit(limit); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.limit, int64(limit))
+
+	c.mu.Lock()
+	pacing := c.pacing
+	c.mu.Unlock()
+	if pacing {
+		return c.setPacingRate(limit)
+	}
+	return nil
 }
 
 // Close closes the connection.
 func (c *Conn) Close() error {
-	c.done <- struct{}{}
+	select {
+	case c.done <- struct{}{}:
+	default:
+		// the connection has already been closed and not yet gc'd
+	}
+	if c.prefetch != nil {
+		c.prefetch.Release()
+	}
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.logger.Debug("closed connection", "remote", c.RemoteAddr().String(),
+			"bytes_read", atomic.LoadInt64(&c.stats.bytesRead), "bytes_written", atomic.LoadInt64(&c.stats.bytesWritten))
+		if c.events != nil {
+			c.events.publish(Event{Type: EventClosed, Conn: c})
+		}
+	}
 	return c.Conn.Close()
 }
@@ -1,11 +1,17 @@
 package netlimit_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
 	"golang.org/x/net/nettest"
 	"golang.org/x/time/rate"
 )
@@ -81,7 +87,6 @@ func TestConn_Read(t *testing.T) {
 
 func TestConn_Write(t *testing.T) {
 	type fields struct {
-		global      *rate.Limiter
 		localLimit  int
 		globalLimit int
 		marginError float64
@@ -101,7 +106,6 @@ func TestConn_Write(t *testing.T) {
 			fields: fields{
 				localLimit:  10,
 				globalLimit: 10,
-				global:      rate.NewLimiter(rate.Limit(10), 10),
 				marginError: 0.05,
 			},
 			args: args{
@@ -114,21 +118,18 @@ func TestConn_Write(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			recv, sender := net.Pipe()
-			defer func(recv net.Conn) {
-				err := recv.Close()
-				if err != nil {
-					t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
-				}
-			}(recv)
-			defer func(sender net.Conn) {
-				err := sender.Close()
-				if err != nil {
-					t.Errorf("Close() error = %v", err)
-				}
-			}(sender)
-			a := netlimit.NewDefaultAllocator(tt.fields.global, tt.fields.localLimit)
+			defer recv.Close()
+			defer sender.Close()
+			clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+			global := netlimit.NewGlobalLimiterWithClock(tt.fields.globalLimit, clock)
+			a := netlimit.NewDefaultAllocatorWithLimiter(global, tt.fields.localLimit)
+			a.SetClock(clock)
 			recvConn, _ := netlimit.NewConn(recv, a)
 			senderConn, _ := netlimit.NewConn(sender, a)
+			done := make(chan struct{})
+			defer close(done)
+			go clock.AdvanceUntil(done, 10*time.Millisecond)
+
 			// send data to receiver
 			go func() {
 				_, err := senderConn.Write(tt.args.msg)
@@ -137,29 +138,18 @@ func TestConn_Write(t *testing.T) {
 				}
 			}()
 
-			now := time.Now()
-			// read data from receiver
-			gotN, err := recvConn.Read(tt.args.b)
+			// read data from receiver, the reader and the writer share the allocator
+			tr, err := netlimittest.Measure(clock, func() (int64, error) {
+				n, err := recvConn.Read(tt.args.b)
+				return int64(n), err
+			})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Read() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			netlimittest.AssertTransfer(t, tr, int64(len(tt.args.msg)), tt.fields.localLimit, tt.fields.marginError)
 
-			elapsed := time.Since(now)
-			allowedErr := float64(tt.fields.localLimit) * tt.fields.marginError
-			rate := float64(len(tt.args.msg)) / elapsed.Seconds()
-			left := float64(tt.fields.localLimit) - allowedErr
-			right := float64(tt.fields.localLimit) + allowedErr
-			if left > rate || rate > right {
-				t.Errorf("Write() rate = %v, want %v", rate, tt.fields.localLimit)
-			}
-
-			wantN := len(tt.args.msg)
-			if gotN != wantN {
-				t.Errorf("Read() gotN = %v, want %v", gotN, wantN)
-			}
-
-			read := tt.args.b[:gotN]
+			read := tt.args.b[:tr.Bytes]
 			if string(tt.args.msg) != string(read) {
 				t.Errorf("Read() gotN = %v, want %v", string(read), string(tt.args.msg))
 			}
@@ -179,3 +169,341 @@ func TestNetConn(t *testing.T) {
 		}, nil
 	})
 }
+
+func TestConn_Stats(t *testing.T) {
+	recv, sender := net.Pipe()
+	defer recv.Close()
+	defer sender.Close()
+	a := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 100), 100)
+	recvConn, _ := netlimit.NewConn(recv, a)
+	senderConn, _ := netlimit.NewConn(sender, a)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if _, err := senderConn.Write(make([]byte, 10)); err != nil {
+			t.Errorf("Write() error = %v", err)
+		}
+	}()
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(recvConn, b); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	<-written
+
+	if got := recvConn.Stats().BytesRead; got != 10 {
+		t.Errorf("Stats() BytesRead = %v, want %v", got, 10)
+	}
+	stats := senderConn.Stats()
+	if stats.BytesWritten != 10 || stats.Writes != 1 {
+		t.Errorf("Stats() = %+v, want 10 bytes written in 1 write", stats)
+	}
+}
+
+// newClockAllocator returns an allocator limited to limit bytes per second on clock, with its burst spent if drained,
+// and advances clock while the allocator waits for quota until the test ends.
+func newClockAllocator(t *testing.T, clock *netlimittest.Clock, limit int, drained bool) *netlimit.DefaultAllocator {
+	t.Helper()
+	a := netlimit.NewDefaultAllocatorWithLimiter(netlimit.NewGlobalLimiterWithClock(limit, clock), limit)
+	a.SetClock(clock)
+	if drained {
+		if _, err := a.Alloc(context.Background(), limit); err != nil {
+			t.Fatalf("Alloc() error = %v", err)
+		}
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+	})
+	go clock.AdvanceUntil(done, 10*time.Millisecond)
+	return a
+}
+
+// assertCopy asserts that tr copied size bytes at limit bytes per second if it was throttled and at once otherwise.
+func assertCopy(t *testing.T, tr netlimittest.Transfer, size, limit int, throttled bool) {
+	t.Helper()
+	if throttled {
+		netlimittest.AssertTransfer(t, tr, int64(size), limit, 0.05)
+		return
+	}
+	if tr.Bytes != int64(size) || tr.Elapsed != 0 {
+		t.Errorf("copied %d bytes in %v, want %d bytes within the burst at once", tr.Bytes, tr.Elapsed, size)
+	}
+}
+
+func TestConn_ReadFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int
+		drained bool
+	}{
+		{name: "within burst", size: 500, limit: 1000},
+		{name: "over burst is throttled", size: 2000, limit: 1000, drained: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte("netlimit"), tt.size/8)
+			f, err := os.CreateTemp(t.TempDir(), "payload")
+			if err != nil {
+				t.Fatalf("CreateTemp() error = %v", err)
+			}
+			defer f.Close()
+			if _, err := f.Write(payload); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek() error = %v", err)
+			}
+
+			recv, sender := tcpPair(t)
+			clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+			conn, _ := netlimit.NewConn(sender, newClockAllocator(t, clock, tt.limit, tt.drained))
+
+			received := make(chan []byte)
+			go func() {
+				b, _ := io.ReadAll(recv)
+				received <- b
+			}()
+
+			// io.CopyN picks Conn.ReadFrom, the file is sent in chunks of granted quota until the io.LimitedReader
+			// of io.CopyN is exhausted
+			tr, err := netlimittest.Measure(clock, func() (int64, error) {
+				return io.CopyN(conn, f, int64(len(payload)))
+			})
+			conn.Close()
+			if err != nil {
+				t.Fatalf("io.CopyN() error = %v", err)
+			}
+			assertCopy(t, tr, len(payload), tt.limit, tt.drained)
+			if got := <-received; !bytes.Equal(got, payload) {
+				t.Errorf("received %d bytes, want the %d bytes of payload", len(got), len(payload))
+			}
+			if got := conn.Stats().BytesWritten; got != tr.Bytes {
+				t.Errorf("Stats() BytesWritten = %d, want %d", got, tr.Bytes)
+			}
+		})
+	}
+}
+
+func TestConn_WriteTo(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		limit     int
+		throttled bool
+	}{
+		{name: "within burst", size: 500, limit: 1000},
+		// EOF is found by a chunk of quota of its own, the burst makes up for it
+		{name: "over burst is throttled", size: 2000, limit: 1000, throttled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte("netlimit"), tt.size/8)
+			recv, sender := tcpPair(t)
+			clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+			conn, _ := netlimit.NewConn(recv, newClockAllocator(t, clock, tt.limit, false))
+
+			go func() {
+				sender.Write(payload)
+				sender.Close()
+			}()
+
+			var b bytes.Buffer
+			// io.Copy picks Conn.WriteTo
+			tr, err := netlimittest.Measure(clock, func() (int64, error) {
+				return io.Copy(&b, conn)
+			})
+			if err != nil {
+				t.Fatalf("io.Copy() error = %v", err)
+			}
+			assertCopy(t, tr, len(payload), tt.limit, tt.throttled)
+			if !bytes.Equal(b.Bytes(), payload) {
+				t.Errorf("copied %d bytes, want the %d bytes of payload", b.Len(), len(payload))
+			}
+			if got := conn.Stats().BytesRead; got != tr.Bytes {
+				t.Errorf("Stats() BytesRead = %d, want %d", got, tr.Bytes)
+			}
+		})
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection, closed once the test ends.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatalf("Accept() failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return conn, dialed
+}
+
+func TestConn_WriteBuffers(t *testing.T) {
+	tests := []struct {
+		name       string
+		buffers    int
+		size       int
+		limit      int
+		drained    bool
+		wantWrites int64
+	}{
+		{name: "single chunk", buffers: 4, size: 100, limit: 1000, wantWrites: 1},
+		{name: "split along quota boundaries", buffers: 8, size: 300, limit: 1000, drained: true, wantWrites: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				v       net.Buffers
+				payload []byte
+			)
+			for i := 0; i < tt.buffers; i++ {
+				b := bytes.Repeat([]byte{byte('a' + i)}, tt.size)
+				v = append(v, b)
+				payload = append(payload, b...)
+			}
+
+			recv, sender := tcpPair(t)
+			clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+			conn, _ := netlimit.NewConn(sender, newClockAllocator(t, clock, tt.limit, tt.drained))
+			received := make(chan []byte)
+			go func() {
+				b, _ := io.ReadAll(recv)
+				received <- b
+			}()
+
+			tr, err := netlimittest.Measure(clock, func() (int64, error) {
+				return conn.WriteBuffers(&v)
+			})
+			conn.Close()
+			if err != nil {
+				t.Fatalf("WriteBuffers() error = %v", err)
+			}
+			if len(v) != 0 {
+				t.Errorf("WriteBuffers() left %d buffers, want none", len(v))
+			}
+			assertCopy(t, tr, len(payload), tt.limit, tt.drained)
+			if got := <-received; !bytes.Equal(got, payload) {
+				t.Errorf("received %d bytes, want the %d bytes of payload", len(got), len(payload))
+			}
+			if got := conn.Stats().Writes; got != tt.wantWrites {
+				t.Errorf("Stats() Writes = %d, want %d", got, tt.wantWrites)
+			}
+		})
+	}
+}
+
+// noQuotaAllocator is an Allocator that never grants any bytes.
+type noQuotaAllocator struct{}
+
+func (noQuotaAllocator) Alloc(context.Context, int) (int, error) {
+	return 0, nil
+}
+
+func (noQuotaAllocator) SetLimit(int) error {
+	return nil
+}
+
+func TestConn_NoQuotaGranted(t *testing.T) {
+	tests := []struct {
+		name string
+		copy func(c *netlimit.Conn) (int64, error)
+	}{
+		{
+			name: "WriteBuffers",
+			copy: func(c *netlimit.Conn) (int64, error) {
+				return c.WriteBuffers(&net.Buffers{make([]byte, 10)})
+			},
+		},
+		{
+			name: "ReadFrom",
+			copy: func(c *netlimit.Conn) (int64, error) {
+				return c.ReadFrom(bytes.NewReader(make([]byte, 10)))
+			},
+		},
+		{
+			name: "WriteTo",
+			copy: func(c *netlimit.Conn) (int64, error) {
+				return c.WriteTo(io.Discard)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, sender := tcpPair(t)
+			conn, _ := netlimit.NewConn(sender, noQuotaAllocator{})
+			if _, err := tt.copy(conn); !errors.Is(err, netlimit.ErrNoQuotaGranted) {
+				t.Errorf("%s() error = %v, want %v", tt.name, err, netlimit.ErrNoQuotaGranted)
+			}
+		})
+	}
+}
+
+func TestConn_SetClock(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := netlimittest.NewClock(start)
+	recv, sender := net.Pipe()
+	defer recv.Close()
+	conn, _ := netlimit.NewConn(sender, newClockAllocator(t, clock, 1000, true))
+	conn.SetClock(clock)
+	defer conn.Close()
+	go io.Copy(io.Discard, recv)
+
+	if _, err := conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	stats := conn.Stats()
+	if !stats.Opened.Equal(start) {
+		t.Errorf("Stats() Opened = %v, want %v", stats.Opened, start)
+	}
+	if stats.AllocWait != time.Second {
+		t.Errorf("Stats() AllocWait = %v, want 1s of virtual time", stats.AllocWait)
+	}
+}
+
+func TestConn_WriteClock(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := netlimittest.NewClock(start)
+	a := netlimit.NewDefaultAllocatorWithLimiter(netlimit.NewGlobalLimiterWithClock(1000, clock), 1000)
+	a.SetClock(clock)
+
+	recv, sender := net.Pipe()
+	defer recv.Close()
+	conn, _ := netlimit.NewConn(sender, a)
+	defer conn.Close()
+	go io.Copy(io.Discard, recv)
+
+	advancing := make(chan struct{})
+	defer close(advancing)
+	go clock.AdvanceUntil(advancing, 100*time.Millisecond)
+
+	// the burst is written at once, the remaining 1500 bytes take 1.5s of virtual time
+	tr, err := netlimittest.Measure(clock, func() (int64, error) {
+		n, err := conn.Write(make([]byte, 2500))
+		return int64(n), err
+	})
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if tr.Elapsed != 1500*time.Millisecond {
+		t.Errorf("Write() took %v of virtual time, want 1.5s", tr.Elapsed)
+	}
+}
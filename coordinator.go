@@ -0,0 +1,291 @@
+package netlimit
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCoordinatorClosed is returned by Coordinator.Serve once the Coordinator is closed.
+	ErrCoordinatorClosed = errors.New("coordinator closed")
+)
+
+const defaultLeaseTTL = 3 * time.Second
+
+// leaseRequest is sent by a LeaseLimiter to renew its lease.
+type leaseRequest struct {
+	// ID identifies the process requesting the lease
+	ID string `json:"id"`
+
+	// Demand is the bytes per second the process would like to use
+	Demand int `json:"demand"`
+
+	// Limit, if greater than 0, changes the global limit enforced by the Coordinator,
+	// it is ignored unless the Coordinator allows remote limit changes
+	Limit int `json:"limit,omitempty"`
+}
+
+// leaseResponse is sent by a Coordinator in reply to leaseRequest.
+type leaseResponse struct {
+	// Share is the bytes per second the process is allowed to use until the lease expires
+	Share int `json:"share"`
+
+	// Global is the global limit enforced by the Coordinator
+	Global int `json:"global"`
+
+	// TTL is the duration after which the lease expires unless it is renewed
+	TTL time.Duration `json:"ttl"`
+}
+
+// lease is the state of a single process holding a lease.
+type lease struct {
+	demand  int
+	share   int
+	expires time.Time
+
+	// joining is set until the process is granted its equal share of the limit for the first time,
+	// until then its demand is at least that share, so that it does not have to grow its demand from 0
+	joining bool
+}
+
+// Coordinator splits a global bytes per second limit between processes that lease shares of it over the network.
+// Coordinator guarantees that the shares of all unexpired leases combined never exceed the global limit,
+// shares are split max-min fairly according to the demand reported by each process.
+type Coordinator struct {
+	mu sync.Mutex
+
+	// limit is the global bytes per second limit shared by all processes
+	limit int
+
+	// ttl is the duration a lease is valid for
+	ttl time.Duration
+
+	// remoteLimit is set if processes may change limit with their lease requests
+	remoteLimit bool
+
+	// leases are the leases held by processes, keyed by process id
+	leases map[string]*lease
+
+	// listeners are the listeners the Coordinator serves on
+	listeners []net.Listener
+
+	// conns are the currently open connections of processes
+	conns map[net.Conn]struct{}
+
+	// closed is set once Close is called
+	closed bool
+
+	// clock tells the time leases expire at
+	clock Clock
+}
+
+// NewCoordinator returns a Coordinator enforcing a global limit of limit bytes per second.
+func NewCoordinator(limit int) *Coordinator {
+	return &Coordinator{
+		limit:  limit,
+		ttl:    defaultLeaseTTL,
+		leases: make(map[string]*lease),
+		conns:  make(map[net.Conn]struct{}),
+		clock:  realClock{},
+	}
+}
+
+// SetClock replaces the clock of the Coordinator, e.g. with a fake clock in tests.
+// SetClock must be called before the Coordinator serves.
+func (c *Coordinator) SetClock(clock Clock) {
+	c.mu.Lock()
+	c.clock = clock
+	c.mu.Unlock()
+}
+
+// SetLimit sets the global bytes per second limit, shares are adjusted as leases are renewed.
+func (c *Coordinator) SetLimit(limit int) {
+	c.mu.Lock()
+	c.limit = limit
+	c.mu.Unlock()
+}
+
+// Limit returns the global bytes per second limit.
+func (c *Coordinator) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// SetLeaseTTL sets the duration leases granted from now on are valid for.
+// Processes renew their leases a few times per ttl.
+func (c *Coordinator) SetLeaseTTL(ttl time.Duration) {
+	c.mu.Lock()
+	c.ttl = ttl
+	c.mu.Unlock()
+}
+
+// SetAllowRemoteLimit sets whether processes may change the global limit, e.g. with LeaseLimiter.SetLimit.
+// Lease requests are not authenticated, so remote limit changes are ignored by default and should only be allowed
+// when the Coordinator serves on a trusted network or socket.
+func (c *Coordinator) SetAllowRemoteLimit(allow bool) {
+	c.mu.Lock()
+	c.remoteLimit = allow
+	c.mu.Unlock()
+}
+
+// Serve accepts connections of LeaseLimiter processes on ln, ln can be a TCP or a Unix socket listener.
+// Serve blocks until ln fails or the Coordinator is closed.
+func (c *Coordinator) Serve(ln net.Listener) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrCoordinatorClosed
+	}
+	c.listeners = append(c.listeners, ln)
+	c.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				return ErrCoordinatorClosed
+			}
+			return err
+		}
+
+		c.mu.Lock()
+		c.conns[conn] = struct{}{}
+		c.mu.Unlock()
+		go c.handle(conn)
+	}
+}
+
+// Close stops all listeners and closes connections of all processes.
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var err error
+	for _, ln := range c.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range c.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (c *Coordinator) handle(conn net.Conn) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.conns, conn)
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req leaseRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if err := enc.Encode(c.lease(req, c.clock.Now())); err != nil {
+			return
+		}
+	}
+}
+
+// lease renews the lease of the requesting process and returns its new share.
+func (c *Coordinator) lease(req leaseRequest, now time.Time) leaseResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.Limit > 0 && c.remoteLimit {
+		c.limit = req.Limit
+	}
+
+	for id, l := range c.leases {
+		if now.After(l.expires) {
+			delete(c.leases, id)
+		}
+	}
+
+	current, ok := c.leases[req.ID]
+	if !ok {
+		current = &lease{joining: true}
+		c.leases[req.ID] = current
+	}
+	current.demand = req.Demand
+	equal := c.limit / len(c.leases)
+	if current.joining && current.demand < equal {
+		current.demand = equal
+	}
+
+	demands := make(map[string]int, len(c.leases))
+	for id, l := range c.leases {
+		demands[id] = l.demand
+	}
+	share := fairShares(c.limit, demands)[req.ID]
+
+	// other processes are only told about their new shares once they renew,
+	// until then their current shares have to be honoured
+	available := c.limit
+	for id, l := range c.leases {
+		if id != req.ID {
+			available -= l.share
+		}
+	}
+	if share > available {
+		share = available
+	}
+	if share < 0 {
+		share = 0
+	}
+
+	current.share = share
+	if share >= equal {
+		current.joining = false
+	}
+	current.expires = now.Add(c.ttl)
+	return leaseResponse{
+		Share:  share,
+		Global: c.limit,
+		TTL:    c.ttl,
+	}
+}
+
+// fairShares splits limit between demands max-min fairly, whatever is left once every demand is satisfied
+// is split equally so that processes can grow their demand.
+func fairShares(limit int, demands map[string]int) map[string]int {
+	ids := make([]string, 0, len(demands))
+	for id := range demands {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return demands[ids[i]] < demands[ids[j]]
+	})
+
+	shares := make(map[string]int, len(demands))
+	remaining := limit
+	for i, id := range ids {
+		share := remaining / (len(ids) - i)
+		if demands[id] < share {
+			share = demands[id]
+		}
+		shares[id] = share
+		remaining -= share
+	}
+
+	if len(ids) == 0 {
+		return shares
+	}
+	for _, id := range ids {
+		shares[id] += remaining / len(ids)
+	}
+	return shares
+}
@@ -0,0 +1,214 @@
+package netlimit_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+func serveCoordinator(t *testing.T, network, addr string, limit int, ttl time.Duration) (*netlimit.Coordinator, string) {
+	t.Helper()
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	c := netlimit.NewCoordinator(limit)
+	c.SetLeaseTTL(ttl)
+	go c.Serve(ln)
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c, ln.Addr().String()
+}
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaseLimiter_Share(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		addr    func(t *testing.T) string
+	}{
+		{
+			name:    "tcp",
+			network: "tcp",
+			addr: func(t *testing.T) string {
+				return "127.0.0.1:0"
+			},
+		},
+		{
+			name:    "unix",
+			network: "unix",
+			addr: func(t *testing.T) string {
+				return filepath.Join(t.TempDir(), "coordinator.sock")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const global = 1000
+			_, addr := serveCoordinator(t, tt.network, tt.addr(t), global, 150*time.Millisecond)
+			a := netlimit.NewLeaseLimiter(tt.network, addr, "a", 10)
+			defer a.Close()
+			b := netlimit.NewLeaseLimiter(tt.network, addr, "b", 10)
+			defer b.Close()
+
+			waitFor(t, 2*time.Second, func() bool {
+				return a.Share() > 10 && b.Share() > 10
+			})
+			waitFor(t, 2*time.Second, func() bool {
+				return a.Share()+b.Share() == global
+			})
+			if got := a.Global(); got != global {
+				t.Errorf("Global() = %v, want %v", got, global)
+			}
+			if got := a.Limit(); got != a.Share() || got != a.Burst() {
+				t.Errorf("Limit() = %v, Burst() = %v, want both to be the share %v", got, a.Burst(), a.Share())
+			}
+		})
+	}
+}
+
+func TestCoordinator_Join(t *testing.T) {
+	const global = 1000000
+	_, addr := serveCoordinator(t, "tcp", "127.0.0.1:0", global, time.Minute)
+	lease := func(conn net.Conn, id string, demand int) int {
+		t.Helper()
+		if err := json.NewEncoder(conn).Encode(map[string]interface{}{"id": id, "demand": demand}); err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		var resp struct {
+			Share int `json:"share"`
+		}
+		if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		return resp.Share
+	}
+	a, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer a.Close()
+	b, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer b.Close()
+
+	if got := lease(a, "a", 2*global); got != global {
+		t.Fatalf("share of a = %v, want %v", got, global)
+	}
+	// b has no traffic yet and a holds the whole limit until it renews
+	if got := lease(b, "b", 0); got != 0 {
+		t.Fatalf("share of b = %v, want %v", got, 0)
+	}
+	if got := lease(a, "a", 2*global); got != global/2 {
+		t.Errorf("share of a = %v, want %v", got, global/2)
+	}
+	// b starts at its equal share instead of doubling its demand from a single byte
+	if got := lease(b, "b", 2); got != global/2 {
+		t.Errorf("share of b = %v, want %v", got, global/2)
+	}
+}
+
+func TestCoordinator_RemoteLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow bool
+		want  int
+	}{
+		{
+			name: "ignored by default",
+			want: 1000,
+		},
+		{
+			name:  "allowed",
+			allow: true,
+			want:  500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, addr := serveCoordinator(t, "tcp", "127.0.0.1:0", 1000, time.Minute)
+			c.SetAllowRemoteLimit(tt.allow)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			if err := json.NewEncoder(conn).Encode(map[string]interface{}{"id": "a", "demand": 10, "limit": 500}); err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			var resp struct {
+				Global int `json:"global"`
+			}
+			if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if resp.Global != tt.want {
+				t.Errorf("global = %v, want %v", resp.Global, tt.want)
+			}
+			if got := c.Limit(); got != tt.want {
+				t.Errorf("Limit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseLimiter_Fallback(t *testing.T) {
+	c, addr := serveCoordinator(t, "tcp", "127.0.0.1:0", 1000, 150*time.Millisecond)
+	l := netlimit.NewLeaseLimiter("tcp", addr, "a", 10)
+	defer l.Close()
+	waitFor(t, 2*time.Second, func() bool {
+		return l.Share() == 1000
+	})
+
+	c.Close()
+	waitFor(t, 2*time.Second, func() bool {
+		return l.Share() == 10
+	})
+}
+
+func TestListener_SetGlobalLimiter(t *testing.T) {
+	_, addr := serveCoordinator(t, "tcp", "127.0.0.1:0", 100, 150*time.Millisecond)
+	l := netlimit.NewLeaseLimiter("tcp", addr, "a", 10)
+	defer l.Close()
+	waitFor(t, 2*time.Second, func() bool {
+		return l.Share() == 100
+	})
+
+	a := netlimit.NewDefaultAllocatorWithLimiter(l, 100)
+	got, err := a.Alloc(context.Background(), 200)
+	if err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	if got != 100 {
+		t.Errorf("Alloc() got = %v, want %v", got, 100)
+	}
+
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 10, 10)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	ln.SetGlobalLimiter(l)
+	if err := ln.SetLocalLimit(50); err != nil {
+		t.Errorf("SetLocalLimit() error = %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package netlimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Allocator = (*CreditAllocator)(nil)
+
+// CreditAllocator is an Allocator modelled after "burstable" plans, a connection earns credits at its baseline rate
+// while it transfers less than that, up to a cap, e.g. an hour's worth of traffic. Credits are spent at up to the
+// burst ceiling enforced by the wrapped Allocator, once they run out the connection falls back to its baseline rate.
+type CreditAllocator struct {
+	Allocator
+
+	mu sync.Mutex
+
+	// baseline is the bytes per second rate credits are earned at
+	baseline int
+
+	// ceiling is the bytes per second limit of the wrapped Allocator
+	ceiling int
+
+	// capacity is the maximum number of credits, in bytes, a connection can save up
+	capacity float64
+
+	// balance is the number of credits, in bytes, left at last, balance is negative when allocations wait for credits
+	balance float64
+
+	// last is the time balance was last updated at
+	last time.Time
+
+	// clock tells the time credits are earned at and waits for them
+	clock Clock
+}
+
+// NewCreditAllocator returns an Allocator that earns baseline bytes per second of credits up to capacity bytes
+// and spends them at up to ceiling bytes per second enforced by a. The connection starts without credits.
+func NewCreditAllocator(a Allocator, baseline, ceiling int, capacity int64) *CreditAllocator {
+	c := &CreditAllocator{
+		Allocator: a,
+		baseline:  baseline,
+		ceiling:   ceiling,
+		capacity:  float64(capacity),
+		clock:     realClock{},
+	}
+	c.last = c.clock.Now()
+	return c
+}
+
+// SetClock replaces the clock of the allocator, e.g. with a fake clock in tests.
+// SetClock must be called before the first allocation.
+func (a *CreditAllocator) SetClock(c Clock) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clock = c
+	a.last = c.Now()
+}
+
+// Alloc waits until there are enough credits for the requested quota and allocates it in the wrapped Allocator.
+func (a *CreditAllocator) Alloc(ctx context.Context, requestedQuota int) (int, error) {
+	a.mu.Lock()
+	if requestedQuota > a.ceiling {
+		requestedQuota = a.ceiling
+	}
+	if float64(requestedQuota) > a.capacity && a.capacity >= 1 {
+		requestedQuota = int(a.capacity)
+	}
+	delay := a.spend(a.clock.Now(), requestedQuota)
+	clock := a.clock
+	a.mu.Unlock()
+
+	if delay > 0 {
+		timer := newTimer(clock, delay)
+		select {
+		case <-timer.C():
+			stopTimer(timer)
+		case <-ctx.Done():
+			stopTimer(timer)
+			a.mu.Lock()
+			a.balance += float64(requestedQuota)
+			a.mu.Unlock()
+			return 0, ctx.Err()
+		}
+	}
+
+	granted, err := a.Allocator.Alloc(ctx, requestedQuota)
+	a.mu.Lock()
+	// credits of bytes that were not granted are given back
+	a.balance += float64(requestedQuota - granted)
+	a.mu.Unlock()
+	return granted, err
+}
+
+// spend debits n credits and returns how long the caller has to wait for the balance to become positive.
+// spend must be called with a.mu held.
+func (a *CreditAllocator) spend(now time.Time, n int) time.Duration {
+	a.earn(now)
+	a.balance -= float64(n)
+	if a.balance >= 0 || a.baseline <= 0 {
+		return 0
+	}
+	return time.Duration(-a.balance / float64(a.baseline) * float64(time.Second))
+}
+
+// earn credits the baseline rate for the time elapsed since last, earn must be called with a.mu held.
+func (a *CreditAllocator) earn(now time.Time) {
+	elapsed := now.Sub(a.last)
+	if elapsed <= 0 {
+		return
+	}
+	a.last = now
+	a.balance += elapsed.Seconds() * float64(a.baseline)
+	if a.balance > a.capacity {
+		a.balance = a.capacity
+	}
+}
+
+// Balance returns the number of credits, in bytes, the connection has saved up.
+func (a *CreditAllocator) Balance() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.earn(a.clock.Now())
+	if a.balance < 0 {
+		return 0
+	}
+	return int64(a.balance)
+}
+
+// SetLimit sets the baseline rate credits are earned at, the burst ceiling is kept.
+// A limit higher than the burst ceiling is clamped to it.
+func (a *CreditAllocator) SetLimit(limit int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if limit > a.ceiling {
+		limit = a.ceiling
+	}
+	a.earn(a.clock.Now())
+	a.baseline = limit
+	return nil
+}
@@ -0,0 +1,143 @@
+package netlimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+	"golang.org/x/time/rate"
+)
+
+func TestCreditAllocator_Alloc(t *testing.T) {
+	type fields struct {
+		baseline int
+		ceiling  int
+		capacity int64
+		idle     time.Duration
+	}
+	tests := []struct {
+		name      string
+		fields    fields
+		requested int
+		want      int
+		wantWait  time.Duration
+	}{
+		{
+			name: "without credits alloc waits at baseline rate",
+			fields: fields{
+				baseline: 100,
+				ceiling:  1000,
+				capacity: 1000,
+			},
+			requested: 50,
+			want:      50,
+			wantWait:  500 * time.Millisecond,
+		},
+		{
+			name: "credits earned while idle are spent at once",
+			fields: fields{
+				baseline: 100,
+				ceiling:  1000,
+				capacity: 1000,
+				idle:     300 * time.Millisecond,
+			},
+			requested: 30,
+			want:      30,
+		},
+		{
+			name: "alloc is capped at the burst ceiling",
+			fields: fields{
+				baseline: 100,
+				ceiling:  20,
+				capacity: 1000,
+				idle:     300 * time.Millisecond,
+			},
+			requested: 30,
+			want:      20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1000), tt.fields.ceiling)
+			a := netlimit.NewCreditAllocator(next, tt.fields.baseline, tt.fields.ceiling, tt.fields.capacity)
+			time.Sleep(tt.fields.idle)
+
+			now := time.Now()
+			got, err := a.Alloc(context.Background(), tt.requested)
+			if err != nil {
+				t.Fatalf("Alloc() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Alloc() got = %v, want %v", got, tt.want)
+			}
+			elapsed := time.Since(now)
+			if elapsed < tt.wantWait-50*time.Millisecond || elapsed > tt.wantWait+100*time.Millisecond {
+				t.Errorf("Alloc() waited %v, want %v", elapsed, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestCreditAllocator_Balance(t *testing.T) {
+	next := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1000), 1000)
+	a := netlimit.NewCreditAllocator(next, 1000, 1000, 100)
+	time.Sleep(200 * time.Millisecond)
+	if got := a.Balance(); got != 100 {
+		t.Errorf("Balance() = %v, want %v", got, 100)
+	}
+}
+
+func TestCreditAllocator_SetLimit(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	next := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1000), 1000)
+	next.SetClock(clock)
+	a := netlimit.NewCreditAllocator(next, 100, 1000, 10000)
+	a.SetClock(clock)
+
+	// the baseline is clamped to the burst ceiling
+	if err := a.SetLimit(2000); err != nil {
+		t.Fatalf("SetLimit() error = %v", err)
+	}
+	clock.Advance(time.Second)
+	if got := a.Balance(); got != 1000 {
+		t.Errorf("Balance() = %v, want %v", got, 1000)
+	}
+
+	// without credits an allocation waits for them on the clock
+	if _, err := a.Alloc(context.Background(), 1000); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go clock.AdvanceUntil(done, 10*time.Millisecond)
+	tr, err := netlimittest.Measure(clock, func() (int64, error) {
+		n, err := a.Alloc(context.Background(), 500)
+		return int64(n), err
+	})
+	if err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	// the clock is advanced in steps of 10ms
+	if tr.Elapsed < 500*time.Millisecond || tr.Elapsed > 510*time.Millisecond {
+		t.Errorf("Alloc() waited %v, want %v", tr.Elapsed, 500*time.Millisecond)
+	}
+}
+
+func TestListener_SetBurstCredits(t *testing.T) {
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 100, 10)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	if err := ln.SetBurstCredits(200, time.Hour); err != netlimit.ErrLimitGreaterThanTotal {
+		t.Errorf("SetBurstCredits() error = %v, wantErr %v", err, netlimit.ErrLimitGreaterThanTotal)
+	}
+	if err := ln.SetBurstCredits(5, time.Hour); err == nil {
+		t.Errorf("SetBurstCredits() error = nil, want error")
+	}
+	if err := ln.SetBurstCredits(100, time.Hour); err != nil {
+		t.Errorf("SetBurstCredits() error = %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package netlimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Dialer dials net.Conn connections that obey bandwidth limits, it is the client side counterpart of Listener.
+type Dialer struct {
+	mu sync.Mutex
+
+	// Dialer is the dialer used to establish the underlying connections
+	net.Dialer
+
+	// limiter is the global limiter that is the upper bound of all dialed connections combined
+	limiter GlobalLimiter
+
+	// localLimit determines maximum bytes per second limit of bandwidth allowed per single dialed connection
+	localLimit int
+
+	// globalLimit determines maximum bytes per second limit of bandwidth allowed for all dialed connections combined
+	globalLimit int
+
+	// emulation is the optional Emulation of network conditions of dialed connections
+	emulation *Emulation
+
+	// logger logs dials and limit changes of the dialer, and allocations of its connections
+	logger Logger
+
+	// clock tells the time to the dialer, its global limiter and dialed connections
+	clock Clock
+}
+
+// NewDialer returns a *Dialer with the specified limits.
+// limitGlobal is the maximum bytes per second allowed for all dialed connections combined
+// limitLocal is the maximum bytes per second allowed for a single dialed connection
+func NewDialer(limitGlobal, limitLocal int) (*Dialer, error) {
+	if limitGlobal < limitLocal {
+		return nil, ErrLimitGreaterThanTotal
+	}
+
+	return &Dialer{
+		limiter:     NewGlobalLimiter(limitGlobal),
+		localLimit:  limitLocal,
+		globalLimit: limitGlobal,
+		logger:      nopLogger{},
+		clock:       realClock{},
+	}, nil
+}
+
+// Dial connects to the address on the named network, see net.Dial.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address on the named network using the provided context, see net.Dialer.DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	alloc := NewDefaultAllocatorWithLimiter(d.limiter, d.localLimit)
+	alloc.SetLogger(d.logger)
+	alloc.SetClock(d.clock)
+	emulation := d.emulation
+	logger := d.logger
+	localLimit := d.localLimit
+	clock := d.clock
+	d.mu.Unlock()
+
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		logger.Warn("failed to dial", "network", network, "addr", addr, "err", err)
+		return nil, err
+	}
+	if emulation != nil {
+		e := *emulation
+		if e.Clock == nil {
+			e.Clock = clock
+		}
+		emulated, err := NewEmulatedConn(conn, e)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create new conn: %w", err)
+		}
+		conn = emulated
+	}
+	newConn, err := NewConn(conn, alloc)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create new conn: %w", err)
+	}
+	newConn.SetClock(clock)
+	newConn.logger = logger
+	newConn.limit = int64(localLimit)
+	logger.Debug("dialed connection", "network", network, "addr", addr, "local_limit", localLimit)
+	return newConn, nil
+}
+
+// SetEmulation makes connections dialed from now on emulate network conditions of e, see Emulation
+// and EmulationPreset. Limits of the Dialer still apply on top of the emulated rates.
+// Setting e to nil disables emulation for future connections.
+func (d *Dialer) SetEmulation(e *Emulation) {
+	d.mu.Lock()
+	d.emulation = e
+	d.mu.Unlock()
+}
+
+// SetGlobalLimiter replaces the global limiter shared by connections dialed from now on,
+// e.g. with a GroupMember of a LimiterGroup shared with Listeners.
+func (d *Dialer) SetGlobalLimiter(limiter GlobalLimiter) {
+	d.mu.Lock()
+	d.limiter = limiter
+	d.globalLimit = limiter.Limit()
+	d.mu.Unlock()
+}
+
+// SetGlobalLimit sets the limit of the bandwidth of all dialed connections combined.
+// The global limit cannot be lower than the local limit.
+func (d *Dialer) SetGlobalLimit(limit int) error {
+	d.mu.Lock()
+	if limit < d.localLimit {
+		d.mu.Unlock()
+		return ErrLimitGreaterThanTotal
+	}
+	d.limiter.SetLimit(limit)
+	d.globalLimit = limit
+	d.logger.Info("global limit changed", "limit", limit)
+	d.mu.Unlock()
+	return nil
+}
+
+// SetLocalLimit sets the limit of the bandwidth of connections dialed from now on.
+// Use Conn.SetLimit to change the limit of an already dialed connection.
+func (d *Dialer) SetLocalLimit(limit int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if limit > d.globalLimit {
+		return ErrLimitGreaterThanTotal
+	}
+	d.localLimit = limit
+	d.logger.Info("local limit changed", "limit", limit)
+	return nil
+}
+
+// SetClock replaces the clock of the Dialer, of its default global limiter and of connections dialed from now on,
+// e.g. with a fake clock in tests. SetClock must be called before the first connection is dialed.
+func (d *Dialer) SetClock(c Clock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clock = c
+	if rl, ok := d.limiter.(*rateLimiter); ok {
+		rl.clock = c
+	}
+}
+
+// SetLogger makes the Dialer log dials and limit changes, and allocation retries and failures of connections
+// dialed from now on, to lg. Setting lg to nil discards logs.
+func (d *Dialer) SetLogger(lg Logger) {
+	d.mu.Lock()
+	d.logger = loggerOrNop(lg)
+	d.mu.Unlock()
+}
@@ -0,0 +1,346 @@
+package netlimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = (*EmulatedConn)(nil)
+
+var (
+	// ErrUnknownEmulation is returned by EmulationPreset for names without a preset.
+	ErrUnknownEmulation = errors.New("unknown emulation preset")
+)
+
+const (
+	// emulationQueue is the number of writes an emulated link holds while they travel, like a socket buffer
+	emulationQueue = 64
+
+	// minRetransmitTimeout is the lowest delay of a lost write, as the minimum RTO of TCP on Linux
+	minRetransmitTimeout = 200 * time.Millisecond
+
+	// emulationLinger is how long a closed link waits, beyond the delivery time of queued writes,
+	// for the peer to take them before the underlying connection is closed
+	emulationLinger = time.Second
+)
+
+// Emulation describes network conditions emulated on a connection, so that code can be tested on poor networks
+// without tc netem or root. Delays apply to data written to the connection, a request sent by an unemulated peer
+// and answered over an emulated connection therefore takes Latency on top of the transfer time.
+type Emulation struct {
+	// UpRate is the bytes per second limit of data written to the connection, 0 means unlimited
+	UpRate int
+
+	// DownRate is the bytes per second limit of data read from the connection, 0 means unlimited
+	DownRate int
+
+	// Latency is the fixed delay of every write
+	Latency time.Duration
+
+	// Jitter is the maximum random delay added to Latency, writes are never reordered
+	Jitter time.Duration
+
+	// StallEvery is the period of stalls of the link, 0 disables stalls
+	StallEvery time.Duration
+
+	// StallFor is the duration of every stall, nothing is delivered while the link stalls
+	StallFor time.Duration
+
+	// Loss is the probability, between 0 and 1, that a write is lost and delivered only after a retransmission
+	// timeout, together with all writes that follow it
+	Loss float64
+
+	// Seed seeds the random jitter and loss, 0 seeds them with the current time
+	Seed int64
+
+	// Clock tells the time to the emulation, the real clock is used if Clock is nil
+	Clock Clock
+}
+
+// emulationPresets are typical conditions of common links, rates follow the throttling presets of browsers
+var emulationPresets = map[string]Emulation{
+	"2G": {
+		UpRate:   50 * 1000 / 8,
+		DownRate: 250 * 1000 / 8,
+		Latency:  300 * time.Millisecond,
+		Jitter:   100 * time.Millisecond,
+		Loss:     0.02,
+	},
+	"3G": {
+		UpRate:   250 * 1000 / 8,
+		DownRate: 750 * 1000 / 8,
+		Latency:  100 * time.Millisecond,
+		Jitter:   30 * time.Millisecond,
+		Loss:     0.01,
+	},
+	"4G": {
+		UpRate:   3 * 1000 * 1000 / 8,
+		DownRate: 4 * 1000 * 1000 / 8,
+		Latency:  20 * time.Millisecond,
+		Jitter:   10 * time.Millisecond,
+		Loss:     0.001,
+	},
+	"DSL": {
+		UpRate:   1000 * 1000 / 8,
+		DownRate: 2 * 1000 * 1000 / 8,
+		Latency:  10 * time.Millisecond,
+		Jitter:   2 * time.Millisecond,
+	},
+	"satellite": {
+		UpRate:     3 * 1000 * 1000 / 8,
+		DownRate:   15 * 1000 * 1000 / 8,
+		Latency:    600 * time.Millisecond,
+		Jitter:     50 * time.Millisecond,
+		StallEvery: 30 * time.Second,
+		StallFor:   time.Second,
+		Loss:       0.005,
+	},
+}
+
+// EmulationPreset returns the Emulation of a named link: "2G", "3G", "4G", "DSL" or "satellite".
+func EmulationPreset(name string) (Emulation, error) {
+	e, ok := emulationPresets[name]
+	if !ok {
+		return Emulation{}, fmt.Errorf("%w: %q", ErrUnknownEmulation, name)
+	}
+	return e, nil
+}
+
+func (e Emulation) clock() Clock {
+	if e.Clock == nil {
+		return realClock{}
+	}
+	return e.Clock
+}
+
+// EmulatedConn is a net.Conn that emulates the network conditions of an Emulation.
+type EmulatedConn struct {
+	net.Conn
+
+	// w is the end data is written to, it throttles UpRate and delays writes
+	w net.Conn
+
+	// down throttles DownRate, it is nil if reads are unlimited
+	down Allocator
+}
+
+// NewEmulatedConn returns conn with network conditions emulated according to e.
+// Writes are throttled by a Conn limited to e.UpRate, reads are charged to an Allocator limited to e.DownRate
+// once data is read, so that only bytes actually received count.
+func NewEmulatedConn(conn net.Conn, e Emulation) (*EmulatedConn, error) {
+	clock := e.clock()
+	c := &EmulatedConn{Conn: conn, w: conn}
+	if e.Latency > 0 || e.Jitter > 0 || e.Loss > 0 || (e.StallEvery > 0 && e.StallFor > 0) {
+		c.w = newLink(conn, e, clock)
+	}
+
+	if e.UpRate > 0 {
+		limited, err := NewConn(c.w, emulatedAllocator(e.UpRate, clock))
+		if err != nil {
+			return nil, fmt.Errorf("failed to emulate rate: %w", err)
+		}
+		c.w = limited
+	}
+	if e.DownRate > 0 {
+		c.down = emulatedAllocator(e.DownRate, clock)
+	}
+	return c, nil
+}
+
+func emulatedAllocator(limit int, clock Clock) *DefaultAllocator {
+	a := NewDefaultAllocatorWithLimiter(NewGlobalLimiterWithClock(limit, clock), limit)
+	a.SetClock(clock)
+	return a
+}
+
+// Read reads data from the connection at the emulated down rate, it returns once the data read has been paid for.
+func (c *EmulatedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.down == nil {
+		return n, err
+	}
+	for paid := 0; paid < n; {
+		granted, allocErr := c.down.Alloc(context.Background(), n-paid)
+		if allocErr != nil {
+			return n, fmt.Errorf("failed to allocate quota: %w", allocErr)
+		}
+		paid += granted
+	}
+	return n, err
+}
+
+// Write writes data to the connection at the emulated up rate, data reaches the peer after the emulated delays.
+func (c *EmulatedConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// Close closes the connection once data already written has been delivered,
+// or once the peer did not take it within a second of its delivery time.
+func (c *EmulatedConn) Close() error {
+	return c.w.Close()
+}
+
+// link is a net.Conn that delivers written data to the underlying connection after emulated delays.
+type link struct {
+	net.Conn
+
+	e     Emulation
+	clock Clock
+
+	// queue holds written data with the time it is delivered at
+	queue chan packet
+
+	mu sync.Mutex
+
+	// rand draws jitter and losses
+	rand *rand.Rand
+
+	// start is the time stalls are counted from
+	start time.Time
+
+	// last is the delivery time of the last write, writes are never delivered before it
+	last time.Time
+
+	// err is the error the underlying connection failed with
+	err error
+
+	// closed is closed once the link is closed, queued data is still delivered
+	closed chan struct{}
+	once   sync.Once
+}
+
+type packet struct {
+	at time.Time
+	b  []byte
+}
+
+func newLink(conn net.Conn, e Emulation, clock Clock) *link {
+	seed := e.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	l := &link{
+		Conn:   conn,
+		e:      e,
+		clock:  clock,
+		queue:  make(chan packet, emulationQueue),
+		rand:   rand.New(rand.NewSource(seed)),
+		start:  clock.Now(),
+		closed: make(chan struct{}),
+	}
+	go l.deliver()
+	return l
+}
+
+// Write queues b for delivery after the emulated delays.
+func (l *link) Write(b []byte) (int, error) {
+	select {
+	case <-l.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	l.mu.Lock()
+	if l.err != nil {
+		err := l.err
+		l.mu.Unlock()
+		return 0, err
+	}
+	p := packet{at: l.deliveryTime(l.clock.Now()), b: append([]byte(nil), b...)}
+	l.mu.Unlock()
+
+	select {
+	case l.queue <- p:
+		return len(b), nil
+	case <-l.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// deliveryTime returns the time data written at now reaches the peer, deliveryTime must be called with l.mu held.
+func (l *link) deliveryTime(now time.Time) time.Time {
+	at := now.Add(l.e.Latency)
+	if l.e.Jitter > 0 {
+		at = at.Add(time.Duration(l.rand.Int63n(int64(l.e.Jitter) + 1)))
+	}
+	if l.e.Loss > 0 && l.rand.Float64() < l.e.Loss {
+		rto := 2 * l.e.Latency
+		if rto < minRetransmitTimeout {
+			rto = minRetransmitTimeout
+		}
+		at = at.Add(rto)
+	}
+	if at.Before(l.last) {
+		at = l.last
+	}
+	if l.e.StallEvery > 0 && l.e.StallFor > 0 {
+		// nothing is delivered within the first StallFor of every period but the first one
+		offset := at.Sub(l.start) % l.e.StallEvery
+		if at.Sub(l.start) >= l.e.StallEvery && offset < l.e.StallFor {
+			at = at.Add(l.e.StallFor - offset)
+		}
+	}
+	l.last = at
+	return at
+}
+
+// Close closes the link once queued data is delivered. A write the peer does not take fails after emulationLinger
+// past the delivery time of the last queued write, so that delivery never blocks forever on a peer that stopped reading.
+func (l *link) Close() error {
+	l.once.Do(func() {
+		l.mu.Lock()
+		remaining := l.last.Sub(l.clock.Now())
+		l.mu.Unlock()
+		if remaining < 0 {
+			remaining = 0
+		}
+		close(l.closed)
+		// deadlines of the network connection are always on the real time
+		if err := l.Conn.SetWriteDeadline(time.Now().Add(remaining + emulationLinger)); err != nil {
+			l.Conn.Close()
+		}
+	})
+	return nil
+}
+
+func (l *link) deliver() {
+	defer l.Conn.Close()
+	for {
+		select {
+		case p := <-l.queue:
+			if !l.send(p) {
+				return
+			}
+		case <-l.closed:
+			for {
+				select {
+				case p := <-l.queue:
+					if !l.send(p) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send waits until p is due and writes it to the underlying connection, it returns false once writing fails.
+func (l *link) send(p packet) bool {
+	if d := p.at.Sub(l.clock.Now()); d > 0 {
+		l.clock.Sleep(d)
+	}
+	if _, err := l.Conn.Write(p.b); err != nil {
+		l.mu.Lock()
+		l.err = err
+		l.mu.Unlock()
+		return false
+	}
+	return true
+}
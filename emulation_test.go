@@ -0,0 +1,233 @@
+package netlimit_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+)
+
+func TestEmulatedConn(t *testing.T) {
+	tests := []struct {
+		name        string
+		emulation   netlimit.Emulation
+		size        int
+		wantElapsed time.Duration
+	}{
+		{
+			name: "unlimited",
+			size: 1000,
+		},
+		{
+			name:        "up rate",
+			emulation:   netlimit.Emulation{UpRate: 1000, DownRate: 2000},
+			size:        3000,
+			wantElapsed: 2 * time.Second,
+		},
+		{
+			name:        "down rate",
+			emulation:   netlimit.Emulation{UpRate: 2000, DownRate: 1000},
+			size:        3000,
+			wantElapsed: 2 * time.Second,
+		},
+		{
+			name:        "latency",
+			emulation:   netlimit.Emulation{Latency: 100 * time.Millisecond},
+			size:        1000,
+			wantElapsed: 100 * time.Millisecond,
+		},
+		{
+			name:        "stall",
+			emulation:   netlimit.Emulation{Latency: time.Second, StallEvery: time.Second, StallFor: 500 * time.Millisecond},
+			size:        1000,
+			wantElapsed: 1500 * time.Millisecond,
+		},
+		{
+			name:        "loss",
+			emulation:   netlimit.Emulation{Latency: 50 * time.Millisecond, Loss: 1},
+			size:        1000,
+			wantElapsed: 250 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+			tt.emulation.Clock = clock
+			raw1, raw2 := net.Pipe()
+			sender, err := netlimit.NewEmulatedConn(raw1, tt.emulation)
+			if err != nil {
+				t.Fatalf("NewEmulatedConn() error = %v", err)
+			}
+			recv, err := netlimit.NewEmulatedConn(raw2, tt.emulation)
+			if err != nil {
+				t.Fatalf("NewEmulatedConn() error = %v", err)
+			}
+			defer recv.Close()
+			done := make(chan struct{})
+			defer close(done)
+			go clock.AdvanceUntil(done, 10*time.Millisecond)
+
+			payload := bytes.Repeat([]byte{'x'}, tt.size)
+			go func() {
+				sender.Write(payload)
+				sender.Close()
+			}()
+
+			var got []byte
+			tr, err := netlimittest.Measure(clock, func() (int64, error) {
+				got, err = io.ReadAll(recv)
+				return int64(len(got)), err
+			})
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("received %d bytes, want the %d bytes of payload", len(got), len(payload))
+			}
+			// the clock is advanced in steps of 10ms
+			if tr.Elapsed < tt.wantElapsed || tr.Elapsed > tt.wantElapsed+20*time.Millisecond {
+				t.Errorf("transfer took %v of virtual time, want %v", tr.Elapsed, tt.wantElapsed)
+			}
+		})
+	}
+}
+
+func TestEmulatedConn_Jitter(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	e := netlimit.Emulation{Latency: 100 * time.Millisecond, Jitter: 50 * time.Millisecond, Seed: 1, Clock: clock}
+	raw, recv := net.Pipe()
+	defer recv.Close()
+	sender, err := netlimit.NewEmulatedConn(raw, e)
+	if err != nil {
+		t.Fatalf("NewEmulatedConn() error = %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go clock.AdvanceUntil(done, 10*time.Millisecond)
+
+	var payload []byte
+	for i := byte(0); i < 32; i++ {
+		payload = append(payload, i)
+	}
+	go func() {
+		// every byte is a separate write with its own jitter
+		for i := range payload {
+			sender.Write(payload[i : i+1])
+		}
+		sender.Close()
+	}()
+
+	var got []byte
+	tr, err := netlimittest.Measure(clock, func() (int64, error) {
+		got, err = io.ReadAll(recv)
+		return int64(len(got)), err
+	})
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("received %v, want writes delivered in order %v", got, payload)
+	}
+	if min, max := e.Latency, e.Latency+e.Jitter+20*time.Millisecond; tr.Elapsed < min || tr.Elapsed > max {
+		t.Errorf("transfer took %v of virtual time, want between %v and %v", tr.Elapsed, min, max)
+	}
+}
+
+func TestEmulatedConn_CloseStalledPeer(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	raw, recv := net.Pipe()
+	defer recv.Close()
+	sender, err := netlimit.NewEmulatedConn(raw, netlimit.Emulation{Latency: 10 * time.Millisecond, Clock: clock})
+	if err != nil {
+		t.Fatalf("NewEmulatedConn() error = %v", err)
+	}
+	if _, err := sender.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := sender.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// the write is due but the peer does not read it
+	clock.Advance(10 * time.Millisecond)
+	time.Sleep(1500 * time.Millisecond)
+
+	// the write has given up and the underlying connection is closed
+	recv.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := recv.Read(make([]byte, 5)); err != io.EOF {
+		t.Errorf("Read() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestEmulationPreset(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr error
+	}{
+		{name: "2G"},
+		{name: "3G"},
+		{name: "4G"},
+		{name: "DSL"},
+		{name: "satellite"},
+		{name: "5G", wantErr: netlimit.ErrUnknownEmulation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := netlimit.EmulationPreset(tt.name)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EmulationPreset() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (e.UpRate <= 0 || e.DownRate <= 0 || e.Latency <= 0) {
+				t.Errorf("EmulationPreset() = %+v, want rates and latency", e)
+			}
+		})
+	}
+}
+
+func TestListener_SetEmulation(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	ln, err := netlimit.NewListener(netlimittest.Listen(netlimittest.Shape{}), 1000000, 1000000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	ln.SetEmulation(&netlimit.Emulation{Latency: 100 * time.Millisecond, Clock: clock})
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hi there"))
+		conn.Close()
+	}()
+	client, err := ln.Listener.(*netlimittest.Listener).Dial("pipe", "")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	// the write waits for the emulated latency
+	clock.BlockUntil(1)
+	clock.Advance(99 * time.Millisecond)
+	b := make([]byte, 100)
+	client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, err := client.Read(b); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() = %d, %v before the emulated latency, want %v", n, err, os.ErrDeadlineExceeded)
+	}
+
+	clock.Advance(time.Millisecond)
+	client.SetReadDeadline(time.Time{})
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(got) != "hi there" {
+		t.Errorf("received %q, want %q", got, "hi there")
+	}
+}
@@ -0,0 +1,157 @@
+package netlimit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttledWait is the shortest wait for quota that counts as throttling of a connection
+const throttledWait = time.Millisecond
+
+// EventType is the type of an Event.
+type EventType uint8
+
+const (
+	// EventAccepted is published when the Listener accepts a connection
+	EventAccepted EventType = iota + 1
+
+	// EventClosed is published when a connection is closed
+	EventClosed
+
+	// EventLimitChanged is published when the global or the local limit of the Listener changes
+	EventLimitChanged
+
+	// EventQuotaExhausted is published when an allocation of a connection fails with ErrQuotaExceeded
+	EventQuotaExhausted
+
+	// EventSlowAlloc is published when an allocation of a connection waits longer than the slow allocation threshold
+	EventSlowAlloc
+
+	// EventThrottled is published when a connection starts waiting for quota, once until it is granted
+	// quota without waiting again
+	EventThrottled
+
+	// EventLimitChangeFailed is published when the limits of a period of the schedule of the Listener
+	// could not be applied
+	EventLimitChangeFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAccepted:
+		return "accepted"
+	case EventClosed:
+		return "closed"
+	case EventLimitChanged:
+		return "limit changed"
+	case EventQuotaExhausted:
+		return "quota exhausted"
+	case EventSlowAlloc:
+		return "slow alloc"
+	case EventThrottled:
+		return "throttled"
+	case EventLimitChangeFailed:
+		return "limit change failed"
+	default:
+		return fmt.Sprintf("EventType(%d)", uint8(t))
+	}
+}
+
+// Event is a lifecycle event of a Listener or of one of its connections.
+type Event struct {
+	// Type is the type of the event
+	Type EventType
+
+	// Time is the time the event happened at
+	Time time.Time
+
+	// Conn is the connection the event is about, nil for events of the Listener
+	Conn *Conn
+
+	// Global and Local are the limits of the Listener after EventLimitChanged,
+	// the limits that failed to apply for EventLimitChangeFailed
+	Global int
+	Local  int
+
+	// Wait is the time an allocation waited for quota for EventSlowAlloc and EventThrottled
+	Wait time.Duration
+
+	// Err is the error of the allocation for EventQuotaExhausted and of the change for EventLimitChangeFailed
+	Err error
+}
+
+// events publishes Events to subscribers, it is shared by a Listener and its connections.
+type events struct {
+	// slowAlloc is the threshold of EventSlowAlloc in nanoseconds, 0 disables it, accessed atomically,
+	// it comes first to be 64-bit aligned on 32-bit platforms
+	slowAlloc int64
+
+	mu    sync.Mutex
+	subs  map[chan Event]struct{}
+	clock Clock
+}
+
+func newEvents(clock Clock) *events {
+	return &events{subs: make(map[chan Event]struct{}), clock: clock}
+}
+
+func (e *events) subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	e.mu.Lock()
+	e.subs[ch] = struct{}{}
+	e.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			delete(e.subs, ch)
+			close(ch)
+			e.mu.Unlock()
+		})
+	}
+}
+
+// publish sends ev to all subscribers whose buffers are not full, so that publishing never blocks.
+func (e *events) publish(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.subs) == 0 {
+		return
+	}
+	ev.Time = e.clock.Now()
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (e *events) setClock(c Clock) {
+	e.mu.Lock()
+	e.clock = c
+	e.mu.Unlock()
+}
+
+// allocated publishes events of an allocation of conn that waited wait for quota and failed with err, if any.
+// throttled tracks whether conn is throttled, it is accessed atomically.
+func (e *events) allocated(conn *Conn, throttled *int32, wait time.Duration, err error) {
+	if err != nil {
+		if errors.Is(err, ErrQuotaExceeded) {
+			e.publish(Event{Type: EventQuotaExhausted, Conn: conn, Err: err})
+		}
+		return
+	}
+	if wait < throttledWait {
+		atomic.StoreInt32(throttled, 0)
+	} else if atomic.CompareAndSwapInt32(throttled, 0, 1) {
+		e.publish(Event{Type: EventThrottled, Conn: conn, Wait: wait})
+	}
+	if threshold := time.Duration(atomic.LoadInt64(&e.slowAlloc)); threshold > 0 && wait > threshold {
+		e.publish(Event{Type: EventSlowAlloc, Conn: conn, Wait: wait})
+	}
+}
@@ -0,0 +1,170 @@
+package netlimit_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+)
+
+// nextEvent returns the next event of type typ, skipping events of other types.
+func nextEvent(t *testing.T, events <-chan netlimit.Event, typ netlimit.EventType) netlimit.Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %v event", typ)
+		}
+	}
+}
+
+// acceptPipe returns a connection accepted by ln and the client end of it.
+func acceptPipe(t *testing.T, inner *netlimittest.Listener, ln *netlimit.Listener) (net.Conn, net.Conn) {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Accept() error = %v", err)
+		}
+		accepted <- conn
+	}()
+	client, err := inner.Dial("pipe", "")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	return <-accepted, client
+}
+
+func TestListener_Subscribe(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	events, cancel := ln.Subscribe(16)
+	defer cancel()
+
+	conn, client := acceptPipe(t, inner, ln)
+	defer client.Close()
+	if ev := nextEvent(t, events, netlimit.EventAccepted); ev.Conn != conn || ev.Time.IsZero() {
+		t.Errorf("accepted event = %+v, want the accepted connection", ev)
+	}
+
+	if err := ln.SetGlobalLimit(5000); err != nil {
+		t.Fatalf("SetGlobalLimit() error = %v", err)
+	}
+	if ev := nextEvent(t, events, netlimit.EventLimitChanged); ev.Global != 5000 || ev.Local != 1000 || ev.Conn != nil {
+		t.Errorf("limit changed event = %+v, want limits 5000 and 1000", ev)
+	}
+	if err := ln.SetLocalLimit(500); err != nil {
+		t.Fatalf("SetLocalLimit() error = %v", err)
+	}
+	if ev := nextEvent(t, events, netlimit.EventLimitChanged); ev.Global != 5000 || ev.Local != 500 {
+		t.Errorf("limit changed event = %+v, want limits 5000 and 500", ev)
+	}
+
+	conn.Close()
+	conn.Close()
+	if ev := nextEvent(t, events, netlimit.EventClosed); ev.Conn != conn {
+		t.Errorf("closed event = %+v, want the closed connection", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %+v after the connection was closed twice", ev)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("events channel open after cancel")
+	}
+}
+
+func TestListener_SubscribeThrottled(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	ln.SetSlowAllocThreshold(100 * time.Millisecond)
+	events, cancel := ln.Subscribe(16)
+	defer cancel()
+
+	conn, client := acceptPipe(t, inner, ln)
+	defer client.Close()
+	defer conn.Close()
+	go io.Copy(io.Discard, client)
+
+	// the burst is granted at once, the remaining 300 bytes wait for 300ms
+	if _, err := conn.Write(make([]byte, 1300)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if ev := nextEvent(t, events, netlimit.EventThrottled); ev.Conn != conn || ev.Wait <= 0 {
+		t.Errorf("throttled event = %+v, want a wait of the connection", ev)
+	}
+	if ev := nextEvent(t, events, netlimit.EventSlowAlloc); ev.Wait < 100*time.Millisecond {
+		t.Errorf("slow alloc event = %+v, want a wait above the threshold", ev)
+	}
+}
+
+func TestListener_SubscribeQuotaExhausted(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	ln.SetQuota(netlimit.NewQuota(netlimit.Monthly, 10), func(net.Conn) string { return "key" })
+	events, cancel := ln.Subscribe(16)
+	defer cancel()
+
+	conn, client := acceptPipe(t, inner, ln)
+	defer client.Close()
+	defer conn.Close()
+	go io.Copy(io.Discard, client)
+
+	if _, err := conn.Write(make([]byte, 20)); !errors.Is(err, netlimit.ErrQuotaExceeded) {
+		t.Fatalf("Write() error = %v, want %v", err, netlimit.ErrQuotaExceeded)
+	}
+	if ev := nextEvent(t, events, netlimit.EventQuotaExhausted); ev.Conn != conn || !errors.Is(ev.Err, netlimit.ErrQuotaExceeded) {
+		t.Errorf("quota exhausted event = %+v, want %v of the connection", ev, netlimit.ErrQuotaExceeded)
+	}
+}
+
+func TestListener_SubscribeSlowSubscriber(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	events, cancel := ln.Subscribe(1)
+	defer cancel()
+
+	// events that do not fit the buffer are dropped instead of blocking the listener
+	for i := 1; i <= 3; i++ {
+		if err := ln.SetGlobalLimit(1000 * (i + 1)); err != nil {
+			t.Fatalf("SetGlobalLimit() error = %v", err)
+		}
+	}
+	if ev := <-events; ev.Global != 2000 {
+		t.Errorf("first event = %+v, want global limit 2000", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %+v, want events beyond the buffer dropped", ev)
+	default:
+	}
+}
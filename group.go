@@ -0,0 +1,291 @@
+package netlimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var _ GlobalLimiter = (*GroupMember)(nil)
+
+// SharingPolicy determines how the budget of a LimiterGroup is shared between its members.
+type SharingPolicy int
+
+const (
+	// ShareFirstCome lets members compete for the whole budget of the group.
+	ShareFirstCome SharingPolicy = iota
+
+	// ShareFair splits the budget of the group between active members proportionally to their weights.
+	// Budget of idle members is split between the active ones, so no bandwidth is wasted.
+	ShareFair
+)
+
+// groupActivityWindow is the time after which a member that reserved nothing is considered idle
+const groupActivityWindow = time.Second
+
+// LimiterGroup is a budget shared by several Listeners and Dialers, e.g. serving different ports
+// over a single uplink. Every Listener or Dialer attaches to the group through its own GroupMember.
+type LimiterGroup struct {
+	mu sync.Mutex
+
+	// limiter is the limiter enforcing the budget of the whole group
+	limiter *rate.Limiter
+
+	// policy determines how the budget is shared between members
+	policy SharingPolicy
+
+	// members are the members of the group, keyed by name
+	members map[string]*GroupMember
+
+	// clock tells the time limits change and reservations are cancelled at
+	clock Clock
+}
+
+// GroupMember is the GlobalLimiter a single Listener or Dialer uses to take part in a LimiterGroup.
+type GroupMember struct {
+	group *LimiterGroup
+
+	// name identifies the member in the group statistics
+	name string
+
+	// weight is the relative share of the member under ShareFair
+	weight int
+
+	// limiter enforces the share of the member under ShareFair
+	limiter *rate.Limiter
+
+	// lastActive is the time of the last reservation of the member
+	lastActive time.Time
+
+	// active is set when the member counted as active during the last rebalance
+	active bool
+
+	// reserved is the number of bytes reserved by the member
+	reserved int64
+}
+
+// GroupStats is a snapshot of a LimiterGroup.
+type GroupStats struct {
+	// Limit is the bytes per second limit of the whole group
+	Limit int
+
+	// Policy is the policy the budget is shared with
+	Policy SharingPolicy
+
+	// Reserved is the number of bytes reserved by all members combined
+	Reserved int64
+
+	// Members are snapshots of all members, sorted by name
+	Members []MemberStats
+}
+
+// MemberStats is a snapshot of a GroupMember.
+type MemberStats struct {
+	// Name identifies the member
+	Name string
+
+	// Weight is the relative share of the member under ShareFair
+	Weight int
+
+	// Share is the bytes per second the member is currently allowed to use
+	Share int
+
+	// Active reports whether the member reserved anything recently
+	Active bool
+
+	// Reserved is the number of bytes reserved by the member
+	Reserved int64
+}
+
+// NewLimiterGroup returns a LimiterGroup that allows limit bytes per second for all members combined.
+func NewLimiterGroup(limit int) *LimiterGroup {
+	return &LimiterGroup{
+		limiter: rate.NewLimiter(rate.Limit(limit), limit),
+		members: make(map[string]*GroupMember),
+		clock:   realClock{},
+	}
+}
+
+// SetClock replaces the clock of the group, e.g. with a fake clock in tests.
+// SetClock must be called before the first reservation.
+func (g *LimiterGroup) SetClock(c Clock) {
+	g.mu.Lock()
+	g.clock = c
+	g.mu.Unlock()
+}
+
+// Member returns the GroupMember identified by name, creating it with weight if it does not exist yet.
+// Pass the member to Listener.SetGlobalLimiter or Dialer.SetGlobalLimiter to attach them to the group.
+func (g *LimiterGroup) Member(name string, weight int) *GroupMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if m, ok := g.members[name]; ok {
+		return m
+	}
+
+	if weight < 1 {
+		weight = 1
+	}
+	limit := g.limiter.Limit()
+	m := &GroupMember{
+		group:   g,
+		name:    name,
+		weight:  weight,
+		limiter: rate.NewLimiter(limit, g.limiter.Burst()),
+	}
+	g.members[name] = m
+	g.rebalance(g.clock.Now())
+	return m
+}
+
+// SetLimit sets the bytes per second limit of the whole group.
+func (g *LimiterGroup) SetLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.clock.Now()
+	g.limiter.SetLimitAt(now, rate.Limit(limit))
+	g.limiter.SetBurstAt(now, limit)
+	for _, m := range g.members {
+		m.limiter.SetBurstAt(now, limit)
+	}
+	g.rebalance(now)
+}
+
+// Limit returns the bytes per second limit of the whole group.
+func (g *LimiterGroup) Limit() int {
+	return limitToInt(g.limiter.Limit())
+}
+
+// SetPolicy sets the policy the budget is shared with.
+func (g *LimiterGroup) SetPolicy(p SharingPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.policy = p
+	g.rebalance(g.clock.Now())
+}
+
+// Stats returns a snapshot of the group and all of its members.
+func (g *LimiterGroup) Stats() GroupStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stats := GroupStats{
+		Limit:  limitToInt(g.limiter.Limit()),
+		Policy: g.policy,
+	}
+	for _, m := range g.members {
+		stats.Reserved += m.reserved
+		stats.Members = append(stats.Members, MemberStats{
+			Name:     m.name,
+			Weight:   m.weight,
+			Share:    limitToInt(m.limiter.Limit()),
+			Active:   m.active,
+			Reserved: m.reserved,
+		})
+	}
+	sort.Slice(stats.Members, func(i, j int) bool {
+		return stats.Members[i].Name < stats.Members[j].Name
+	})
+	return stats
+}
+
+// rebalance recalculates shares of members, rebalance must be called with g.mu held.
+func (g *LimiterGroup) rebalance(now time.Time) {
+	limit := g.limiter.Limit()
+	totalWeight := 0
+	for _, m := range g.members {
+		m.active = now.Sub(m.lastActive) < groupActivityWindow
+		if m.active {
+			totalWeight += m.weight
+		}
+	}
+
+	for _, m := range g.members {
+		share := limit
+		if g.policy == ShareFair && m.active && limit != rate.Inf {
+			share = limit * rate.Limit(m.weight) / rate.Limit(totalWeight)
+		}
+		m.limiter.SetLimitAt(now, share)
+	}
+}
+
+func (g *LimiterGroup) reserve(m *GroupMember, now time.Time, n int) Reservation {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m.lastActive = now
+	if !m.active {
+		g.rebalance(now)
+	}
+	for _, other := range g.members {
+		if other.active && now.Sub(other.lastActive) >= groupActivityWindow {
+			g.rebalance(now)
+			break
+		}
+	}
+
+	m.reserved += int64(n)
+	r := &groupReservation{
+		group: g.limiter.ReserveN(now, n),
+		clock: g.clock,
+	}
+	if g.policy == ShareFair {
+		r.member = m.limiter.ReserveN(now, n)
+	}
+	return r
+}
+
+// ReserveN reserves n bytes of the member share and of the group budget.
+func (m *GroupMember) ReserveN(now time.Time, n int) Reservation {
+	return m.group.reserve(m, now, n)
+}
+
+// Limit returns the bytes per second limit of the whole group.
+func (m *GroupMember) Limit() int {
+	return m.group.Limit()
+}
+
+// Burst returns the maximum number of bytes that can be reserved at once.
+func (m *GroupMember) Burst() int {
+	return m.group.limiter.Burst()
+}
+
+// SetLimit sets the bytes per second limit of the whole group, it affects all members.
+func (m *GroupMember) SetLimit(limit int) {
+	m.group.SetLimit(limit)
+}
+
+// Name returns the name identifying the member in the group.
+func (m *GroupMember) Name() string {
+	return m.name
+}
+
+// groupReservation is a Reservation of a GroupMember, it holds a reservation of the group budget
+// and, under ShareFair, a reservation of the member share.
+type groupReservation struct {
+	group  *rate.Reservation
+	member *rate.Reservation
+	clock  Clock
+}
+
+func (r *groupReservation) OK() bool {
+	return r.group.OK() && (r.member == nil || r.member.OK())
+}
+
+func (r *groupReservation) DelayFrom(now time.Time) time.Duration {
+	delay := r.group.DelayFrom(now)
+	if r.member != nil {
+		if memberDelay := r.member.DelayFrom(now); memberDelay > delay {
+			delay = memberDelay
+		}
+	}
+	return delay
+}
+
+func (r *groupReservation) Cancel() {
+	now := r.clock.Now()
+	r.group.CancelAt(now)
+	if r.member != nil {
+		r.member.CancelAt(now)
+	}
+}
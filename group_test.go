@@ -0,0 +1,141 @@
+package netlimit_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+func TestLimiterGroup_ReserveN(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    netlimit.SharingPolicy
+		limit     int
+		reserve   int
+		wantDelay time.Duration
+	}{
+		{
+			name:      "first come member refills at the group rate",
+			policy:    netlimit.ShareFirstCome,
+			limit:     100,
+			reserve:   50,
+			wantDelay: 500 * time.Millisecond,
+		},
+		{
+			name:      "fair member refills at its weighted share",
+			policy:    netlimit.ShareFair,
+			limit:     100,
+			reserve:   50,
+			wantDelay: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := netlimit.NewLimiterGroup(tt.limit)
+			g.SetPolicy(tt.policy)
+			a := g.Member("a", 1)
+			b := g.Member("b", 1)
+
+			now := time.Now()
+			// both members become active, then a uses up the whole burst
+			a.ReserveN(now, 0)
+			b.ReserveN(now, 0)
+			a.ReserveN(now, tt.limit)
+			r := a.ReserveN(now, tt.reserve)
+			if !r.OK() {
+				t.Fatalf("ReserveN() ok = false")
+			}
+			if got := r.DelayFrom(now); got != tt.wantDelay {
+				t.Errorf("DelayFrom() = %v, want %v", got, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestLimiterGroup_Stats(t *testing.T) {
+	g := netlimit.NewLimiterGroup(100)
+	g.SetPolicy(netlimit.ShareFair)
+	g.Member("http", 1).ReserveN(time.Now(), 10)
+	g.Member("https", 3).ReserveN(time.Now(), 20)
+	g.Member("custom", 1)
+
+	stats := g.Stats()
+	if stats.Limit != 100 || stats.Reserved != 30 || len(stats.Members) != 3 {
+		t.Fatalf("Stats() = %+v", stats)
+	}
+	wantShares := map[string]int{"custom": 100, "http": 25, "https": 75}
+	for _, m := range stats.Members {
+		if m.Share != wantShares[m.Name] {
+			t.Errorf("Stats() %v share = %v, want %v", m.Name, m.Share, wantShares[m.Name])
+		}
+	}
+
+	g.SetLimit(200)
+	if got := g.Member("http", 1).Limit(); got != 200 {
+		t.Errorf("Limit() = %v, want %v", got, 200)
+	}
+}
+
+func TestDialer_SetGlobalLimiter(t *testing.T) {
+	g := netlimit.NewLimiterGroup(100)
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 100, 100)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	ln.SetGlobalLimiter(g.Member("listener", 1))
+
+	d, err := netlimit.NewDialer(100, 100)
+	if err != nil {
+		t.Fatalf("NewDialer() error = %v", err)
+	}
+	d.SetGlobalLimiter(g.Member("dialer", 1))
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Accept() error = %v", err)
+			return
+		}
+		c.Read(make([]byte, 50))
+	}()
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*netlimit.Conn); !ok {
+		t.Errorf("Dial() got %T, want *netlimit.Conn", conn)
+	}
+	if _, err := conn.Write(make([]byte, 50)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := g.Stats().Reserved; got < 50 {
+		t.Errorf("Stats() reserved = %v, want at least %v", got, 50)
+	}
+}
+
+func TestNewDialer(t *testing.T) {
+	if _, err := netlimit.NewDialer(10, 20); err != netlimit.ErrLimitGreaterThanTotal {
+		t.Errorf("NewDialer() error = %v, wantErr %v", err, netlimit.ErrLimitGreaterThanTotal)
+	}
+	var _ interface {
+		Dial(network, addr string) (net.Conn, error)
+	} = &netlimit.Dialer{}
+}
+
+func TestDialer_SetGlobalLimitBelowLocal(t *testing.T) {
+	d, err := netlimit.NewDialer(100, 50)
+	if err != nil {
+		t.Fatalf("NewDialer() error = %v", err)
+	}
+	if err := d.SetGlobalLimit(40); err != netlimit.ErrLimitGreaterThanTotal {
+		t.Errorf("SetGlobalLimit() error = %v, wantErr %v", err, netlimit.ErrLimitGreaterThanTotal)
+	}
+	// the global limit is left at 100
+	if err := d.SetLocalLimit(100); err != nil {
+		t.Errorf("SetLocalLimit() error = %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+// Package fakeclock provides a netlimit.Clock whose time moves only when told to, it backs the fake clock
+// of netlimittest and the virtual time of sim.
+package fakeclock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+var _ netlimit.Clock = (*Clock)(nil)
+
+// Clock is a fake netlimit.Clock, its time moves only when Advance is called, so that rate behaviour can be
+// tested deterministically in milliseconds of wall time.
+type Clock struct {
+	mu sync.Mutex
+
+	// changed is signalled whenever a timer is added or removed
+	changed *sync.Cond
+
+	now time.Time
+
+	// timers are the active timers of the clock
+	timers []*timer
+}
+
+// New returns a fake clock set to start.
+func New(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a Timer that fires once the clock is advanced by d.
+func (c *Clock) NewTimer(d time.Duration) netlimit.Timer {
+	t := &timer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Sleep blocks until the clock is advanced by d.
+func (c *Clock) Sleep(d time.Duration) {
+	<-c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d and fires timers that are due, in the order of their deadlines.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	sort.Slice(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	for len(c.timers) > 0 && !c.timers[0].deadline.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.deadline
+		t.fire(c.now)
+	}
+	c.now = end
+	c.changed.Broadcast()
+}
+
+// AdvanceUntil moves the clock forward by step whenever there are active timers, e.g. goroutines waiting for quota,
+// until done is closed. It drives code under test through virtual time as fast as the code runs.
+func (c *Clock) AdvanceUntil(done <-chan struct{}, step time.Duration) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if c.Timers() == 0 {
+			// let goroutines under test run until they wait for a timer
+			time.Sleep(100 * time.Microsecond)
+			continue
+		}
+		c.Advance(step)
+	}
+}
+
+// Timers returns the number of active timers, including goroutines blocked in Sleep.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Next returns the earliest deadline of active timers, ok is false if there are no active timers.
+// Advancing the clock to Next fires the next timer, so that Next drives discrete-event simulations.
+func (c *Clock) Next() (deadline time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.timers {
+		if !ok || t.deadline.Before(deadline) {
+			deadline, ok = t.deadline, true
+		}
+	}
+	return deadline, ok
+}
+
+// BlockUntil blocks until there are at least n active timers, e.g. until goroutines under test wait for quota.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.changed.Wait()
+	}
+}
+
+// BlockUntilContext does the same as BlockUntil but gives up once ctx is done and returns its error,
+// e.g. once goroutines under test exit instead of waiting for a timer.
+func (c *Clock) BlockUntilContext(ctx context.Context, n int) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.changed.Broadcast()
+			c.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.changed.Wait()
+	}
+	return nil
+}
+
+// remove removes t from active timers and reports whether it was active, remove must be called with c.mu held.
+func (c *Clock) remove(t *timer) bool {
+	for i, active := range c.timers {
+		if active == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+type timer struct {
+	clock    *Clock
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := c.remove(t)
+	t.deadline = c.now.Add(d)
+	if d <= 0 {
+		t.fire(c.now)
+		return active
+	}
+	c.timers = append(c.timers, t)
+	c.changed.Broadcast()
+	return active
+}
+
+// fire sends now on the channel of the timer unless a previous value has not been received yet, like time.Timer.
+func (t *timer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
@@ -0,0 +1,146 @@
+package fakeclock_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit/internal/fakeclock"
+)
+
+func TestClock_Advance(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		timers   []time.Duration
+		advance  time.Duration
+		wantFire []bool
+	}{
+		{
+			name:     "fires due timers only",
+			timers:   []time.Duration{time.Second, 2 * time.Second},
+			advance:  time.Second,
+			wantFire: []bool{true, false},
+		},
+		{
+			name:     "fires all timers",
+			timers:   []time.Duration{2 * time.Second, time.Millisecond},
+			advance:  time.Minute,
+			wantFire: []bool{true, true},
+		},
+		{
+			name:     "fires timers without delay at once",
+			timers:   []time.Duration{0},
+			wantFire: []bool{true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fakeclock.New(start)
+			var timers []<-chan time.Time
+			for _, d := range tt.timers {
+				timers = append(timers, c.NewTimer(d).C())
+			}
+			c.Advance(tt.advance)
+
+			if got := c.Now(); !got.Equal(start.Add(tt.advance)) {
+				t.Errorf("Now() = %v, want %v", got, start.Add(tt.advance))
+			}
+			for i, ch := range timers {
+				select {
+				case at := <-ch:
+					if !tt.wantFire[i] {
+						t.Errorf("timer %d fired, want not fired", i)
+					}
+					if want := start.Add(tt.timers[i]); !at.Equal(want) {
+						t.Errorf("timer %d fired at %v, want %v", i, at, want)
+					}
+				default:
+					if tt.wantFire[i] {
+						t.Errorf("timer %d not fired, want fired", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestClock_Stop(t *testing.T) {
+	c := fakeclock.New(time.Now())
+	timer := c.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Errorf("Stop() = false, want true for an active timer")
+	}
+	if timer.Stop() {
+		t.Errorf("Stop() = true, want false for a stopped timer")
+	}
+	c.Advance(time.Minute)
+	select {
+	case <-timer.C():
+		t.Errorf("stopped timer fired")
+	default:
+	}
+
+	if timer.Reset(time.Second) {
+		t.Errorf("Reset() = true, want false for a stopped timer")
+	}
+	c.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Errorf("reset timer not fired")
+	}
+}
+
+func TestClock_Sleep(t *testing.T) {
+	c := fakeclock.New(time.Now())
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(time.Hour)
+		close(done)
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Hour)
+	<-done
+	if got := c.Timers(); got != 0 {
+		t.Errorf("Timers() = %d, want 0", got)
+	}
+}
+
+func TestClock_Next(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := fakeclock.New(start)
+	if _, ok := c.Next(); ok {
+		t.Errorf("Next() ok = true, want false without timers")
+	}
+
+	c.NewTimer(2 * time.Second)
+	first := c.NewTimer(time.Second)
+	if got, ok := c.Next(); !ok || !got.Equal(start.Add(time.Second)) {
+		t.Errorf("Next() = %v, %v, want %v", got, ok, start.Add(time.Second))
+	}
+
+	first.Stop()
+	if got, ok := c.Next(); !ok || !got.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Next() = %v, %v, want %v after the first timer was stopped", got, ok, start.Add(2*time.Second))
+	}
+}
+
+func TestClock_BlockUntilContext(t *testing.T) {
+	c := fakeclock.New(time.Now())
+	c.NewTimer(time.Second)
+	if err := c.BlockUntilContext(context.Background(), 1); err != nil {
+		t.Errorf("BlockUntilContext() error = %v, want nil with an active timer", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// nothing else waits for a timer
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := c.BlockUntilContext(ctx, 2); err != context.Canceled {
+		t.Errorf("BlockUntilContext() error = %v, want %v", err, context.Canceled)
+	}
+}
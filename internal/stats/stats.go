@@ -0,0 +1,13 @@
+// Package stats provides statistics shared by the reports of netlimit replays and sim simulations.
+package stats
+
+import "time"
+
+// Percentile returns the p-th percentile of sorted durations, sorted must not be empty.
+func Percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,49 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit/internal/stats"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{
+			name:   "single duration",
+			sorted: []time.Duration{time.Second},
+			p:      50,
+			want:   time.Second,
+		},
+		{
+			name:   "median rounds up",
+			sorted: []time.Duration{1, 2, 3},
+			p:      50,
+			want:   2,
+		},
+		{
+			name:   "tail",
+			sorted: []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			p:      95,
+			want:   10,
+		},
+		{
+			name:   "zeroth is the minimum",
+			sorted: []time.Duration{1, 2, 3},
+			p:      0,
+			want:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stats.Percentile(tt.sorted, tt.p); got != tt.want {
+				t.Errorf("Percentile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package netlimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var _ GlobalLimiter = (*LeaseLimiter)(nil)
+
+const (
+	// leaseRenewals is the number of times a lease is renewed within its ttl
+	leaseRenewals = 3
+
+	// leaseDialTimeout is the maximum time spent connecting to a Coordinator
+	leaseDialTimeout = time.Second
+)
+
+// LeaseLimiter is a GlobalLimiter whose budget is a share of a global limit leased from a Coordinator.
+// LeaseLimiter renews its lease in the background and reports its demand so that the Coordinator can
+// split the global limit between processes according to their needs.
+//
+// When the Coordinator is unreachable, LeaseLimiter keeps using its last share until the lease expires
+// and then falls back to the fallback limit, e.g. the global limit divided by the number of processes.
+type LeaseLimiter struct {
+	// reserved is the number of bytes reserved since the last renewal, accessed atomically,
+	// it comes first to be 64-bit aligned on 32-bit platforms
+	reserved int64
+
+	mu sync.Mutex
+
+	// network and addr are the address of the Coordinator
+	network string
+	addr    string
+
+	// id identifies this process in the Coordinator
+	id string
+
+	// limiter is the local limiter enforcing the leased share
+	limiter *rate.Limiter
+
+	// fallback is the bytes per second limit used when there is no valid lease
+	fallback int
+
+	// global is the global limit as last reported by the Coordinator
+	global int
+
+	// pendingLimit is the global limit that will be sent to the Coordinator with the next renewal
+	pendingLimit int
+
+	// expires is the time the current lease expires at, zero if there is no lease
+	expires time.Time
+
+	// interval is the time between renewals
+	interval time.Duration
+
+	// conn is the connection to the Coordinator, nil if disconnected
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+
+	// throttled is set to 1 when any reservation since the last renewal had to wait
+	throttled int32
+
+	// lastRenewal is the time of the last renewal attempt
+	lastRenewal time.Time
+
+	// clock tells the time leases expire and demand is measured at and schedules renewals
+	clock Clock
+
+	// done is closed once the LeaseLimiter is closed
+	done chan struct{}
+}
+
+// NewLeaseLimiter returns a LeaseLimiter that leases its budget from the Coordinator listening on addr.
+// id must be unique across processes sharing the Coordinator, fallback is the bytes per second limit used
+// until the first lease is granted and whenever the lease expires without being renewed.
+func NewLeaseLimiter(network, addr, id string, fallback int) *LeaseLimiter {
+	l := &LeaseLimiter{
+		network:  network,
+		addr:     addr,
+		id:       id,
+		limiter:  rate.NewLimiter(rate.Limit(fallback), fallback),
+		fallback: fallback,
+		global:   fallback,
+		interval: defaultLeaseTTL / leaseRenewals,
+		clock:    realClock{},
+		done:     make(chan struct{}),
+	}
+	l.lastRenewal = l.clock.Now()
+
+	go l.run()
+	return l
+}
+
+// ReserveN reserves n bytes of the leased share.
+func (l *LeaseLimiter) ReserveN(now time.Time, n int) Reservation {
+	atomic.AddInt64(&l.reserved, int64(n))
+	r := l.limiter.ReserveN(now, n)
+	if r.OK() && r.DelayFrom(now) > 0 {
+		atomic.StoreInt32(&l.throttled, 1)
+	}
+	return clockReservation{Reservation: r, clock: l.clock}
+}
+
+// SetClock replaces the clock of the LeaseLimiter, e.g. with a fake clock in tests.
+// SetClock must be called before the first reservation, a renewal already scheduled on the previous clock still fires.
+func (l *LeaseLimiter) SetClock(c Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = c
+	l.lastRenewal = c.Now()
+}
+
+// Limit returns the bytes per second this process is currently allowed to use, its leased share.
+func (l *LeaseLimiter) Limit() int {
+	return l.Share()
+}
+
+// Burst returns the maximum number of bytes that can be reserved at once, the leased share.
+func (l *LeaseLimiter) Burst() int {
+	return l.limiter.Burst()
+}
+
+// Global returns the global limit as last reported by the Coordinator.
+func (l *LeaseLimiter) Global() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.global
+}
+
+// SetLimit changes the global limit enforced by the Coordinator for all processes, unlike Limit which
+// reports the share of this process. The change is sent to the Coordinator with the next renewal
+// and is ignored unless the Coordinator allows remote limit changes, see Coordinator.SetAllowRemoteLimit.
+func (l *LeaseLimiter) SetLimit(limit int) {
+	l.mu.Lock()
+	l.global = limit
+	l.pendingLimit = limit
+	l.mu.Unlock()
+}
+
+// Share returns the bytes per second this process is currently allowed to use.
+func (l *LeaseLimiter) Share() int {
+	return limitToInt(l.limiter.Limit())
+}
+
+// Close stops renewing the lease and disconnects from the Coordinator.
+func (l *LeaseLimiter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+		return nil
+	default:
+	}
+
+	close(l.done)
+	if l.conn != nil {
+		return l.conn.Close()
+	}
+	return nil
+}
+
+func (l *LeaseLimiter) run() {
+	for {
+		if err := l.renew(); err != nil {
+			l.disconnect()
+			l.expire()
+		}
+
+		l.mu.Lock()
+		interval, clock := l.interval, l.clock
+		l.mu.Unlock()
+		timer := clock.NewTimer(interval)
+		select {
+		case <-l.done:
+			timer.Stop()
+			l.disconnect()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// renew reports demand observed since the last renewal and applies the newly leased share.
+func (l *LeaseLimiter) renew() error {
+	if err := l.connect(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	conn, enc, dec := l.conn, l.enc, l.dec
+	req := leaseRequest{
+		ID:     l.id,
+		Demand: l.demand(),
+		Limit:  l.pendingLimit,
+	}
+	l.mu.Unlock()
+
+	// deadlines of the network connection are always on the real time
+	conn.SetDeadline(time.Now().Add(leaseDialTimeout))
+	if err := enc.Encode(req); err != nil {
+		return fmt.Errorf("failed to request lease: %w", err)
+	}
+	var resp leaseResponse
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read lease: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if req.Limit == l.pendingLimit {
+		l.pendingLimit = 0
+	}
+	l.global = resp.Global
+	l.expires = l.clock.Now().Add(resp.TTL)
+	if resp.TTL > 0 {
+		l.interval = resp.TTL / leaseRenewals
+	}
+	l.setShare(resp.Share)
+	return nil
+}
+
+// demand estimates the bytes per second this process would like to use.
+// demand must be called with l.mu held.
+func (l *LeaseLimiter) demand() int {
+	now := l.clock.Now()
+	elapsed := now.Sub(l.lastRenewal).Seconds()
+	l.lastRenewal = now
+	reserved := atomic.SwapInt64(&l.reserved, 0)
+	throttled := atomic.SwapInt32(&l.throttled, 0) == 1
+	if elapsed <= 0 {
+		return 0
+	}
+
+	demand := int(float64(reserved) / elapsed)
+	if throttled {
+		// callers had to wait, the observed rate is capped by the share, ask for more
+		share := l.Share()
+		if demand < share {
+			demand = share
+		}
+		demand *= 2
+	}
+	return demand
+}
+
+// expire falls back to the fallback limit once the lease is no longer valid.
+func (l *LeaseLimiter) expire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.expires.IsZero() && l.clock.Now().Before(l.expires) {
+		return
+	}
+	l.expires = time.Time{}
+	l.setShare(l.fallback)
+}
+
+// setShare must be called with l.mu held.
+func (l *LeaseLimiter) setShare(share int) {
+	if share < 1 {
+		// a single byte keeps reservations valid until a share is granted
+		share = 1
+	}
+	now := l.clock.Now()
+	l.limiter.SetLimitAt(now, rate.Limit(share))
+	l.limiter.SetBurstAt(now, share)
+}
+
+func (l *LeaseLimiter) connect() error {
+	l.mu.Lock()
+	connected := l.conn != nil
+	l.mu.Unlock()
+	if connected {
+		return nil
+	}
+
+	conn, err := net.DialTimeout(l.network, l.addr, leaseDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to coordinator: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conn = conn
+	l.enc = json.NewEncoder(conn)
+	l.dec = json.NewDecoder(conn)
+	return nil
+}
+
+func (l *LeaseLimiter) disconnect() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+}
@@ -0,0 +1,237 @@
+package netlimit
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	_ GlobalLimiter = (*rateLimiter)(nil)
+	_ Releaser      = (*rateLimiter)(nil)
+)
+
+// GlobalLimiter is the budget shared by all connections of a Listener.
+// All connections combined cannot exceed limits enforced by the GlobalLimiter.
+type GlobalLimiter interface {
+	// ReserveN returns a Reservation that indicates how long the caller must wait before n bytes can be sent.
+	ReserveN(now time.Time, n int) Reservation
+
+	// Limit returns the maximum bytes per second allowed by the GlobalLimiter.
+	Limit() int
+
+	// Burst returns the maximum number of bytes that can be reserved at once.
+	Burst() int
+
+	// SetLimit sets the maximum bytes per second allowed by the GlobalLimiter.
+	SetLimit(limit int)
+}
+
+// Releaser is implemented by GlobalLimiters that can take back bytes that were reserved but not sent.
+// Allocators that reserve ahead of time, e.g. PrefetchAllocator, release leftovers on idle and on close,
+// leftovers reserved from GlobalLimiters that do not implement Releaser are simply not sent.
+type Releaser interface {
+	// Release gives n reserved but unused bytes back to the limiter.
+	Release(n int)
+}
+
+// Reservation holds information about bytes that are permitted by a GlobalLimiter to happen after a delay.
+type Reservation interface {
+	// OK returns whether the GlobalLimiter can provide the requested number of bytes.
+	OK() bool
+
+	// DelayFrom returns the duration for which the reservation holder must wait before sending reserved bytes.
+	DelayFrom(now time.Time) time.Duration
+
+	// Cancel indicates that the reservation holder will not send reserved bytes
+	// and reverses the effects of this Reservation on the GlobalLimiter as much as possible.
+	Cancel()
+}
+
+// NewGlobalLimiter returns a GlobalLimiter that allows limit bytes per second with a burst of limit bytes.
+func NewGlobalLimiter(limit int) GlobalLimiter {
+	return WrapLimiter(rate.NewLimiter(rate.Limit(limit), limit))
+}
+
+// NewGlobalLimiterWithClock does the same as NewGlobalLimiter but tells the time with c, e.g. a fake clock in tests.
+func NewGlobalLimiterWithClock(limit int, c Clock) GlobalLimiter {
+	return &rateLimiter{limiter: rate.NewLimiter(rate.Limit(limit), limit), clock: c}
+}
+
+// WrapLimiter returns a GlobalLimiter backed by lim.
+// Bytes given back with Release go back into the bucket of lim, see releaseTo.
+func WrapLimiter(lim *rate.Limiter) GlobalLimiter {
+	return &rateLimiter{limiter: lim, clock: realClock{}}
+}
+
+type rateLimiter struct {
+	// pool keeps bytes given back by Release while reservations wait on limiter
+	pool releasePool
+
+	limiter *rate.Limiter
+	clock   Clock
+}
+
+func (l *rateLimiter) ReserveN(now time.Time, n int) Reservation {
+	return reserveReleased(l.limiter, &l.pool, now, n, l.clock)
+}
+
+// Release gives n bytes back to later reservations, see releaseTo.
+func (l *rateLimiter) Release(n int) {
+	releaseTo(l.limiter, &l.pool, l.clock.Now(), n)
+}
+
+func (l *rateLimiter) Limit() int {
+	return limitToInt(l.limiter.Limit())
+}
+
+func (l *rateLimiter) Burst() int {
+	return l.limiter.Burst()
+}
+
+func (l *rateLimiter) SetLimit(limit int) {
+	now := l.clock.Now()
+	l.limiter.SetLimitAt(now, rate.Limit(limit))
+	l.limiter.SetBurstAt(now, limit)
+}
+
+// releasedReservation is a Reservation partly or entirely covered by released bytes.
+type releasedReservation struct {
+	// reservation is the reservation of bytes not covered by released ones, nil if there are none
+	reservation *rate.Reservation
+
+	// pool is the pool taken released bytes go back to on Cancel
+	pool  *releasePool
+	taken int
+	burst int
+
+	clock Clock
+}
+
+func (r *releasedReservation) OK() bool {
+	return r.reservation == nil || r.reservation.OK()
+}
+
+func (r *releasedReservation) DelayFrom(now time.Time) time.Duration {
+	if r.reservation == nil {
+		return 0
+	}
+	return r.reservation.DelayFrom(now)
+}
+
+func (r *releasedReservation) Cancel() {
+	if r.reservation != nil {
+		r.reservation.CancelAt(r.clock.Now())
+	}
+	r.pool.put(r.taken, r.burst)
+}
+
+// reserveReleased reserves n bytes, taking bytes kept in p first and the rest from lim.
+// Taken bytes go back to p when the Reservation is cancelled.
+func reserveReleased(lim *rate.Limiter, p *releasePool, now time.Time, n int, c Clock) Reservation {
+	burst := lim.Burst()
+	taken := p.take(now, n)
+	r := &releasedReservation{pool: p, taken: taken, burst: burst, clock: c}
+	if taken < n {
+		r.reservation = lim.ReserveN(now, n-taken)
+		if !r.reservation.OK() {
+			// the caller never cancels a reservation that is not OK
+			p.put(taken, burst)
+			r.taken = 0
+		}
+	}
+	return r
+}
+
+// releaseTo gives n reserved but unused bytes back to lim. Unless reservations wait on lim, the bytes go back into
+// its bucket with a negative reservation and the bucket caps them at its burst like any other tokens.
+// Crediting a bucket that reservations wait on would move its last event before them and make their Cancel restore
+// more than they took, so the bytes are kept in p instead. They serve reservations until the bucket catches up with
+// the ones that were waiting, by then the bucket would have absorbed them.
+func releaseTo(lim *rate.Limiter, p *releasePool, now time.Time, n int) {
+	if n <= 0 || lim.Limit() == 0 {
+		return
+	}
+	if lim.AllowN(now, 0) {
+		lim.ReserveN(now, -n)
+		return
+	}
+	p.extend(now.Add(lim.ReserveN(now, 0).DelayFrom(now)))
+	p.put(n, lim.Burst())
+}
+
+// clockReservation is a Reservation of a rate.Limiter that is cancelled at the time of clock.
+type clockReservation struct {
+	*rate.Reservation
+	clock Clock
+}
+
+func (r clockReservation) Cancel() {
+	r.CancelAt(r.clock.Now())
+}
+
+// releasePool keeps bytes given back to a limiter while reservations wait on it, see releaseTo.
+// Fields are accessed atomically, a releasePool has to be 64-bit aligned.
+type releasePool struct {
+	// bytes is the number of bytes kept
+	bytes int64
+
+	// until is the time in Unix nanoseconds the bucket catches up with the reservations that were waiting
+	// when the bytes were given back, kept bytes are dropped after it
+	until int64
+}
+
+// take takes up to n kept bytes at now and returns the number of bytes taken.
+func (p *releasePool) take(now time.Time, n int) int {
+	for {
+		available := atomic.LoadInt64(&p.bytes)
+		if available <= 0 || n <= 0 {
+			return 0
+		}
+		if now.UnixNano() >= atomic.LoadInt64(&p.until) {
+			atomic.CompareAndSwapInt64(&p.bytes, available, 0)
+			return 0
+		}
+		taken := int64(n)
+		if taken > available {
+			taken = available
+		}
+		if atomic.CompareAndSwapInt64(&p.bytes, available, available-taken) {
+			return int(taken)
+		}
+	}
+}
+
+// put keeps n more bytes, the pool is capped at burst like the tokens of a bucket.
+func (p *releasePool) put(n, burst int) {
+	for {
+		available := atomic.LoadInt64(&p.bytes)
+		next := available + int64(n)
+		if next > int64(burst) {
+			next = int64(burst)
+		}
+		if n <= 0 || next <= available || atomic.CompareAndSwapInt64(&p.bytes, available, next) {
+			return
+		}
+	}
+}
+
+// extend keeps bytes at least until until.
+func (p *releasePool) extend(until time.Time) {
+	for {
+		current := atomic.LoadInt64(&p.until)
+		if until.UnixNano() <= current || atomic.CompareAndSwapInt64(&p.until, current, until.UnixNano()) {
+			return
+		}
+	}
+}
+
+// limitToInt converts limit to bytes per second, rate.Inf is converted to math.MaxInt.
+func limitToInt(limit rate.Limit) int {
+	if limit == rate.Inf || float64(limit) > float64(math.MaxInt) {
+		return math.MaxInt
+	}
+	return int(limit)
+}
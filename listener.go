@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/time/rate"
 )
 
 var (
@@ -26,7 +26,7 @@ type Listener struct {
 
 	// limiter is the global limiter that is the upper bound of all net.Conn connections combined
 	// all connections combined cannot exceed limits enforced by this limiter.
-	limiter *rate.Limiter
+	limiter GlobalLimiter
 
 	// conns is a list of currently "active" Conn connections.
 	// conns are updated just after accepting a new Conn connection.
@@ -45,6 +45,55 @@ type Listener struct {
 
 	// gcInterval is the interval between "gc" cycles
 	gcInterval time.Duration
+
+	// quota is the optional Quota accepted connections are charged against
+	quota *Quota
+
+	// quotaKey maps accepted connections to the key they are charged against in quota
+	quotaKey KeyFunc
+
+	// creditCeiling is the bytes per second limit a connection may burst up to while it has credits,
+	// creditCeiling equal to 0 disables burst credits
+	creditCeiling int
+
+	// creditCapacity is the time worth of localLimit traffic a connection may save up as credits
+	creditCapacity time.Duration
+
+	// boost is the optional Boost of connections
+	boost *Boost
+
+	// kernelPacing is set when accepted connections hand pacing to the kernel, see Conn.EnableKernelPacing
+	kernelPacing bool
+
+	// prefetch is set when accepted connections prefetch quota in blocks, see PrefetchAllocator
+	prefetch bool
+
+	// schedule is the optional Schedule of limits applied by the listener
+	schedule *Schedule
+
+	// scheduleStop is closed to stop applying schedule
+	scheduleStop chan struct{}
+
+	// adaptiveStop is closed to stop adjusting the global limit to the measured link capacity
+	adaptiveStop chan struct{}
+
+	// clock tells the time to the listener, its global limiter and accepted connections
+	clock Clock
+
+	// emulation is the optional Emulation of network conditions of accepted connections
+	emulation *Emulation
+
+	// trace records reads and writes of accepted connections, it is nil if connections are not traced
+	trace *TraceWriter
+
+	// events publishes lifecycle events of the listener and its connections to subscribers
+	events *events
+
+	// logger logs accepts, closes and limit changes of the listener, and allocations of its connections
+	logger Logger
+
+	// accepted is the number of connections accepted so far, the id of the last one
+	accepted uint64
 }
 
 // Listen returns a *Listener that will be bound to addr with the specified limits.
@@ -71,14 +120,27 @@ func ListenCtx(ctx context.Context, network, addr string, limitTotal, limitConn
 	if err != nil {
 		return nil, err
 	}
-	limiter := rate.NewLimiter(rate.Limit(limitTotal), limitTotal)
+	return NewListener(ln, limitTotal, limitConn)
+}
+
+// NewListener returns a *Listener that throttles connections accepted from ln with the specified limits,
+// e.g. an in-memory listener of netlimittest or a listener inherited from a parent process.
+// limitGlobal is the maximum bytes per second allowed for all net.Conn connections combined
+// limitLocal is the maximum bytes per second allowed for a single net.Conn connection
+func NewListener(ln net.Listener, limitGlobal, limitLocal int) (*Listener, error) {
+	if limitGlobal < limitLocal {
+		return nil, ErrLimitGreaterThanTotal
+	}
 
 	limitedLn := &Listener{
 		Listener:    ln,
-		localLimit:  limitConn,
-		globalLimit: limitTotal,
-		limiter:     limiter,
+		localLimit:  limitLocal,
+		globalLimit: limitGlobal,
+		limiter:     NewGlobalLimiter(limitGlobal),
 		gcInterval:  time.Second,
+		clock:       realClock{},
+		events:      newEvents(realClock{}),
+		logger:      nopLogger{},
 	}
 
 	go limitedLn.gc()
@@ -89,61 +151,464 @@ func ListenCtx(ctx context.Context, network, addr string, limitTotal, limitConn
 func (l *Listener) Accept() (net.Conn, error) {
 	conn, err := l.Listener.Accept()
 	if err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			l.getLogger().Error("failed to accept connection", "err", err)
+		}
 		return nil, err
 	}
 
-	alloc := NewDefaultAllocator(l.limiter, l.localLimit)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.emulation != nil {
+		e := *l.emulation
+		if e.Clock == nil {
+			e.Clock = l.clock
+		}
+		if conn, err = NewEmulatedConn(conn, e); err != nil {
+			return nil, fmt.Errorf("failed to create new conn: %w", err)
+		}
+	}
+	base := NewDefaultAllocatorWithLimiter(l.limiter, l.localLimit)
+	base.SetClock(l.clock)
+	base.SetLogger(l.logger)
+	var alloc Allocator = base
+	var prefetch *PrefetchAllocator
+	switch {
+	case l.creditCeiling > 0:
+		capacity := int64(l.creditCapacity.Seconds() * float64(l.localLimit))
+		ceiling := NewDefaultAllocatorWithLimiter(l.limiter, l.creditCeiling)
+		ceiling.SetClock(l.clock)
+		ceiling.SetLogger(l.logger)
+		credit := NewCreditAllocator(ceiling, l.localLimit, l.creditCeiling, capacity)
+		credit.SetClock(l.clock)
+		alloc = credit
+	case l.boost != nil && l.boost.Rate > l.localLimit:
+		boosted := NewDefaultAllocatorWithLimiter(l.limiter, l.boost.Rate)
+		boosted.SetClock(l.clock)
+		boosted.SetLogger(l.logger)
+		boost, err := NewBoostAllocator(boosted, *l.boost, l.localLimit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new conn: %w", err)
+		}
+		boost.SetClock(l.clock)
+		alloc = boost
+	case l.prefetch:
+		prefetch = NewPrefetchAllocator(base)
+		alloc = prefetch
+	}
+	if l.quota != nil {
+		alloc = NewQuotaAllocator(alloc, l.quota, l.quotaKey(conn))
+	}
+
 	newConn, err := NewConn(conn, alloc)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new conn: %w", err)
 	}
+	newConn.SetClock(l.clock)
+	newConn.prefetch = prefetch
+	newConn.events = l.events
+	newConn.logger = l.logger
+	l.accepted++
+	newConn.id = l.accepted
+	newConn.limit = int64(l.localLimit)
+	if l.trace != nil {
+		newConn.SetTrace(l.trace)
+	}
+	if l.kernelPacing {
+		// pacing is best effort, the allocator keeps enforcing the limit when the kernel cannot
+		newConn.EnableKernelPacing(l.localLimit)
+	}
 
-	l.mu.Lock()
 	l.conns = append(l.conns, newConn)
-	l.mu.Unlock()
+	l.events.publish(Event{Type: EventAccepted, Conn: newConn})
+	l.logger.Debug("accepted connection", "remote", conn.RemoteAddr().String(), "local_limit", l.localLimit)
 
 	return newConn, nil
 }
 
 // SetGlobalLimit sets the limit of the bandwidth of all net.Conn connections currently active combined.
+// The global limit cannot be lower than the local limit.
 func (l *Listener) SetGlobalLimit(limit int) error {
 	l.mu.Lock()
-	l.limiter.SetLimit(rate.Limit(limit))
-	l.limiter.SetBurst(limit)
+	if limit < l.localLimit {
+		l.mu.Unlock()
+		return ErrLimitGreaterThanTotal
+	}
+	l.limiter.SetLimit(limit)
 	l.globalLimit = limit
+	l.events.publish(Event{Type: EventLimitChanged, Global: limit, Local: l.localLimit})
+	l.logger.Info("global limit changed", "limit", limit)
+	l.mu.Unlock()
+	return nil
+}
+
+// SetGlobalLimiter replaces the global limiter shared by connections accepted from now on, e.g. with a LeaseLimiter
+// whose budget is shared with other processes. Connections accepted earlier keep using the previous global limiter,
+// hence SetGlobalLimiter should be called before the first connection is accepted.
+func (l *Listener) SetGlobalLimiter(limiter GlobalLimiter) {
+	l.mu.Lock()
+	l.limiter = limiter
+	l.globalLimit = limiter.Limit()
+	l.mu.Unlock()
+}
+
+// SetQuota charges connections accepted from now on against q, key determines the key a connection is charged against.
+// If key is nil, connections are charged against the IP address of the remote peer.
+// Setting q to nil disables quota accounting for future connections.
+func (l *Listener) SetQuota(q *Quota, key KeyFunc) {
+	if key == nil {
+		key = KeyByIP
+	}
+
+	l.mu.Lock()
+	l.quota = q
+	l.quotaKey = key
+	l.mu.Unlock()
+}
+
+// SetBurstCredits makes connections accepted from now on earn credits while they transfer less than the local limit,
+// up to capacity worth of local limit traffic, and spend them at up to ceiling bytes per second.
+// Setting ceiling to 0 disables burst credits for future connections.
+func (l *Listener) SetBurstCredits(ceiling int, capacity time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ceiling > l.globalLimit {
+		return ErrLimitGreaterThanTotal
+	}
+	if ceiling > 0 && ceiling < l.localLimit {
+		return fmt.Errorf("burst ceiling cannot be lower than local limit")
+	}
+	if ceiling > 0 && l.boost != nil {
+		return fmt.Errorf("burst credits cannot be combined with boost")
+	}
+
+	l.creditCeiling = ceiling
+	l.creditCapacity = capacity
+	return nil
+}
+
+// SetBoost makes connections accepted from now on start at a boosted rate and then drop smoothly
+// to the local limit, see Boost. Setting b to nil disables boosting of future connections.
+func (l *Listener) SetBoost(b *Boost) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b == nil {
+		l.boost = nil
+		return nil
+	}
+	if err := b.validate(l.localLimit); err != nil {
+		return err
+	}
+	if b.Rate > l.globalLimit {
+		return ErrLimitGreaterThanTotal
+	}
+	if l.creditCeiling > 0 {
+		return fmt.Errorf("boost cannot be combined with burst credits")
+	}
+
+	boost := *b
+	l.boost = &boost
+	return nil
+}
+
+// SetKernelPacing makes connections accepted from now on hand pacing of their egress to the kernel,
+// see Conn.EnableKernelPacing. It returns ErrPacingUnsupported on platforms without SO_MAX_PACING_RATE.
+func (l *Listener) SetKernelPacing(enabled bool) error {
+	if enabled && !pacingSupported {
+		return ErrPacingUnsupported
+	}
+
+	l.mu.Lock()
+	l.kernelPacing = enabled
+	l.mu.Unlock()
+	return nil
+}
+
+// SetClock replaces the clock of the Listener, of its default global limiter and of connections accepted from now on,
+// e.g. with a fake clock in tests. SetClock must be called before the first connection is accepted.
+// Idle connections are still cleaned up on the real time.
+func (l *Listener) SetClock(c Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = c
+	if rl, ok := l.limiter.(*rateLimiter); ok {
+		rl.clock = c
+	}
+	l.events.setClock(c)
+}
+
+// Subscribe returns a channel of lifecycle events of the Listener and of all its connections, see Event.
+// Events are dropped when the buffer of the channel is full, so that slow subscribers never hold up connections.
+// cancel stops the subscription and closes the channel.
+func (l *Listener) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	return l.events.subscribe(buffer)
+}
+
+// SetSlowAllocThreshold makes connections publish EventSlowAlloc when an allocation waits longer than d
+// for quota. Setting d to 0 disables slow allocation events.
+func (l *Listener) SetSlowAllocThreshold(d time.Duration) {
+	atomic.StoreInt64(&l.events.slowAlloc, int64(d))
+}
+
+// SetTrace records reads and writes of connections accepted from now on to t, so that the traffic can be
+// replayed against other limits with Replay. Setting t to nil disables tracing for future connections.
+func (l *Listener) SetTrace(t *TraceWriter) {
+	l.mu.Lock()
+	l.trace = t
+	l.mu.Unlock()
+}
+
+// SetEmulation makes connections accepted from now on emulate network conditions of e, see Emulation
+// and EmulationPreset. Limits of the Listener still apply on top of the emulated rates.
+// Setting e to nil disables emulation for future connections.
+func (l *Listener) SetEmulation(e *Emulation) {
+	l.mu.Lock()
+	l.emulation = e
+	l.mu.Unlock()
+}
+
+// SetPrefetch makes connections accepted from now on lease quota in blocks and spend it without locking
+// the limiters on every call, see PrefetchAllocator. Quota held by connections idle for a gc cycle is released.
+// Prefetching does not apply to connections with burst credits or boost.
+func (l *Listener) SetPrefetch(enabled bool) {
+	l.mu.Lock()
+	l.prefetch = enabled
 	l.mu.Unlock()
+}
+
+// GlobalLimit returns the limit of the bandwidth of all net.Conn connections combined.
+func (l *Listener) GlobalLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.globalLimit
+}
+
+// LocalLimit returns the limit of the bandwidth of a single net.Conn connection.
+func (l *Listener) LocalLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.localLimit
+}
+
+// SetSchedule makes the Listener apply limits of s as periods of s begin, stopping any previous schedule.
+// Limits are applied with SetGlobalLimit and SetLocalLimit, so they affect active and future connections.
+// Setting s to nil stops applying the schedule, limits in effect at that time are kept.
+func (l *Listener) SetSchedule(s *Schedule) error {
+	if s != nil && len(s.Periods) == 0 {
+		return ErrEmptySchedule
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.scheduleStop != nil {
+		close(l.scheduleStop)
+		l.scheduleStop = nil
+	}
+	l.schedule = s
+	if s == nil {
+		return nil
+	}
+
+	stop := make(chan struct{})
+	l.scheduleStop = stop
+	go l.runSchedule(s, stop)
 	return nil
 }
 
+// Schedule returns the schedule applied by the Listener, nil if there is none.
+func (l *Listener) Schedule() *Schedule {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.schedule
+}
+
+func (l *Listener) runSchedule(s *Schedule, stop chan struct{}) {
+	clock := l.getClock()
+	for {
+		now := clock.Now()
+		global, local := s.LimitsAt(now)
+		if err := l.applyLimits(global, local); err != nil {
+			l.getLogger().Error("failed to apply scheduled limits", "global", global, "local", local, "err", err)
+			l.events.publish(Event{Type: EventLimitChangeFailed, Global: global, Local: local, Err: err})
+		}
+
+		next := s.next(now)
+		if next.IsZero() {
+			// none of the periods ever begins again
+			<-stop
+			return
+		}
+
+		timer := clock.NewTimer(next.Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// applyLimits sets both limits in the order that keeps the local limit below the global one.
+func (l *Listener) applyLimits(global, local int) error {
+	if global <= 0 || local <= 0 {
+		return nil
+	}
+	if local > global {
+		return ErrLimitGreaterThanTotal
+	}
+
+	if global >= l.GlobalLimit() {
+		if err := l.SetGlobalLimit(global); err != nil {
+			return err
+		}
+		return l.SetLocalLimit(local)
+	}
+	if err := l.SetLocalLimit(local); err != nil {
+		return err
+	}
+	return l.SetGlobalLimit(global)
+}
+
+// SetAdaptive makes the Listener adjust its global limit to the measured capacity of the link, see Adaptive.
+// The global limit is adjusted with SetGlobalLimit within the bounds of cfg and never below the local limit,
+// cfg.Min cannot be lower than the local limit. Setting cfg to nil stops adjusting, the limit in effect at that
+// time is kept.
+func (l *Listener) SetAdaptive(cfg *Adaptive) error {
+	var controller *AdaptiveController
+	if cfg != nil {
+		if cfg.Min < l.LocalLimit() {
+			return ErrLimitGreaterThanTotal
+		}
+		var err error
+		controller, err = NewAdaptiveController(*cfg, l.GlobalLimit())
+		if err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.adaptiveStop != nil {
+		close(l.adaptiveStop)
+		l.adaptiveStop = nil
+	}
+	if controller == nil {
+		return nil
+	}
+
+	stop := make(chan struct{})
+	l.adaptiveStop = stop
+	go l.runAdaptive(controller, stop)
+	return nil
+}
+
+func (l *Listener) runAdaptive(c *AdaptiveController, stop chan struct{}) {
+	clock := l.getClock()
+	timer := clock.NewTimer(c.cfg.Interval)
+	defer timer.Stop()
+	l.SetGlobalLimit(c.Limit())
+
+	previous := make(map[*Conn]ConnStats)
+	last := clock.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C():
+			timer.Reset(c.cfg.Interval)
+		}
+
+		l.mu.Lock()
+		conns := make([]*Conn, len(l.conns))
+		copy(conns, l.conns)
+		l.mu.Unlock()
+
+		var written, writes int64
+		var writeTime time.Duration
+		current := make(map[*Conn]ConnStats, len(conns))
+		for _, conn := range conns {
+			stats := conn.Stats()
+			current[conn] = stats
+			prev := previous[conn]
+			written += stats.BytesWritten - prev.BytesWritten
+			writes += stats.Writes - prev.Writes
+			writeTime += stats.WriteTime - prev.WriteTime
+		}
+		previous = current
+
+		now := clock.Now()
+		elapsed := now.Sub(last).Seconds()
+		last = now
+		var latency time.Duration
+		if writes > 0 {
+			latency = writeTime / time.Duration(writes)
+		}
+
+		limit := c.Update(int(float64(written)/elapsed), latency)
+		// the local limit may have been raised above the minimum of the controller since it was attached
+		if local := l.LocalLimit(); limit < local {
+			limit = local
+		}
+		if limit != l.GlobalLimit() {
+			l.SetGlobalLimit(limit)
+		}
+	}
+}
+
+// Conns returns the active connections of the listener, ordered by their ids.
+func (l *Listener) Conns() []*Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conns := make([]*Conn, 0, len(l.conns))
+	for _, conn := range l.conns {
+		if atomic.LoadInt32(&conn.closed) == 0 {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
 // SetLocalLimit sets the limit of the bandwidth of all net.Conn active and future connections accepted by the listener.
+// Connections with a pinned limit keep it, see Conn.Pin.
 func (l *Listener) SetLocalLimit(newLocalLimit int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	if newLocalLimit > l.globalLimit {
 		return ErrLimitGreaterThanTotal
 	}
 	eg := errgroup.Group{}
 	eg.SetLimit(len(l.conns))
-
-	l.mu.Lock()
-	defer l.mu.Unlock()
 	for _, alloc := range l.conns {
 		alloc := alloc
 		eg.TryGo(func() error {
-			return alloc.SetLimit(newLocalLimit)
+			return alloc.followLimit(newLocalLimit)
 		})
 	}
 
 	err := eg.Wait()
 	if err != nil {
+		l.logger.Error("failed to set local limit", "limit", newLocalLimit, "err", err)
 		return err
 	}
 
 	l.localLimit = newLocalLimit
+	l.events.publish(Event{Type: EventLimitChanged, Global: l.globalLimit, Local: newLocalLimit})
+	l.logger.Info("local limit changed", "limit", newLocalLimit)
 	return nil
 }
 
 func (l *Listener) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.scheduleStop != nil {
+		close(l.scheduleStop)
+		l.scheduleStop = nil
+	}
+	if l.adaptiveStop != nil {
+		close(l.adaptiveStop)
+		l.adaptiveStop = nil
+	}
 	for _, conn := range l.conns {
 		if err := conn.Close(); err != nil {
 			return fmt.Errorf("failed to close listener: %w", err)
@@ -161,13 +626,37 @@ func (l *Listener) gc() {
 			case <-conn.done:
 				l.conns = remove(l.conns, conn)
 			default:
+				if conn.prefetch != nil {
+					conn.prefetch.ReleaseIdle()
+				}
 			}
 		}
 		l.mu.Unlock()
+		// gc cycles run on the real time, so that a fake clock does not count the gc timer as a waiter
 		time.Sleep(l.gcInterval)
 	}
 }
 
+// SetLogger makes the Listener log accepts, closes and limit changes, and allocation retries and failures
+// of connections accepted from now on, to lg. Setting lg to nil discards logs.
+func (l *Listener) SetLogger(lg Logger) {
+	l.mu.Lock()
+	l.logger = loggerOrNop(lg)
+	l.mu.Unlock()
+}
+
+func (l *Listener) getLogger() Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.logger
+}
+
+func (l *Listener) getClock() Clock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clock
+}
+
 func remove(slice []*Conn, elem *Conn) []*Conn {
 	for i, v := range slice {
 		if v == elem {
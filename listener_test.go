@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
 )
 
 func TestSetLocalLimit(t *testing.T) {
@@ -99,3 +100,71 @@ func TestSetGlobalLimit(t *testing.T) {
 		}
 	}
 }
+
+func TestSetGlobalLimitBelowLocal(t *testing.T) {
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 100, 50)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	if err := ln.SetGlobalLimit(40); err != netlimit.ErrLimitGreaterThanTotal {
+		t.Errorf("SetGlobalLimit() error = %v, wantErr %v", err, netlimit.ErrLimitGreaterThanTotal)
+	}
+	if got := ln.GlobalLimit(); got != 100 {
+		t.Errorf("GlobalLimit() = %v, want %v", got, 100)
+	}
+}
+
+func TestListener_Conns(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, client := acceptPipe(t, inner, ln)
+		defer client.Close()
+		conns = append(conns, conn)
+	}
+	conns[1].Close()
+
+	got := ln.Conns()
+	if len(got) != 2 || got[0].ID() != 1 || got[1].ID() != 3 {
+		t.Fatalf("Conns() = %v, want connections 1 and 3", got)
+	}
+	if limit := got[0].Limit(); limit != 1000 {
+		t.Errorf("Limit() = %d, want the local limit 1000", limit)
+	}
+}
+
+func TestListener_SetLocalLimitPinned(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	accepted, client := acceptPipe(t, inner, ln)
+	defer client.Close()
+	conn := accepted.(*netlimit.Conn)
+
+	for i := 0; i < 1000; i++ {
+		conn.Unpin()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ln.SetLocalLimit(2000 + i)
+		}()
+		if err := conn.Pin(300); err != nil {
+			t.Fatalf("Pin() error = %v", err)
+		}
+		<-done
+		// a limit change racing with Pin is applied before it or not at all
+		if got := conn.Limit(); got != 300 {
+			t.Fatalf("Limit() = %d after Pin raced with SetLocalLimit, want the pinned 300", got)
+		}
+	}
+}
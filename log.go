@@ -0,0 +1,26 @@
+package netlimit
+
+// Logger is a leveled structured logger, messages are followed by alternating keys and values.
+// *slog.Logger implements Logger, other structured loggers can be adapted with a few lines.
+type Logger interface {
+	Debug(msg string, kv ...any)
+	Info(msg string, kv ...any)
+	Warn(msg string, kv ...any)
+	Error(msg string, kv ...any)
+}
+
+// nopLogger discards everything, it is the Logger of Listeners, Dialers and allocators until SetLogger is called.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// loggerOrNop returns lg, or a Logger that discards everything if lg is nil.
+func loggerOrNop(lg Logger) Logger {
+	if lg == nil {
+		return nopLogger{}
+	}
+	return lg
+}
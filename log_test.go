@@ -0,0 +1,181 @@
+package netlimit_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+	"golang.org/x/time/rate"
+)
+
+type entry struct {
+	level string
+	msg   string
+	kv    []any
+}
+
+// recorder is a netlimit.Logger that records entries.
+type recorder struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+func (r *recorder) log(level, msg string, kv []any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry{level, msg, kv})
+}
+
+func (r *recorder) Debug(msg string, kv ...any) { r.log("debug", msg, kv) }
+func (r *recorder) Info(msg string, kv ...any)  { r.log("info", msg, kv) }
+func (r *recorder) Warn(msg string, kv ...any)  { r.log("warn", msg, kv) }
+func (r *recorder) Error(msg string, kv ...any) { r.log("error", msg, kv) }
+
+// find returns the first entry with msg, ok is false if there is none.
+func (r *recorder) find(msg string) (entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
+// value returns the value of key in e.
+func (e entry) value(key string) any {
+	for i := 0; i+1 < len(e.kv); i += 2 {
+		if e.kv[i] == key {
+			return e.kv[i+1]
+		}
+	}
+	return nil
+}
+
+func TestListener_SetLogger(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 10000, 1000)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+	logs := &recorder{}
+	ln.SetLogger(logs)
+
+	conn, client := acceptPipe(t, inner, ln)
+	defer client.Close()
+	if err := ln.SetGlobalLimit(5000); err != nil {
+		t.Fatalf("SetGlobalLimit() error = %v", err)
+	}
+	if err := ln.SetLocalLimit(500); err != nil {
+		t.Fatalf("SetLocalLimit() error = %v", err)
+	}
+	conn.Close()
+
+	tests := []struct {
+		msg       string
+		wantLevel string
+		key       string
+		wantValue any
+	}{
+		{"accepted connection", "debug", "local_limit", 1000},
+		{"global limit changed", "info", "limit", 5000},
+		{"local limit changed", "info", "limit", 500},
+		{"closed connection", "debug", "bytes_written", int64(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			e, ok := logs.find(tt.msg)
+			if !ok {
+				t.Fatalf("no %q entry", tt.msg)
+			}
+			if e.level != tt.wantLevel {
+				t.Errorf("%q logged at %s, want %s", tt.msg, e.level, tt.wantLevel)
+			}
+			if got := e.value(tt.key); got != tt.wantValue {
+				t.Errorf("%q has %s = %v, want %v", tt.msg, tt.key, got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestDefaultAllocator_SetLogger(t *testing.T) {
+	tests := []struct {
+		name      string
+		interrupt func(a *netlimit.DefaultAllocator, cancel context.CancelFunc)
+		wantMsg   string
+	}{
+		{
+			name: "retry after limit change",
+			interrupt: func(a *netlimit.DefaultAllocator, cancel context.CancelFunc) {
+				a.SetLimit(2000)
+			},
+			wantMsg: "allocation retried after limit change",
+		},
+		{
+			name: "cancellation",
+			interrupt: func(a *netlimit.DefaultAllocator, cancel context.CancelFunc) {
+				cancel()
+			},
+			wantMsg: "allocation cancelled",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &recorder{}
+			a := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Limit(10000), 10000), 1000)
+			a.SetLogger(logs)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := a.Alloc(ctx, 1000); err != nil {
+				t.Fatalf("Alloc() error = %v", err)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// the burst is spent, the allocation waits for a second
+				a.Alloc(ctx, 1000)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			tt.interrupt(a, cancel)
+			<-done
+
+			if e, ok := logs.find(tt.wantMsg); !ok || e.level != "debug" || e.value("requested") != 1000 {
+				t.Errorf("entries = %+v, want a debug %q entry", logs.entries, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestDialer_SetLogger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	d, err := netlimit.NewDialer(10000, 1000)
+	if err != nil {
+		t.Fatalf("NewDialer() error = %v", err)
+	}
+	logs := &recorder{}
+	d.SetLogger(logs)
+	if _, err := d.Dial("tcp", addr); err == nil {
+		t.Fatalf("Dial() error = nil, want an error for a closed port")
+	}
+	e, ok := logs.find("failed to dial")
+	if !ok || e.level != "warn" || e.value("addr") != addr {
+		t.Errorf("entries = %+v, want a warn entry of the failed dial", logs.entries)
+	}
+	if err, _ := e.value("err").(error); err == nil {
+		t.Errorf("failed dial entry has no error: %s", fmt.Sprint(e.kv...))
+	}
+}
@@ -0,0 +1,256 @@
+package netlimittest
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+const (
+	// conformanceLimit is the bytes per second limit allocators under test are made with
+	conformanceLimit = 10000
+
+	// conformanceTolerance is the accepted error of the measured rate, generous enough for loaded CI machines
+	conformanceTolerance = 0.2
+
+	// conformanceTimeout bounds every blocking call of the suite
+	conformanceTimeout = 5 * time.Second
+)
+
+// MakeAllocator returns a new Allocator limited to limit bytes per second with a burst of limit bytes.
+// The Allocator has to accept SetLimit with any limit between 1 and limit. stop is called once the Allocator
+// is no longer used and releases all its resources, it may be nil.
+type MakeAllocator func(limit int) (a netlimit.Allocator, stop func(), err error)
+
+// TestAllocator tests that Allocators made by mk conform to the contract of netlimit.Allocator:
+// allocations are granted at the limit rate, grants never exceed the request nor the burst, SetLimit
+// is safe while allocations are in flight, cancelled contexts abort waiting allocations, concurrent use
+// is safe and allocations do not leak goroutines.
+// Run it with the race detector enabled to check race safety.
+func TestAllocator(t *testing.T, mk MakeAllocator) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, a netlimit.Allocator)
+	}{
+		{"PartialGrants", testPartialGrants},
+		{"Rate", testRate},
+		{"ContextCancellation", testContextCancellation},
+		{"SetLimitInflight", testSetLimitInflight},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, stop := makeAllocator(t, mk)
+			defer stop()
+			tt.test(t, a)
+		})
+	}
+
+	t.Run("GoroutineLeaks", func(t *testing.T) {
+		testGoroutineLeaks(t, mk)
+	})
+}
+
+func makeAllocator(t *testing.T, mk MakeAllocator) (netlimit.Allocator, func()) {
+	t.Helper()
+	a, stop, err := mk(conformanceLimit)
+	if err != nil {
+		t.Fatalf("MakeAllocator() error = %v", err)
+	}
+	if stop == nil {
+		stop = func() {}
+	}
+	return a, stop
+}
+
+// drain spends the burst of a, so that further allocations have to wait.
+func drain(t *testing.T, a netlimit.Allocator) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), conformanceTimeout)
+	defer cancel()
+	for spent := 0; spent < conformanceLimit; {
+		n, err := a.Alloc(ctx, conformanceLimit-spent)
+		if err != nil {
+			t.Fatalf("Alloc() error = %v", err)
+		}
+		spent += n
+	}
+}
+
+func testPartialGrants(t *testing.T, a netlimit.Allocator) {
+	ctx, cancel := context.WithTimeout(context.Background(), conformanceTimeout)
+	defer cancel()
+
+	for _, requested := range []int{1, conformanceLimit / 10, 10 * conformanceLimit} {
+		n, err := a.Alloc(ctx, requested)
+		if err != nil {
+			t.Fatalf("Alloc(%d) error = %v", requested, err)
+		}
+		if n <= 0 || n > requested {
+			t.Errorf("Alloc(%d) = %d, want between 1 and %d", requested, n, requested)
+		}
+		if n > conformanceLimit {
+			t.Errorf("Alloc(%d) = %d, want at most the burst of %d", requested, n, conformanceLimit)
+		}
+	}
+}
+
+func testRate(t *testing.T, a netlimit.Allocator) {
+	drain(t, a)
+	ctx, cancel := context.WithTimeout(context.Background(), conformanceTimeout)
+	defer cancel()
+
+	want := int64(conformanceLimit / 2)
+	tr, err := Measure(nil, func() (int64, error) {
+		allocated := int64(0)
+		for allocated < want {
+			chunk := int64(conformanceLimit / 10)
+			if left := want - allocated; left < chunk {
+				chunk = left
+			}
+			n, err := a.Alloc(ctx, int(chunk))
+			if err != nil {
+				return allocated, err
+			}
+			allocated += int64(n)
+		}
+		return allocated, nil
+	})
+	if err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	AssertTransfer(t, tr, want, conformanceLimit, conformanceTolerance)
+}
+
+func testContextCancellation(t *testing.T, a netlimit.Allocator) {
+	drain(t, a)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// the allocation has to wait for about a second
+	n, err := a.Alloc(ctx, conformanceLimit)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Alloc() = %d, %v, want %v", n, err, context.DeadlineExceeded)
+	}
+	if n != 0 {
+		t.Errorf("Alloc() = %d, want 0 when cancelled", n)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Alloc() returned %v after its context was cancelled, want at once", elapsed)
+	}
+}
+
+func testSetLimitInflight(t *testing.T, a netlimit.Allocator) {
+	drain(t, a)
+	ctx, cancel := context.WithTimeout(context.Background(), conformanceTimeout)
+	defer cancel()
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := a.Alloc(ctx, conformanceLimit)
+		done <- result{n, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := a.SetLimit(conformanceLimit / 2); err != nil {
+		t.Fatalf("SetLimit() error = %v", err)
+	}
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("Alloc() error = %v, want the in-flight allocation to complete", r.err)
+		}
+		if r.n <= 0 || r.n > conformanceLimit {
+			t.Errorf("Alloc() = %d, want between 1 and %d", r.n, conformanceLimit)
+		}
+	case <-time.After(conformanceTimeout):
+		t.Fatalf("Alloc() did not return after SetLimit")
+	}
+}
+
+func testConcurrency(t *testing.T, a netlimit.Allocator) {
+	const workers = 8
+	duration := 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		allocated int64
+	)
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n, err := a.Alloc(ctx, conformanceLimit/100)
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(&allocated, int64(n))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ctx.Err() == nil; i++ {
+			limit := conformanceLimit
+			if i%2 == 0 {
+				limit = conformanceLimit / 2
+			}
+			if err := a.SetLimit(limit); err != nil {
+				t.Errorf("SetLimit() error = %v", err)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	// the burst and the full limit are the upper bound, whatever the order of SetLimit calls
+	elapsed := time.Since(start).Seconds()
+	if max := conformanceLimit * (1 + elapsed) * (1 + conformanceTolerance); float64(allocated) > max {
+		t.Errorf("allocated %d bytes in %.2fs, want at most %.0f", allocated, elapsed, max)
+	}
+	if allocated == 0 {
+		t.Errorf("allocated nothing, want allocations to make progress")
+	}
+}
+
+func testGoroutineLeaks(t *testing.T, mk MakeAllocator) {
+	before := runtime.NumGoroutine()
+
+	a, stop := makeAllocator(t, mk)
+	ctx, cancel := context.WithTimeout(context.Background(), conformanceTimeout)
+	for i := 0; i < 10; i++ {
+		if _, err := a.Alloc(ctx, conformanceLimit/10); err != nil {
+			t.Fatalf("Alloc() error = %v", err)
+		}
+	}
+	cancel()
+	// allocations with a cancelled context must not leave anything behind either
+	a.Alloc(ctx, conformanceLimit)
+	stop()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines leaked", after-before)
+	}
+}
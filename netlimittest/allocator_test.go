@@ -0,0 +1,53 @@
+package netlimittest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+)
+
+func TestAllocator(t *testing.T) {
+	tests := []struct {
+		name string
+		mk   netlimittest.MakeAllocator
+	}{
+		{
+			name: "DefaultAllocator",
+			mk: func(limit int) (netlimit.Allocator, func(), error) {
+				return netlimit.NewDefaultAllocatorWithLimiter(netlimit.NewGlobalLimiter(limit), limit), nil, nil
+			},
+		},
+		{
+			name: "PrefetchAllocator",
+			mk: func(limit int) (netlimit.Allocator, func(), error) {
+				a := netlimit.NewDefaultAllocatorWithLimiter(netlimit.NewGlobalLimiter(limit), limit)
+				p := netlimit.NewPrefetchAllocator(a)
+				return p, p.Release, nil
+			},
+		},
+		{
+			name: "QuotaAllocator",
+			mk: func(limit int) (netlimit.Allocator, func(), error) {
+				a := netlimit.NewDefaultAllocatorWithLimiter(netlimit.NewGlobalLimiter(limit), limit)
+				q := netlimit.NewQuota(netlimit.Daily, 1<<40)
+				return netlimit.NewQuotaAllocator(a, q, "conformance"), nil, nil
+			},
+		},
+		{
+			name: "ShardedLimiter",
+			mk: func(limit int) (netlimit.Allocator, func(), error) {
+				l := netlimit.NewShardedLimiter(limit, 1)
+				l.SetRebalanceInterval(time.Hour)
+				a := netlimit.NewDefaultAllocatorWithLimiter(l, limit)
+				return a, func() { l.Close() }, nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			netlimittest.TestAllocator(t, tt.mk)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package netlimittest
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+// Transfer is a measured transfer of data.
+type Transfer struct {
+	// Bytes is the number of bytes transferred
+	Bytes int64
+
+	// Elapsed is the time the transfer took
+	Elapsed time.Duration
+}
+
+// Rate returns the bytes per second rate of the transfer.
+func (tr Transfer) Rate() float64 {
+	if tr.Elapsed <= 0 {
+		return math.Inf(1)
+	}
+	return float64(tr.Bytes) / tr.Elapsed.Seconds()
+}
+
+// Measure runs f, which returns the number of bytes it transferred, and measures the time it took on clock.
+// The real clock is used if clock is nil.
+func Measure(clock netlimit.Clock, f func() (int64, error)) (Transfer, error) {
+	if clock == nil {
+		clock = netlimit.RealClock()
+	}
+	start := clock.Now()
+	n, err := f()
+	return Transfer{Bytes: n, Elapsed: clock.Now().Sub(start)}, err
+}
+
+// AssertTransfer reports an error on t unless tr transferred n bytes at rate bytes per second ± tolerance,
+// tolerance is a fraction of rate, e.g. 0.05 for 5%. It returns whether the assertion holds.
+func AssertTransfer(t testing.TB, tr Transfer, n int64, rate int, tolerance float64) bool {
+	t.Helper()
+	ok := true
+	if tr.Bytes != n {
+		t.Errorf("transferred %d bytes, want %d", tr.Bytes, n)
+		ok = false
+	}
+	margin := float64(rate) * tolerance
+	if got := tr.Rate(); got < float64(rate)-margin || got > float64(rate)+margin {
+		t.Errorf("transferred at %.2f B/s in %v, want %d B/s ± %.0f%%", got, tr.Elapsed, rate, tolerance*100)
+		ok = false
+	}
+	return ok
+}
@@ -0,0 +1,81 @@
+package netlimittest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit/netlimittest"
+)
+
+// recorder records errors reported by assertions under test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertTransfer(t *testing.T) {
+	tests := []struct {
+		name      string
+		tr        netlimittest.Transfer
+		n         int64
+		rate      int
+		tolerance float64
+		want      bool
+	}{
+		{
+			name:      "exact",
+			tr:        netlimittest.Transfer{Bytes: 1000, Elapsed: time.Second},
+			n:         1000,
+			rate:      1000,
+			tolerance: 0.05,
+			want:      true,
+		},
+		{
+			name:      "within tolerance",
+			tr:        netlimittest.Transfer{Bytes: 1000, Elapsed: 1040 * time.Millisecond},
+			n:         1000,
+			rate:      1000,
+			tolerance: 0.05,
+			want:      true,
+		},
+		{
+			name:      "too fast",
+			tr:        netlimittest.Transfer{Bytes: 1000, Elapsed: 900 * time.Millisecond},
+			n:         1000,
+			rate:      1000,
+			tolerance: 0.05,
+		},
+		{
+			name:      "too few bytes",
+			tr:        netlimittest.Transfer{Bytes: 500, Elapsed: 500 * time.Millisecond},
+			n:         1000,
+			rate:      1000,
+			tolerance: 0.05,
+		},
+		{
+			name:      "instant",
+			tr:        netlimittest.Transfer{Bytes: 1000},
+			n:         1000,
+			rate:      1000,
+			tolerance: 0.05,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{TB: t}
+			if got := netlimittest.AssertTransfer(r, tt.tr, tt.n, tt.rate, tt.tolerance); got != tt.want {
+				t.Errorf("AssertTransfer() = %v, want %v, errors %q", got, tt.want, r.errors)
+			}
+			if tt.want != (len(r.errors) == 0) {
+				t.Errorf("AssertTransfer() reported %q", r.errors)
+			}
+		})
+	}
+}
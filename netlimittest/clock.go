@@ -0,0 +1,17 @@
+// Package netlimittest provides utilities for testing code throttled by netlimit.
+package netlimittest
+
+import (
+	"time"
+
+	"github.com/charconstpointer/netlimit/internal/fakeclock"
+)
+
+// Clock is a fake netlimit.Clock, its time moves only when Advance is called, so that rate behaviour can be
+// tested deterministically in milliseconds of wall time.
+type Clock = fakeclock.Clock
+
+// NewClock returns a fake clock set to start.
+func NewClock(start time.Time) *Clock {
+	return fakeclock.New(start)
+}
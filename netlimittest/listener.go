@@ -0,0 +1,87 @@
+package netlimittest
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listener is an in-memory net.Listener, connections are made with Dial or DialContext of the same Listener
+// and each of them is a shaped Pipe. Wrap it with netlimit.NewListener to test code throttled by a netlimit.Listener.
+type Listener struct {
+	shape Shape
+
+	// conns passes server ends of dialed pipes to Accept
+	conns chan net.Conn
+
+	// closed is closed once the listener is closed
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Listen returns an in-memory Listener whose connections are shaped according to s.
+func Listen(s Shape) *Listener {
+	return &Listener{
+		shape:  s,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection dialed to the listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener, connections accepted earlier are not closed.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connects to the listener, network and addr are ignored, so that Dial can replace net.Dial.
+func (l *Listener) Dial(network, addr string) (net.Conn, error) {
+	return l.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the listener and blocks until the connection is accepted or ctx is done.
+// network and addr are ignored, so that DialContext can replace net.Dialer.DialContext.
+func (l *Listener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	server, client := Pipe(l.shape)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+	case <-ctx.Done():
+	}
+	server.Close()
+	client.Close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, net.ErrClosed
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "pipe"
+}
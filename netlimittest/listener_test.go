@@ -0,0 +1,66 @@
+package netlimittest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+)
+
+func TestListener(t *testing.T) {
+	inner := netlimittest.Listen(netlimittest.Shape{})
+	ln, err := netlimit.NewListener(inner, 1000, 100)
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Accept() error = %v", err)
+			return
+		}
+		conn.Write([]byte("netlimit"))
+		conn.Close()
+	}()
+
+	conn, err := inner.Dial("tcp", "ignored")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "netlimit" {
+		t.Errorf("ReadAll() = %q, %v, want %q", got, err, "netlimit")
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	ln := netlimittest.Listen(netlimittest.Shape{})
+	ln.Close()
+
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() error = %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := ln.Dial("tcp", ""); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Dial() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestListener_DialContext(t *testing.T) {
+	ln := netlimittest.Listen(netlimittest.Shape{})
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// nothing accepts the connection
+	if _, err := ln.DialContext(ctx, "tcp", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
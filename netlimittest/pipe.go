@@ -0,0 +1,40 @@
+package netlimittest
+
+import (
+	"net"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+// Shape describes the link simulated by a shaped pipe.
+type Shape struct {
+	// Rate is the bytes per second limit of each end of the pipe, 0 means unlimited
+	Rate int
+
+	// Latency is the one-way delay of data written to either end of the pipe
+	Latency time.Duration
+
+	// Clock tells the time to both ends of the pipe, the real clock is used if Clock is nil
+	Clock netlimit.Clock
+}
+
+func (s Shape) clock() netlimit.Clock {
+	if s.Clock == nil {
+		return netlimit.RealClock()
+	}
+	return s.Clock
+}
+
+// Pipe returns both ends of an in-memory connection shaped according to s. Data written to either end is
+// throttled to s.Rate bytes per second by a *netlimit.EmulatedConn, reads are not throttled, so that every direction
+// is limited once, like a link. Writes return as soon as data is queued and data reaches the other end after s.Latency.
+func Pipe(s Shape) (net.Conn, net.Conn) {
+	c1, c2 := net.Pipe()
+	return shape(c1, s), shape(c2, s)
+}
+
+func shape(conn net.Conn, s Shape) net.Conn {
+	emulated, _ := netlimit.NewEmulatedConn(conn, netlimit.Emulation{UpRate: s.Rate, Latency: s.Latency, Clock: s.clock()})
+	return emulated
+}
@@ -0,0 +1,77 @@
+package netlimittest_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit/netlimittest"
+)
+
+func TestPipe(t *testing.T) {
+	tests := []struct {
+		name        string
+		shape       netlimittest.Shape
+		size        int
+		wantElapsed time.Duration
+	}{
+		{
+			name:  "unshaped",
+			shape: netlimittest.Shape{},
+			size:  1000,
+		},
+		{
+			name:        "rate",
+			shape:       netlimittest.Shape{Rate: 1000},
+			size:        3000,
+			wantElapsed: 2 * time.Second,
+		},
+		{
+			name:        "latency",
+			shape:       netlimittest.Shape{Latency: 50 * time.Millisecond},
+			size:        1000,
+			wantElapsed: 50 * time.Millisecond,
+		},
+		{
+			name:        "rate and latency",
+			shape:       netlimittest.Shape{Rate: 1000, Latency: 50 * time.Millisecond},
+			size:        3000,
+			wantElapsed: 2050 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+			tt.shape.Clock = clock
+			c1, c2 := netlimittest.Pipe(tt.shape)
+			defer c2.Close()
+			done := make(chan struct{})
+			defer close(done)
+			go clock.AdvanceUntil(done, 10*time.Millisecond)
+
+			payload := bytes.Repeat([]byte{'x'}, tt.size)
+			go func() {
+				c1.Write(payload)
+				c1.Close()
+			}()
+
+			var got []byte
+			tr, err := netlimittest.Measure(clock, func() (int64, error) {
+				var err error
+				got, err = io.ReadAll(c2)
+				return int64(len(got)), err
+			})
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("received %d bytes, want the %d bytes of payload", len(got), len(payload))
+			}
+			// the clock is advanced in steps of 10ms
+			if tr.Elapsed < tt.wantElapsed || tr.Elapsed > tt.wantElapsed+20*time.Millisecond {
+				t.Errorf("transfer took %v of virtual time, want %v", tr.Elapsed, tt.wantElapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package netlimit
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+var (
+	// ErrPacingUnsupported is returned when kernel pacing is not available for a connection,
+	// either because of the platform or because the underlying connection is not a socket.
+	ErrPacingUnsupported = errors.New("kernel pacing is not supported")
+)
+
+// EnableKernelPacing hands pacing of the egress of the connection to the kernel by setting SO_MAX_PACING_RATE
+// on the underlying socket to limit bytes per second. Once enabled, the pacing rate follows the limit set with
+// SetLimit, including limits set with Listener.SetLocalLimit. The Allocator keeps enforcing its limits on top of
+// kernel pacing, so it remains an upper-level budget and a fallback where pacing is unavailable.
+func (c *Conn) EnableKernelPacing(limit int) error {
+	if err := c.setPacingRate(limit); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.pacing = true
+	c.mu.Unlock()
+	return nil
+}
+
+// DisableKernelPacing removes the pacing rate from the underlying socket.
+func (c *Conn) DisableKernelPacing() error {
+	c.mu.Lock()
+	pacing := c.pacing
+	c.pacing = false
+	c.mu.Unlock()
+	if !pacing {
+		return nil
+	}
+	return c.setPacingRate(unlimitedPacingRate)
+}
+
+func (c *Conn) setPacingRate(limit int) error {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return ErrPacingUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to access socket: %w", err)
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = setPacingRate(fd, limit)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to access socket: %w", err)
+	}
+	if serr != nil {
+		return fmt.Errorf("failed to set pacing rate: %w", serr)
+	}
+	return nil
+}
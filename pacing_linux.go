@@ -0,0 +1,27 @@
+//go:build linux && !sparc64
+
+package netlimit
+
+import (
+	"math"
+	"syscall"
+)
+
+const (
+	// pacingSupported reports whether SO_MAX_PACING_RATE is available on this platform
+	pacingSupported = true
+
+	// soMaxPacingRate is SO_MAX_PACING_RATE, it is not exported by package syscall
+	soMaxPacingRate = 0x2f
+
+	// unlimitedPacingRate is the pacing rate meaning that the socket is not paced,
+	// it is truncated to 32 bits by SetsockoptInt, which gives ~0U expected by the kernel
+	unlimitedPacingRate = -1
+)
+
+func setPacingRate(fd uintptr, limit int) error {
+	if limit < 0 || int64(limit) >= math.MaxUint32 {
+		limit = unlimitedPacingRate
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soMaxPacingRate, limit)
+}
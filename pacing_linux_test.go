@@ -0,0 +1,80 @@
+//go:build linux && !sparc64
+
+package netlimit_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/charconstpointer/netlimit"
+	"golang.org/x/time/rate"
+)
+
+func pacingRate(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() error = %v", err)
+	}
+	var got int
+	var serr error
+	raw.Control(func(fd uintptr) {
+		got, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, 0x2f)
+	})
+	if serr != nil {
+		t.Fatalf("GetsockoptInt() error = %v", serr)
+	}
+	return got
+}
+
+func TestConn_EnableKernelPacing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer tcp.Close()
+
+	a := netlimit.NewDefaultAllocator(rate.NewLimiter(1000, 1000), 100)
+	conn, _ := netlimit.NewConn(tcp, a)
+	if err := conn.EnableKernelPacing(100); err != nil {
+		t.Fatalf("EnableKernelPacing() error = %v", err)
+	}
+	if got := pacingRate(t, tcp); got != 100 {
+		t.Errorf("pacing rate = %v, want %v", got, 100)
+	}
+	if err := conn.SetLimit(200); err != nil {
+		t.Fatalf("SetLimit() error = %v", err)
+	}
+	if got := pacingRate(t, tcp); got != 200 {
+		t.Errorf("pacing rate = %v, want %v", got, 200)
+	}
+	if err := conn.DisableKernelPacing(); err != nil {
+		t.Fatalf("DisableKernelPacing() error = %v", err)
+	}
+	if got := uint32(pacingRate(t, tcp)); got != ^uint32(0) {
+		t.Errorf("pacing rate = %v, want unlimited", got)
+	}
+}
+
+func TestConn_EnableKernelPacingUnsupported(t *testing.T) {
+	recv, sender := net.Pipe()
+	defer recv.Close()
+	defer sender.Close()
+	conn, _ := netlimit.NewConn(sender, netlimit.NewDefaultAllocator(rate.NewLimiter(1000, 1000), 100))
+	if err := conn.EnableKernelPacing(100); err != netlimit.ErrPacingUnsupported {
+		t.Errorf("EnableKernelPacing() error = %v, wantErr %v", err, netlimit.ErrPacingUnsupported)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux || sparc64
+
+package netlimit
+
+const (
+	// pacingSupported reports whether SO_MAX_PACING_RATE is available on this platform
+	pacingSupported = false
+
+	unlimitedPacingRate = -1
+)
+
+func setPacingRate(fd uintptr, limit int) error {
+	return ErrPacingUnsupported
+}
@@ -0,0 +1,135 @@
+package netlimit
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+var _ Allocator = (*PrefetchAllocator)(nil)
+
+const (
+	// prefetchTargetCalls is the number of allocations a prefetched block should serve
+	prefetchTargetCalls = 32
+
+	// prefetchMaxBlockFraction bounds a block to the given fraction of the local limit, 100ms worth of traffic,
+	// so that a connection never holds on to much more quota than it is about to use
+	prefetchMaxBlockFraction = 10
+)
+
+// PrefetchAllocator is an Allocator that leases blocks of quota from a DefaultAllocator and spends them locally
+// with atomics, so that small reads and writes do not lock the local and the global limiter on every call.
+// The block size adapts to the observed call pattern, it grows while blocks are used up within a few calls
+// and shrinks once a block serves far more calls than needed to amortize leasing it.
+// Unused quota goes back to the limiters on Release, ReleaseIdle and SetLimit.
+// The counters come first, so that they are 64-bit aligned on 32-bit platforms.
+type PrefetchAllocator struct {
+	// available is the number of prefetched bytes left
+	available int64
+
+	// block is the size of the next block to lease, 0 until the first lease
+	block int64
+
+	// calls is the number of allocations served so far
+	calls int64
+
+	// leasedAt is the value of calls at the time the last block was leased
+	leasedAt int64
+
+	// idleAt is the value of calls observed by the last ReleaseIdle
+	idleAt int64
+
+	alloc *DefaultAllocator
+}
+
+// NewPrefetchAllocator returns an Allocator that prefetches quota in blocks from a.
+func NewPrefetchAllocator(a *DefaultAllocator) *PrefetchAllocator {
+	return &PrefetchAllocator{alloc: a, idleAt: -1}
+}
+
+// Alloc spends prefetched quota and leases a new block only when there is none left.
+func (a *PrefetchAllocator) Alloc(ctx context.Context, requestedQuota int) (int, error) {
+	if granted := a.take(requestedQuota); granted > 0 {
+		return granted, nil
+	}
+
+	// concurrent callers may lease blocks at the same time, leftovers of both are pooled
+	leased, err := a.alloc.Alloc(ctx, a.nextBlock(requestedQuota))
+	if err != nil {
+		return 0, err
+	}
+
+	granted := requestedQuota
+	if granted > leased {
+		granted = leased
+	}
+	atomic.AddInt64(&a.available, int64(leased-granted))
+	atomic.StoreInt64(&a.leasedAt, atomic.AddInt64(&a.calls, 1))
+	return granted, nil
+}
+
+// take spends up to n prefetched bytes and returns the number of bytes spent.
+func (a *PrefetchAllocator) take(n int) int {
+	for {
+		available := atomic.LoadInt64(&a.available)
+		if available <= 0 {
+			return 0
+		}
+		taken := int64(n)
+		if taken > available {
+			taken = available
+		}
+		if atomic.CompareAndSwapInt64(&a.available, available, available-taken) {
+			atomic.AddInt64(&a.calls, 1)
+			return int(taken)
+		}
+	}
+}
+
+// nextBlock adapts the block size to the number of calls served by the previous block and returns it.
+func (a *PrefetchAllocator) nextBlock(n int) int {
+	served := atomic.LoadInt64(&a.calls) - atomic.LoadInt64(&a.leasedAt)
+	block := atomic.LoadInt64(&a.block)
+	switch {
+	case block == 0:
+		block = int64(n) * prefetchTargetCalls
+	case served < prefetchTargetCalls/2:
+		block *= 2
+	case served > prefetchTargetCalls*2:
+		block /= 2
+	}
+
+	if max := int64(a.alloc.local.Limit()) / prefetchMaxBlockFraction; block > max {
+		block = max
+	}
+	if block < int64(n) {
+		block = int64(n)
+	}
+	atomic.StoreInt64(&a.block, block)
+	return int(block)
+}
+
+// Release gives all prefetched quota back to the limiters, it should be called once the connection is closed.
+func (a *PrefetchAllocator) Release() {
+	if n := atomic.SwapInt64(&a.available, 0); n > 0 {
+		a.alloc.release(int(n))
+	}
+}
+
+// ReleaseIdle releases prefetched quota if there were no allocations since the previous call to ReleaseIdle.
+// Calling ReleaseIdle periodically gives back quota held by idle connections.
+func (a *PrefetchAllocator) ReleaseIdle() {
+	calls := atomic.LoadInt64(&a.calls)
+	if atomic.SwapInt64(&a.idleAt, calls) == calls {
+		a.Release()
+	}
+}
+
+// SetLimit sets the limit of the wrapped DefaultAllocator and releases quota prefetched under the previous limit.
+func (a *PrefetchAllocator) SetLimit(limit int) error {
+	if err := a.alloc.SetLimit(limit); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&a.block, 0)
+	a.Release()
+	return nil
+}
@@ -0,0 +1,169 @@
+package netlimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+	"golang.org/x/time/rate"
+)
+
+func TestPrefetchAllocator_Alloc(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		quota     int
+		total     int
+		wantAbove time.Duration
+	}{
+		{
+			name:  "small allocations within burst",
+			limit: 1000,
+			quota: 10,
+			total: 900,
+		},
+		{
+			name:      "small allocations over burst are throttled",
+			limit:     1000,
+			quota:     10,
+			total:     2000,
+			wantAbove: 900 * time.Millisecond,
+		},
+		{
+			name:      "allocations larger than a block",
+			limit:     1000,
+			quota:     300,
+			total:     2000,
+			wantAbove: 900 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global := rate.NewLimiter(rate.Limit(tt.limit), tt.limit)
+			a := netlimit.NewPrefetchAllocator(netlimit.NewDefaultAllocator(global, tt.limit))
+
+			start := time.Now()
+			for allocated := 0; allocated < tt.total; {
+				granted, err := a.Alloc(context.Background(), tt.quota)
+				if err != nil {
+					t.Fatalf("Alloc() error = %v", err)
+				}
+				if granted <= 0 || granted > tt.quota {
+					t.Fatalf("Alloc() granted = %d, want 1..%d", granted, tt.quota)
+				}
+				allocated += granted
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantAbove {
+				t.Errorf("Alloc() took %v, want at least %v", elapsed, tt.wantAbove)
+			}
+		})
+	}
+}
+
+// allows reports whether g allows n bytes right away, without keeping them reserved.
+func allows(g netlimit.GlobalLimiter, n int) bool {
+	now := time.Now()
+	r := g.ReserveN(now, n)
+	defer r.Cancel()
+	return r.DelayFrom(now) == 0
+}
+
+func TestPrefetchAllocator_Release(t *testing.T) {
+	global := netlimit.NewGlobalLimiter(1000)
+	a := netlimit.NewPrefetchAllocator(netlimit.NewDefaultAllocatorWithLimiter(global, 1000))
+
+	if _, err := a.Alloc(context.Background(), 10); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	// the first block is bounded to 100ms of traffic
+	if allows(global, 950) {
+		t.Fatalf("global limiter allows 950 bytes, want a block of quota prefetched")
+	}
+
+	a.ReleaseIdle()
+	if allows(global, 950) {
+		t.Fatalf("ReleaseIdle() released quota of a connection that was not idle")
+	}
+	a.ReleaseIdle()
+	if !allows(global, 950) {
+		t.Errorf("global limiter does not allow 950 bytes, want leftovers of the block released")
+	}
+}
+
+func TestPrefetchAllocator_SetLimit(t *testing.T) {
+	global := netlimit.NewGlobalLimiter(1000)
+	a := netlimit.NewPrefetchAllocator(netlimit.NewDefaultAllocatorWithLimiter(global, 1000))
+	if _, err := a.Alloc(context.Background(), 10); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+
+	if err := a.SetLimit(2000); err == nil {
+		t.Errorf("SetLimit() want error for a limit higher than the global limit")
+	}
+	if err := a.SetLimit(500); err != nil {
+		t.Fatalf("SetLimit() error = %v", err)
+	}
+	if !allows(global, 950) {
+		t.Errorf("global limiter does not allow 950 bytes, want prefetched quota released on SetLimit")
+	}
+}
+
+func BenchmarkPrefetchAllocator_AllocParallel(b *testing.B) {
+	global := rate.NewLimiter(rate.Inf, 1<<30)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// every goroutine models a separate connection sharing the global limiter
+		a := netlimit.NewPrefetchAllocator(netlimit.NewDefaultAllocator(global, 1<<30))
+		for pb.Next() {
+			if _, err := a.Alloc(ctx, 1024); err != nil {
+				b.Errorf("Alloc() error = %v", err)
+				return
+			}
+		}
+	})
+}
+
+func TestGlobalLimiter_ReleaseThenCancel(t *testing.T) {
+	clock := netlimittest.NewClock(time.Unix(0, 0))
+	l := netlimit.NewGlobalLimiterWithClock(1000, clock)
+	now := clock.Now()
+
+	l.ReserveN(now, 1000)
+	first := l.ReserveN(now, 500)
+	// second waits behind first, cancelling first must not give its bytes back
+	l.ReserveN(now, 500)
+	l.(netlimit.Releaser).Release(200)
+	first.Cancel()
+
+	// 200 released bytes are spent right away, the other 200 wait for both reservations of 500 bytes
+	r := l.ReserveN(now, 400)
+	if got, want := r.DelayFrom(now), 1200*time.Millisecond; got < want-10*time.Millisecond || got > want {
+		t.Errorf("DelayFrom() = %v, want %v", got, want)
+	}
+	r.Cancel()
+	if got := l.ReserveN(now, 200).DelayFrom(now); got != 0 {
+		t.Errorf("DelayFrom() = %v, want released bytes given back on Cancel", got)
+	}
+}
+
+func TestGlobalLimiter_ReleaseCappedAtBurst(t *testing.T) {
+	lim := rate.NewLimiter(1000, 1000)
+	// connections wrap the same limiter, released bytes must not add up on top of its full bucket
+	first, second := netlimit.WrapLimiter(lim), netlimit.WrapLimiter(lim)
+	first.(netlimit.Releaser).Release(900)
+	second.(netlimit.Releaser).Release(900)
+
+	now := time.Now()
+	if got := first.ReserveN(now, 1000).DelayFrom(now); got != 0 {
+		t.Fatalf("DelayFrom() = %v, want a full bucket allowing its burst", got)
+	}
+	for _, l := range []netlimit.GlobalLimiter{first, second} {
+		if got := l.ReserveN(now, 100).DelayFrom(now); got < 90*time.Millisecond {
+			t.Errorf("DelayFrom() = %v, want bytes beyond the burst to wait for the bucket", got)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package netlimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var _ Allocator = (*QuotaAllocator)(nil)
+
+var (
+	// ErrQuotaExceeded is returned when the key of a connection used up its quota for the current window.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Period is the calendar window over which a Quota accounts transferred bytes.
+type Period int
+
+const (
+	Hourly Period = iota + 1
+	Daily
+	Monthly
+)
+
+// Start returns the beginning of the window t belongs to, in t's location.
+func (p Period) Start(t time.Time) time.Time {
+	switch p {
+	case Hourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case Daily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case Monthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return t
+	}
+}
+
+// Next returns the beginning of the window that follows the one t belongs to.
+func (p Period) Next(t time.Time) time.Time {
+	start := p.Start(t)
+	switch p {
+	case Hourly:
+		return start.Add(time.Hour)
+	case Daily:
+		return start.AddDate(0, 0, 1)
+	case Monthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return t
+	}
+}
+
+// KeyFunc maps a connection to the key its traffic is charged against, e.g. an IP address, an API key or a tenant.
+type KeyFunc func(conn net.Conn) string
+
+// KeyByIP charges connections against the IP address of the remote peer.
+func KeyByIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// defaultFlushInterval is how often Quota persists usage to its Store
+const defaultFlushInterval = time.Second
+
+// Quota tracks bytes transferred per key over calendar windows such as hours, days or months.
+// Quota works alongside the per second limits of Allocator, it does not replace them.
+type Quota struct {
+	mu sync.Mutex
+
+	// flushMu serializes flushes, so that an older state never overwrites a newer one in the store
+	flushMu sync.Mutex
+
+	// period is the calendar window the usage is accounted over
+	period Period
+
+	// limit is the number of bytes a single key is allowed to transfer within a window
+	limit int64
+
+	// rollover is the maximum number of unused bytes carried over into the following window
+	// rollover equal to 0 means that unused bytes are lost once the window ends
+	rollover int64
+
+	// throttle is the bytes per second limit enforced on keys that used up their quota
+	// throttle equal to 0 means that such keys are rejected with ErrQuotaExceeded
+	throttle int
+
+	// location is the time zone the windows are aligned to
+	location *time.Location
+
+	// usage is the per key consumption in the current window
+	usage map[string]*usage
+
+	// swept is the window usage of expired windows was last evicted in
+	swept time.Time
+
+	// store is the optional Store usage is persisted to
+	store Store
+
+	// dirty are the keys whose usage changed since the last flush
+	dirty map[string]struct{}
+
+	// flushInterval is the minimum time between flushes started by allocations
+	flushInterval time.Duration
+
+	// flushed is the time of the last flush
+	flushed time.Time
+
+	// flushing is set while a flush started by an allocation runs
+	flushing bool
+
+	// clock tells the time windows and flushes are timed by and waits for the throttle
+	clock Clock
+}
+
+type usage struct {
+	// used is the number of bytes charged in the current window
+	used int64
+
+	// carried is the number of bytes carried over from the previous window
+	carried int64
+
+	// window is the beginning of the window used is accounted for
+	window time.Time
+
+	// limit overrides the default limit of the quota for this key, 0 means there is no override
+	limit int64
+
+	// throttle is the limiter shared by all connections of an exhausted key
+	throttle *rate.Limiter
+}
+
+// NewQuota returns a Quota that allows every key to transfer limit bytes per period.
+func NewQuota(period Period, limit int64) *Quota {
+	return &Quota{
+		period:        period,
+		limit:         limit,
+		location:      time.Local,
+		usage:         make(map[string]*usage),
+		dirty:         make(map[string]struct{}),
+		flushInterval: defaultFlushInterval,
+		clock:         realClock{},
+	}
+}
+
+// SetThrottle sets the bytes per second limit enforced on keys that used up their quota.
+// Setting limit to 0 makes exhausted keys fail with ErrQuotaExceeded instead.
+func (q *Quota) SetThrottle(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.throttle = limit
+	for _, u := range q.usage {
+		u.throttle = nil
+	}
+}
+
+// SetRollover sets the maximum number of unused bytes carried over into the following window.
+// Bytes are carried over only from the window directly preceding the current one.
+func (q *Quota) SetRollover(max int64) {
+	q.mu.Lock()
+	q.rollover = max
+	q.mu.Unlock()
+}
+
+// SetLocation sets the time zone windows are aligned to, time.Local is used by default.
+func (q *Quota) SetLocation(loc *time.Location) {
+	q.mu.Lock()
+	q.location = loc
+	q.mu.Unlock()
+}
+
+// SetClock replaces the clock of the Quota, e.g. with a fake clock in tests.
+// SetClock must be called before the first allocation.
+func (q *Quota) SetClock(c Clock) {
+	q.mu.Lock()
+	q.clock = c
+	q.mu.Unlock()
+}
+
+// SetFlushInterval sets how often usage charged by allocations is persisted to the Store, 1s by default.
+// Allocations never wait for the Store, usage charged since the last flush is lost if the process crashes.
+func (q *Quota) SetFlushInterval(d time.Duration) {
+	q.mu.Lock()
+	q.flushInterval = d
+	q.mu.Unlock()
+}
+
+// SetStore restores usage persisted in s and persists all further usage to s.
+func (q *Quota) SetStore(s Store) error {
+	records, err := s.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load quota usage: %w", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, r := range records {
+		q.usage[r.Key] = &usage{
+			used:    r.Used,
+			carried: r.Carried,
+			window:  r.Window.In(q.location),
+			limit:   r.Limit,
+		}
+	}
+	q.store = s
+	q.flushed = q.clock.Now()
+	// restored usage of expired windows is evicted by the next sweep
+	q.swept = time.Time{}
+	return nil
+}
+
+// SetLimit overrides the number of bytes key is allowed to transfer within a window.
+// Setting limit to 0 removes the override.
+func (q *Quota) SetLimit(key string, limit int64) error {
+	q.mu.Lock()
+	u := q.current(key)
+	u.limit = limit
+	q.dirty[key] = struct{}{}
+	q.mu.Unlock()
+	return q.Flush()
+}
+
+// Used returns the number of bytes key transferred in the current window.
+func (q *Quota) Used(key string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.current(key).used
+}
+
+// Remaining returns the number of bytes key is still allowed to transfer in the current window.
+func (q *Quota) Remaining(key string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.remaining(q.current(key))
+}
+
+// Reset discards usage of key, the key gets its full allowance back.
+func (q *Quota) Reset(key string) error {
+	q.mu.Lock()
+	u := q.current(key)
+	u.used = 0
+	u.carried = 0
+	u.throttle = nil
+	q.dirty[key] = struct{}{}
+	q.mu.Unlock()
+	return q.Flush()
+}
+
+func (q *Quota) remaining(u *usage) int64 {
+	limit := q.limit
+	if u.limit > 0 {
+		limit = u.limit
+	}
+
+	remaining := limit + u.carried - u.used
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// current returns usage of key rolled over to the window that is in effect right now.
+// current must be called with q.mu held.
+func (q *Quota) current(key string) *usage {
+	window := q.period.Start(q.clock.Now().In(q.location))
+	if !q.swept.Equal(window) {
+		q.sweep(window)
+	}
+	u, ok := q.usage[key]
+	if !ok {
+		u = &usage{window: window}
+		q.usage[key] = u
+		return u
+	}
+
+	if u.window.Equal(window) {
+		return u
+	}
+
+	// carried bytes are what the ended window left unused, they have to be taken before its usage is cleared
+	u.carried = q.carried(u, window)
+	u.used = 0
+	u.window = window
+	return u
+}
+
+// carried returns the number of unused bytes of u carried over into window.
+// carried must be called with q.mu held.
+func (q *Quota) carried(u *usage, window time.Time) int64 {
+	if q.rollover == 0 || !q.period.Next(u.window).Equal(window) {
+		return 0
+	}
+	carried := q.remaining(u)
+	if carried > q.rollover {
+		carried = q.rollover
+	}
+	return carried
+}
+
+// sweep evicts usage of keys that did not transfer anything in window and carry nothing over into it,
+// so that keys seen once do not stay in memory forever. Keys with a limit override are kept.
+// sweep must be called with q.mu held.
+func (q *Quota) sweep(window time.Time) {
+	q.swept = window
+	for key, u := range q.usage {
+		if u.window.Before(window) && u.limit == 0 && q.carried(u, window) == 0 {
+			delete(q.usage, key)
+		}
+	}
+}
+
+// reserve charges key up to requested bytes it is allowed to transfer and returns the number of bytes charged,
+// the window they are charged in and the throttling limiter that has to be obeyed when the key is exhausted.
+// Bytes that are not transferred have to be given back with refund.
+func (q *Quota) reserve(key string, requested int) (int, time.Time, *rate.Limiter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(key)
+	remaining := q.remaining(u)
+	var throttle *rate.Limiter
+	switch {
+	case remaining > 0:
+		if int64(requested) > remaining {
+			requested = int(remaining)
+		}
+	case q.throttle == 0:
+		return 0, u.window, nil, ErrQuotaExceeded
+	default:
+		if u.throttle == nil {
+			u.throttle = rate.NewLimiter(rate.Limit(q.throttle), q.throttle)
+		}
+		if requested > q.throttle {
+			requested = q.throttle
+		}
+		throttle = u.throttle
+	}
+	u.used += int64(requested)
+	q.changed(key)
+	return requested, u.window, throttle, nil
+}
+
+// refund gives back n bytes charged against key by reserve in window, unless the window has ended since.
+func (q *Quota) refund(key string, window time.Time, n int) {
+	if n == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(key)
+	if !u.window.Equal(window) {
+		return
+	}
+	u.used -= int64(n)
+	q.changed(key)
+}
+
+// changed marks usage of key to be persisted and starts a flush once flushInterval elapsed since the last one.
+// changed must be called with q.mu held.
+func (q *Quota) changed(key string) {
+	if q.store == nil {
+		return
+	}
+	q.dirty[key] = struct{}{}
+	if q.flushing || q.clock.Now().Sub(q.flushed) < q.flushInterval {
+		return
+	}
+	q.flushing = true
+	go func() {
+		// errors are not returned to allocations, usage that failed to persist is retried by the next flush
+		q.Flush()
+		q.mu.Lock()
+		q.flushing = false
+		q.mu.Unlock()
+	}()
+}
+
+// Flush persists usage changed since the last flush to the Store, if q has one.
+// Flush is called periodically by allocations, it should also be called before the Store is closed.
+func (q *Quota) Flush() error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	store := q.store
+	records := make([]Record, 0, len(q.dirty))
+	for key := range q.dirty {
+		// usage of evicted keys has nothing left worth persisting
+		if u, ok := q.usage[key]; ok {
+			records = append(records, Record{
+				Key:     key,
+				Used:    u.used,
+				Carried: u.carried,
+				Window:  u.window,
+				Limit:   u.limit,
+			})
+		}
+	}
+	q.dirty = make(map[string]struct{})
+	q.flushed = q.clock.Now()
+	q.mu.Unlock()
+	if store == nil {
+		return nil
+	}
+
+	var failed []string
+	var err error
+	for _, r := range records {
+		if saveErr := store.Save(r); saveErr != nil {
+			failed = append(failed, r.Key)
+			if err == nil {
+				err = saveErr
+			}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	q.mu.Lock()
+	for _, key := range failed {
+		q.dirty[key] = struct{}{}
+	}
+	q.mu.Unlock()
+	return fmt.Errorf("failed to persist quota usage: %w", err)
+}
+
+// QuotaAllocator is an Allocator that charges granted quota against the key of a connection.
+// Once the key used up its Quota, QuotaAllocator either throttles or rejects further allocations.
+type QuotaAllocator struct {
+	Allocator
+
+	// quota is the Quota allocations are charged against
+	quota *Quota
+
+	// key is the key allocations are charged against
+	key string
+
+	mu sync.Mutex
+
+	// window is the window the last allocation was charged in
+	window time.Time
+}
+
+// NewQuotaAllocator returns an Allocator that charges allocations granted by a against key in q.
+func NewQuotaAllocator(a Allocator, q *Quota, key string) *QuotaAllocator {
+	return &QuotaAllocator{
+		Allocator: a,
+		quota:     q,
+		key:       key,
+	}
+}
+
+// Alloc blocks until it is allowed to allocate requested quota and charges the granted quota against the key.
+// The quota is charged up front, so that concurrent connections of a key cannot overshoot it,
+// and the part that is not granted is given back afterwards. A Conn gives back the part it did not transfer.
+func (a *QuotaAllocator) Alloc(ctx context.Context, requestedQuota int) (int, error) {
+	allowed, window, throttle, err := a.quota.reserve(a.key, requestedQuota)
+	if err != nil {
+		return 0, err
+	}
+
+	granted, err := a.Allocator.Alloc(ctx, allowed)
+	if err != nil {
+		a.quota.refund(a.key, window, allowed)
+		return 0, err
+	}
+
+	// the throttle is waited for after the grant, so that it is charged only the bytes that were granted
+	if throttle != nil && granted > 0 {
+		if err := waitN(ctx, throttle, a.quota.clock, granted); err != nil {
+			a.quota.refund(a.key, window, allowed)
+			return 0, err
+		}
+	}
+
+	a.quota.refund(a.key, window, allowed-granted)
+	a.mu.Lock()
+	a.window = window
+	a.mu.Unlock()
+	return granted, nil
+}
+
+// unused gives back n bytes that were granted by the last allocation but not transferred,
+// e.g. by a read that returned fewer bytes than its buffer holds.
+func (a *QuotaAllocator) unused(n int) {
+	a.mu.Lock()
+	window := a.window
+	a.mu.Unlock()
+	a.quota.refund(a.key, window, n)
+}
@@ -0,0 +1,302 @@
+package netlimit_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+	"golang.org/x/time/rate"
+)
+
+func TestPeriod_Start(t *testing.T) {
+	now := time.Date(2022, time.June, 16, 13, 37, 42, 0, time.UTC)
+	tests := []struct {
+		name      string
+		period    netlimit.Period
+		wantStart time.Time
+		wantNext  time.Time
+	}{
+		{
+			name:      "hourly",
+			period:    netlimit.Hourly,
+			wantStart: time.Date(2022, time.June, 16, 13, 0, 0, 0, time.UTC),
+			wantNext:  time.Date(2022, time.June, 16, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "daily",
+			period:    netlimit.Daily,
+			wantStart: time.Date(2022, time.June, 16, 0, 0, 0, 0, time.UTC),
+			wantNext:  time.Date(2022, time.June, 17, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "monthly",
+			period:    netlimit.Monthly,
+			wantStart: time.Date(2022, time.June, 1, 0, 0, 0, 0, time.UTC),
+			wantNext:  time.Date(2022, time.July, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.period.Start(now); !got.Equal(tt.wantStart) {
+				t.Errorf("Start() = %v, want %v", got, tt.wantStart)
+			}
+			if got := tt.period.Next(now); !got.Equal(tt.wantNext) {
+				t.Errorf("Next() = %v, want %v", got, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestQuotaAllocator_Alloc(t *testing.T) {
+	type fields struct {
+		limit    int64
+		throttle int
+	}
+	type args struct {
+		requests []int
+	}
+	tests := []struct {
+		name    string
+		fields  fields
+		args    args
+		want    []int
+		wantErr error
+	}{
+		{
+			name: "alloc within quota",
+			fields: fields{
+				limit: 20,
+			},
+			args: args{
+				requests: []int{5, 10},
+			},
+			want: []int{5, 10},
+		},
+		{
+			name: "alloc is truncated to remaining quota",
+			fields: fields{
+				limit: 8,
+			},
+			args: args{
+				requests: []int{5, 5},
+			},
+			want: []int{5, 3},
+		},
+		{
+			name: "alloc rejected once quota is used up",
+			fields: fields{
+				limit: 5,
+			},
+			args: args{
+				requests: []int{5, 5},
+			},
+			want:    []int{5},
+			wantErr: netlimit.ErrQuotaExceeded,
+		},
+		{
+			name: "alloc throttled once quota is used up",
+			fields: fields{
+				limit:    5,
+				throttle: 2,
+			},
+			args: args{
+				requests: []int{5, 5},
+			},
+			want: []int{5, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := netlimit.NewQuota(netlimit.Daily, tt.fields.limit)
+			q.SetThrottle(tt.fields.throttle)
+			a := netlimit.NewQuotaAllocator(netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 100), 100), q, "key")
+			for i, requested := range tt.args.requests {
+				got, err := a.Alloc(context.Background(), requested)
+				if i < len(tt.want) {
+					if err != nil {
+						t.Fatalf("Alloc() error = %v", err)
+					}
+					if got != tt.want[i] {
+						t.Errorf("Alloc() got = %v, want %v", got, tt.want[i])
+					}
+					continue
+				}
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Alloc() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestQuota_Reset(t *testing.T) {
+	q := netlimit.NewQuota(netlimit.Monthly, 10)
+	a := netlimit.NewQuotaAllocator(netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 10), 10), q, "key")
+	if _, err := a.Alloc(context.Background(), 10); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	if got := q.Remaining("key"); got != 0 {
+		t.Errorf("Remaining() = %v, want %v", got, 0)
+	}
+
+	if err := q.Reset("key"); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	if got := q.Remaining("key"); got != 10 {
+		t.Errorf("Remaining() = %v, want %v", got, 10)
+	}
+}
+
+func TestListener_SetQuota(t *testing.T) {
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 100, 100)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	q := netlimit.NewQuota(netlimit.Daily, 10)
+	ln.SetQuota(q, nil)
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Errorf("Dial() error = %v", err)
+			return
+		}
+		conn.Write(make([]byte, 20))
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	b := make([]byte, 20)
+	if _, err := c.Read(b); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if _, err := c.Read(b); !errors.Is(err, netlimit.ErrQuotaExceeded) {
+		t.Errorf("Read() error = %v, wantErr %v", err, netlimit.ErrQuotaExceeded)
+	}
+	if got := q.Used("127.0.0.1"); got != 10 {
+		t.Errorf("Used() = %v, want %v", got, 10)
+	}
+}
+
+func TestConn_QuotaChargedTransferred(t *testing.T) {
+	q := netlimit.NewQuota(netlimit.Daily, 1<<20)
+	a := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Limit(1<<20), 1<<20), 1<<20)
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	conn, _ := netlimit.NewConn(raw, netlimit.NewQuotaAllocator(a, q, "key"))
+	defer conn.Close()
+	go peer.Write(make([]byte, 10))
+
+	// the read is granted the whole buffer but transfers only what the peer wrote
+	n, err := conn.Read(make([]byte, 32*1024))
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if got := q.Used("key"); got != int64(n) {
+		t.Errorf("Used() = %v after reading %d bytes, want %v", got, n, n)
+	}
+}
+
+func TestQuotaAllocator_AllocConcurrent(t *testing.T) {
+	q := netlimit.NewQuota(netlimit.Daily, 1000)
+	var wg sync.WaitGroup
+	var granted int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := netlimit.NewQuotaAllocator(netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 100), 100), q, "key")
+			n, err := a.Alloc(context.Background(), 100)
+			if err != nil && !errors.Is(err, netlimit.ErrQuotaExceeded) {
+				t.Errorf("Alloc() error = %v", err)
+			}
+			atomic.AddInt64(&granted, int64(n))
+		}()
+	}
+	wg.Wait()
+	if granted != 1000 {
+		t.Errorf("connections of a key were granted %v bytes in total, want %v", granted, 1000)
+	}
+	if got := q.Used("key"); got != 1000 {
+		t.Errorf("Used() = %v, want %v", got, 1000)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Load() ([]netlimit.Record, error) { return nil, nil }
+func (failingStore) Save(netlimit.Record) error       { return errors.New("disk full") }
+func (failingStore) Close() error                     { return nil }
+
+func TestQuota_FlushFailure(t *testing.T) {
+	q := netlimit.NewQuota(netlimit.Daily, 100)
+	if err := q.SetStore(failingStore{}); err != nil {
+		t.Fatalf("SetStore() error = %v", err)
+	}
+	q.SetFlushInterval(0)
+	a := netlimit.NewQuotaAllocator(netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 100), 100), q, "key")
+	if got, err := a.Alloc(context.Background(), 10); got != 10 || err != nil {
+		t.Fatalf("Alloc() = %v, %v, want %v granted although the store fails", got, err, 10)
+	}
+	if err := q.Flush(); err == nil {
+		t.Errorf("Flush() error = nil, want the error of the store")
+	}
+	if got := q.Used("key"); got != 10 {
+		t.Errorf("Used() = %v, want %v", got, 10)
+	}
+}
+
+func TestQuota_SetClock(t *testing.T) {
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC))
+	q := netlimit.NewQuota(netlimit.Hourly, 100)
+	q.SetClock(clock)
+	q.SetLocation(time.UTC)
+	q.SetRollover(50)
+	q.SetThrottle(10)
+	next := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1000), 1000)
+	next.SetClock(clock)
+	a := netlimit.NewQuotaAllocator(next, q, "key")
+	done := make(chan struct{})
+	defer close(done)
+	go clock.AdvanceUntil(done, 100*time.Millisecond)
+
+	if _, err := a.Alloc(context.Background(), 80); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	clock.Advance(time.Hour)
+	// the window ended on the clock, the 20 unused bytes are carried over
+	if got := q.Remaining("key"); got != 120 {
+		t.Errorf("Remaining() = %v, want %v", got, 120)
+	}
+
+	// the throttle of an exhausted key waits on the clock too
+	if _, err := a.Alloc(context.Background(), 120); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	tr, err := netlimittest.Measure(clock, func() (int64, error) {
+		var n int64
+		for n < 20 {
+			granted, err := a.Alloc(context.Background(), 10)
+			if err != nil {
+				return n, err
+			}
+			n += int64(granted)
+		}
+		return n, nil
+	})
+	if err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	if tr.Elapsed != time.Second {
+		t.Errorf("throttled Alloc() took %v of virtual time, want 1s", tr.Elapsed)
+	}
+}
@@ -0,0 +1,193 @@
+package netlimit
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/charconstpointer/netlimit/internal/stats"
+	"golang.org/x/time/rate"
+)
+
+// ReplayReport is the outcome of replaying a trace against a pair of limits.
+type ReplayReport struct {
+	// Conns is the number of connections of the trace
+	Conns int
+
+	// Events is the number of reads and writes of the trace
+	Events int
+
+	// Bytes is the number of bytes transferred
+	Bytes int64
+
+	// Duration is the virtual time from the first event of the trace until the last transfer completed
+	Duration time.Duration
+
+	// Throughput is the bytes per second rate of the replayed traffic
+	Throughput float64
+
+	// MeanWait is the mean time from the recorded time of an event until its quota is granted,
+	// including waiting for previous events of the same connection
+	MeanWait time.Duration
+
+	// P50Wait, P95Wait and P99Wait are percentiles of the wait of events
+	P50Wait time.Duration
+	P95Wait time.Duration
+	P99Wait time.Duration
+
+	// MaxWait is the longest wait of an event
+	MaxWait time.Duration
+
+	// Truncated is set if the trace ends within an event, only the events before it are replayed
+	Truncated bool
+}
+
+// Replay re-runs a trace recorded by TraceWriter against limitGlobal and limitLocal on virtual time and reports
+// the resulting latency and throughput, so that limits can be evaluated against real traffic offline.
+// Events are issued at their recorded time, but not before the previous event of the same connection completed,
+// and every event is charged the bytes it transferred with the reservations a DefaultAllocator would make.
+// A trace cut short, e.g. by a crash of the process recording it, is replayed up to its last complete event.
+func Replay(r *TraceReader, limitGlobal, limitLocal int) (ReplayReport, error) {
+	if limitGlobal <= 0 || limitLocal <= 0 {
+		return ReplayReport{}, fmt.Errorf("failed to replay trace: limits must be positive")
+	}
+
+	conns := make(map[uint64]*replayConn)
+	var order []*replayConn
+	events := 0
+	truncated := false
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			truncated = true
+			break
+		}
+		if err != nil {
+			return ReplayReport{}, fmt.Errorf("failed to replay trace: %w", err)
+		}
+		c, ok := conns[ev.Conn]
+		if !ok {
+			c = &replayConn{local: rate.NewLimiter(rate.Limit(limitLocal), limitLocal)}
+			conns[ev.Conn] = c
+			order = append(order, c)
+		}
+		c.events = append(c.events, ev)
+		events++
+	}
+	if events == 0 {
+		return ReplayReport{Truncated: truncated}, nil
+	}
+
+	global := rate.NewLimiter(rate.Limit(limitGlobal), limitGlobal)
+	queue := make(replayQueue, 0, len(order))
+	start := order[0].events[0].Time
+	for _, c := range order {
+		// events of a connection are recorded in the order they were issued, up to concurrent reads and writes
+		sort.SliceStable(c.events, func(i, j int) bool {
+			return c.events[i].Time.Before(c.events[j].Time)
+		})
+		c.next = c.events[0].Time
+		if c.next.Before(start) {
+			start = c.next
+		}
+		queue = append(queue, c)
+	}
+	heap.Init(&queue)
+
+	report := ReplayReport{Conns: len(order), Events: events, Truncated: truncated}
+	waits := make([]time.Duration, 0, events)
+	end := start
+	for queue.Len() > 0 {
+		c := queue[0]
+		ev := c.events[0]
+		done := c.transfer(global, c.next, ev.Size)
+		waits = append(waits, done.Sub(ev.Time))
+		report.Bytes += int64(ev.Size)
+		if done.After(end) {
+			end = done
+		}
+
+		c.events = c.events[1:]
+		if len(c.events) == 0 {
+			heap.Pop(&queue)
+			continue
+		}
+		c.next = c.events[0].Time
+		if c.next.Before(done) {
+			c.next = done
+		}
+		heap.Fix(&queue, 0)
+	}
+
+	report.Duration = end.Sub(start)
+	if report.Duration > 0 {
+		report.Throughput = float64(report.Bytes) / report.Duration.Seconds()
+	}
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	total := time.Duration(0)
+	for _, w := range waits {
+		total += w
+	}
+	report.MeanWait = total / time.Duration(len(waits))
+	report.P50Wait = stats.Percentile(waits, 50)
+	report.P95Wait = stats.Percentile(waits, 95)
+	report.P99Wait = stats.Percentile(waits, 99)
+	report.MaxWait = waits[len(waits)-1]
+	return report, nil
+}
+
+// replayConn is a connection of a replayed trace.
+type replayConn struct {
+	local *rate.Limiter
+
+	// events are the events of the connection not replayed yet
+	events []TraceEvent
+
+	// next is the time the next event is issued at
+	next time.Time
+}
+
+// transfer reserves size bytes issued at t in chunks granted by global and the local limiter of the connection,
+// as DefaultAllocator does, and returns the time the last chunk is granted at.
+func (c *replayConn) transfer(global *rate.Limiter, t time.Time, size int) time.Time {
+	for size > 0 {
+		chunk := size
+		if chunk > c.local.Burst() {
+			chunk = c.local.Burst()
+		}
+		if chunk > global.Burst() {
+			chunk = global.Burst()
+		}
+		delay := global.ReserveN(t, chunk).DelayFrom(t)
+		if local := c.local.ReserveN(t, chunk).DelayFrom(t); local > delay {
+			delay = local
+		}
+		t = t.Add(delay)
+		size -= chunk
+	}
+	return t
+}
+
+// replayQueue orders connections by the time their next event is issued at.
+type replayQueue []*replayConn
+
+func (q replayQueue) Len() int           { return len(q) }
+func (q replayQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q replayQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *replayQueue) Push(x interface{}) {
+	*q = append(*q, x.(*replayConn))
+}
+
+func (q *replayQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
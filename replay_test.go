@@ -0,0 +1,127 @@
+package netlimit_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(at time.Duration, conn uint64, size int) netlimit.TraceEvent {
+		return netlimit.TraceEvent{Time: start.Add(at), Conn: conn, Direction: netlimit.DirectionWrite, Size: size, Granted: size}
+	}
+	tests := []struct {
+		name         string
+		events       []netlimit.TraceEvent
+		limitGlobal  int
+		limitLocal   int
+		wantDuration time.Duration
+		wantMaxWait  time.Duration
+	}{
+		{
+			name:        "empty",
+			limitGlobal: 1000,
+			limitLocal:  1000,
+		},
+		{
+			name:         "within burst",
+			events:       []netlimit.TraceEvent{write(0, 1, 500), write(time.Second, 1, 500)},
+			limitGlobal:  1000,
+			limitLocal:   1000,
+			wantDuration: time.Second,
+		},
+		{
+			name:         "local limit",
+			events:       []netlimit.TraceEvent{write(0, 1, 3000)},
+			limitGlobal:  10000,
+			limitLocal:   1000,
+			wantDuration: 2 * time.Second,
+			wantMaxWait:  2 * time.Second,
+		},
+		{
+			name:         "events of a connection wait for each other",
+			events:       []netlimit.TraceEvent{write(0, 1, 2000), write(0, 1, 1000)},
+			limitGlobal:  10000,
+			limitLocal:   1000,
+			wantDuration: 2 * time.Second,
+			wantMaxWait:  2 * time.Second,
+		},
+		{
+			name:         "global limit shared by connections",
+			events:       []netlimit.TraceEvent{write(0, 1, 1000), write(0, 2, 1000), write(0, 3, 1000)},
+			limitGlobal:  1000,
+			limitLocal:   1000,
+			wantDuration: 2 * time.Second,
+			wantMaxWait:  2 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := netlimit.NewTraceWriter(&buf)
+			for _, ev := range tt.events {
+				w.Record(ev)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+
+			report, err := netlimit.Replay(netlimit.NewTraceReader(&buf), tt.limitGlobal, tt.limitLocal)
+			if err != nil {
+				t.Fatalf("Replay() error = %v", err)
+			}
+			if report.Events != len(tt.events) {
+				t.Errorf("Replay() Events = %d, want %d", report.Events, len(tt.events))
+			}
+			if report.Duration != tt.wantDuration {
+				t.Errorf("Replay() Duration = %v, want %v", report.Duration, tt.wantDuration)
+			}
+			if report.MaxWait != tt.wantMaxWait {
+				t.Errorf("Replay() MaxWait = %v, want %v", report.MaxWait, tt.wantMaxWait)
+			}
+			if tt.wantDuration > 0 {
+				if want := float64(report.Bytes) / tt.wantDuration.Seconds(); math.Abs(report.Throughput-want) > 1 {
+					t.Errorf("Replay() Throughput = %.0f, want %.0f", report.Throughput, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplay_Truncated(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	w := netlimit.NewTraceWriter(&buf)
+	for i := 0; i < 3; i++ {
+		w.Record(netlimit.TraceEvent{Time: start.Add(time.Duration(i) * time.Second), Conn: 1, Direction: netlimit.DirectionWrite, Size: 500, Granted: 500})
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	// the last event is cut short
+	trace := buf.Bytes()[:buf.Len()-1]
+	report, err := netlimit.Replay(netlimit.NewTraceReader(bytes.NewReader(trace)), 1000, 1000)
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	if !report.Truncated {
+		t.Errorf("Replay() Truncated = false, want true")
+	}
+	if report.Events != 2 || report.Bytes != 1000 {
+		t.Errorf("Replay() Events = %d, Bytes = %d, want the 2 complete events of 1000 bytes", report.Events, report.Bytes)
+	}
+}
+
+func TestReplay_Invalid(t *testing.T) {
+	if _, err := netlimit.Replay(netlimit.NewTraceReader(bytes.NewReader(nil)), 0, 1000); err == nil {
+		t.Errorf("Replay() error = nil, want an error for a zero limit")
+	}
+	if _, err := netlimit.Replay(netlimit.NewTraceReader(bytes.NewReader([]byte("garbage"))), 1000, 1000); err == nil {
+		t.Errorf("Replay() error = nil, want an error for an invalid trace")
+	}
+}
@@ -0,0 +1,161 @@
+package netlimit
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrEmptySchedule is returned when a Schedule has no periods.
+	ErrEmptySchedule = errors.New("schedule has no periods")
+)
+
+const (
+	// scheduleRampTick is the interval limits are updated at while ramping between periods
+	scheduleRampTick = time.Second
+
+	// scheduleLookback is how far back Schedule looks for the period in effect, a week covers every weekday
+	scheduleLookback = 8
+)
+
+// SchedulePeriod is a period of the day with its own limits, it lasts until the next period starts.
+type SchedulePeriod struct {
+	// Start is the time of day the period starts at, as an offset from midnight, e.g. 9 * time.Hour
+	Start time.Duration
+
+	// Days are the weekdays the period applies to, the period applies to every day if Days is empty
+	Days []time.Weekday
+
+	// GlobalLimit is the bytes per second limit of all connections combined within the period
+	GlobalLimit int
+
+	// LocalLimit is the bytes per second limit of a single connection within the period
+	LocalLimit int
+}
+
+// Schedule is a set of periods with different limits, e.g. lower limits during business hours and
+// higher during the night.
+type Schedule struct {
+	// Periods are the periods of the schedule, their order does not matter
+	Periods []SchedulePeriod
+
+	// Location is the time zone Start of periods is relative to, time.Local is used if Location is nil
+	Location *time.Location
+
+	// Ramp is the duration over which limits change linearly from the previous period to the next one,
+	// limits change at once if Ramp is 0
+	Ramp time.Duration
+}
+
+// occurrence is a single start of a SchedulePeriod.
+type occurrence struct {
+	start  time.Time
+	period SchedulePeriod
+}
+
+// LimitsAt returns the global and the local limit in effect at t.
+func (s *Schedule) LimitsAt(t time.Time) (global, local int) {
+	current, previous, ok := s.occurrences(t)
+	if !ok {
+		return 0, 0
+	}
+
+	global, local = current.period.GlobalLimit, current.period.LocalLimit
+	elapsed := t.Sub(current.start)
+	if s.Ramp <= 0 || elapsed >= s.Ramp {
+		return global, local
+	}
+
+	progress := float64(elapsed) / float64(s.Ramp)
+	global = interpolate(previous.period.GlobalLimit, global, progress)
+	local = interpolate(previous.period.LocalLimit, local, progress)
+	if local > global {
+		local = global
+	}
+	return global, local
+}
+
+// next returns the time at which limits change after t.
+func (s *Schedule) next(t time.Time) time.Time {
+	current, _, ok := s.occurrences(t)
+	if ok && s.Ramp > 0 && t.Sub(current.start) < s.Ramp {
+		return t.Add(scheduleRampTick)
+	}
+
+	loc := s.location()
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	next := time.Time{}
+	for i := 0; i < scheduleLookback; i++ {
+		for _, p := range s.Periods {
+			start := startOn(day.AddDate(0, 0, i), p)
+			if start.IsZero() || !start.After(t) {
+				continue
+			}
+			if next.IsZero() || start.Before(next) {
+				next = start
+			}
+		}
+	}
+	return next
+}
+
+// occurrences returns the latest start of a period not after t and the start preceding it.
+func (s *Schedule) occurrences(t time.Time) (current, previous occurrence, ok bool) {
+	loc := s.location()
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	for i := 0; i < scheduleLookback; i++ {
+		for _, p := range s.Periods {
+			start := startOn(day.AddDate(0, 0, -i), p)
+			if start.IsZero() || start.After(t) {
+				continue
+			}
+			o := occurrence{start: start, period: p}
+			switch {
+			case !ok || start.After(current.start):
+				if ok {
+					previous = current
+				}
+				current, ok = o, true
+			case previous.start.IsZero() || start.After(previous.start):
+				previous = o
+			}
+		}
+	}
+	if ok && previous.start.IsZero() {
+		previous = current
+	}
+	return current, previous, ok
+}
+
+func (s *Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
+
+// startOn returns the start of p on day or zero time if p does not apply to day.
+func startOn(day time.Time, p SchedulePeriod) time.Time {
+	if len(p.Days) > 0 {
+		applies := false
+		for _, d := range p.Days {
+			if d == day.Weekday() {
+				applies = true
+				break
+			}
+		}
+		if !applies {
+			return time.Time{}
+		}
+	}
+	// time.Date normalizes the clock, so that periods are aligned to wall time across DST changes
+	h, m := int(p.Start/time.Hour), int(p.Start%time.Hour/time.Minute)
+	sec := int(p.Start % time.Minute / time.Second)
+	return time.Date(day.Year(), day.Month(), day.Day(), h, m, sec, 0, day.Location())
+}
+
+func interpolate(from, to int, progress float64) int {
+	return from + int(float64(to-from)*progress)
+}
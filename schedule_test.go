@@ -0,0 +1,138 @@
+package netlimit_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+func TestSchedule_LimitsAt(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	schedule := &netlimit.Schedule{
+		Location: warsaw,
+		Ramp:     time.Hour,
+		Periods: []netlimit.SchedulePeriod{
+			{
+				Start:       9 * time.Hour,
+				Days:        []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+				GlobalLimit: 100,
+				LocalLimit:  10,
+			},
+			{
+				Start:       17 * time.Hour,
+				GlobalLimit: 1000,
+				LocalLimit:  100,
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		at         time.Time
+		wantGlobal int
+		wantLocal  int
+	}{
+		{
+			name:       "business hours",
+			at:         time.Date(2022, time.June, 16, 12, 0, 0, 0, warsaw),
+			wantGlobal: 100,
+			wantLocal:  10,
+		},
+		{
+			name:       "night",
+			at:         time.Date(2022, time.June, 16, 23, 0, 0, 0, warsaw),
+			wantGlobal: 1000,
+			wantLocal:  100,
+		},
+		{
+			name:       "halfway through the ramp",
+			at:         time.Date(2022, time.June, 16, 17, 30, 0, 0, warsaw),
+			wantGlobal: 550,
+			wantLocal:  55,
+		},
+		{
+			name:       "weekend morning keeps the night limits",
+			at:         time.Date(2022, time.June, 18, 12, 0, 0, 0, warsaw),
+			wantGlobal: 1000,
+			wantLocal:  100,
+		},
+		{
+			name:       "time zone is honoured",
+			at:         time.Date(2022, time.June, 16, 7, 30, 0, 0, time.UTC),
+			wantGlobal: 550,
+			wantLocal:  55,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotGlobal, gotLocal := schedule.LimitsAt(tt.at)
+			if gotGlobal != tt.wantGlobal || gotLocal != tt.wantLocal {
+				t.Errorf("LimitsAt() = %v, %v, want %v, %v", gotGlobal, gotLocal, tt.wantGlobal, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestListener_SetSchedule(t *testing.T) {
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 10, 10)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	if err := ln.SetSchedule(&netlimit.Schedule{}); err != netlimit.ErrEmptySchedule {
+		t.Errorf("SetSchedule() error = %v, wantErr %v", err, netlimit.ErrEmptySchedule)
+	}
+
+	err = ln.SetSchedule(&netlimit.Schedule{
+		Periods: []netlimit.SchedulePeriod{
+			{
+				GlobalLimit: 100,
+				LocalLimit:  50,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SetSchedule() error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for ln.GlobalLimit() != 100 || ln.LocalLimit() != 50 {
+		if time.Now().After(deadline) {
+			t.Fatalf("limits = %v, %v, want %v, %v", ln.GlobalLimit(), ln.LocalLimit(), 100, 50)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListener_SetScheduleInvalidPeriod(t *testing.T) {
+	ln, err := netlimit.Listen("tcp", "127.0.0.1:0", 10, 10)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	events, cancel := ln.Subscribe(16)
+	defer cancel()
+
+	err = ln.SetSchedule(&netlimit.Schedule{
+		Periods: []netlimit.SchedulePeriod{
+			{
+				GlobalLimit: 100,
+				LocalLimit:  200,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SetSchedule() error = %v", err)
+	}
+	ev := nextEvent(t, events, netlimit.EventLimitChangeFailed)
+	if ev.Global != 100 || ev.Local != 200 || !errors.Is(ev.Err, netlimit.ErrLimitGreaterThanTotal) {
+		t.Errorf("event = %+v, want limits %v, %v failing with %v", ev, 100, 200, netlimit.ErrLimitGreaterThanTotal)
+	}
+	if ln.GlobalLimit() != 10 || ln.LocalLimit() != 10 {
+		t.Errorf("limits = %v, %v, want them unchanged %v, %v", ln.GlobalLimit(), ln.LocalLimit(), 10, 10)
+	}
+}
@@ -0,0 +1,281 @@
+package netlimit
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	_ GlobalLimiter = (*ShardedLimiter)(nil)
+	_ Releaser      = (*ShardedLimiter)(nil)
+)
+
+const (
+	defaultRebalanceInterval = 100 * time.Millisecond
+
+	// shardFloorDivisor reserves 1/shardFloorDivisor of the even share for every shard, so that a shard
+	// that was idle during the last interval does not have to wait a whole interval for its first bytes
+	shardFloorDivisor = 4
+
+	// cacheLine is the size of the padding keeping shards on separate cache lines
+	cacheLine = 64
+)
+
+// ShardedLimiter is a GlobalLimiter that splits the global budget between shards, one per P by default,
+// so that connections running on different cores do not contend on a single mutex.
+// Reservations are served by the shard of the P the caller runs on.
+//
+// The global rate is split between shards according to their demand and rebalanced periodically.
+// Rates of all shards always add up to the global limit and bursts of all shards add up to the global burst,
+// so over any period T ShardedLimiter grants at most limit*T + limit bytes, the same bound as a single limiter.
+// Reservations waiting on a shard when a rebalance lowers its rate keep the delay computed at the higher rate,
+// the bytes they get ahead of the lower rate are charged to the shards whose rate grows, which may cost some
+// throughput but keeps the bound. Bytes given back with Release go back to a single shard and are capped at its burst.
+// Only lowering the limit with SetLimit while reservations wait exceeds the bound briefly.
+// An imbalance between shards only delays reservations on the busier shards until the next rebalance.
+type ShardedLimiter struct {
+	mu sync.Mutex
+
+	// limit is the bytes per second limit of all shards combined
+	limit int64
+
+	shards []*shard
+
+	// affinity hands out shards, sync.Pool keeps a per-P cache so that callers on a P keep using the same shard
+	affinity sync.Pool
+
+	// next is the index of the shard handed out to the next P without one
+	next uint32
+
+	// interval is the time between rebalances
+	interval time.Duration
+
+	// clock tells the time reservations are made at and schedules rebalances
+	clock Clock
+
+	// clockChanged restarts the wait for the next rebalance on the new clock
+	clockChanged chan struct{}
+
+	// done is closed once the ShardedLimiter is closed
+	done chan struct{}
+}
+
+type shard struct {
+	// demand is the number of bytes reserved since the last rebalance, accessed atomically,
+	// it comes first to be 64-bit aligned on 32-bit platforms
+	demand int64
+
+	// average is the moving average of demand, it is accessed only by rebalance
+	average float64
+
+	// pool keeps bytes given back by Release while reservations wait on limiter
+	pool releasePool
+
+	limiter *rate.Limiter
+
+	_ [cacheLine - 40]byte
+}
+
+// NewShardedLimiter returns a ShardedLimiter that allows limit bytes per second split between shards.
+// If shards is not positive, the budget is split between runtime.GOMAXPROCS shards.
+// The ShardedLimiter rebalances shards in the background until it is closed.
+func NewShardedLimiter(limit, shards int) *ShardedLimiter {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+
+	l := &ShardedLimiter{
+		limit:        int64(limit),
+		shards:       make([]*shard, shards),
+		interval:     defaultRebalanceInterval,
+		clock:        realClock{},
+		clockChanged: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	burst := l.shardBurst(int64(limit))
+	for i := range l.shards {
+		l.shards[i] = &shard{limiter: rate.NewLimiter(rate.Limit(limit/shards), burst)}
+	}
+	l.affinity.New = func() interface{} {
+		i := atomic.AddUint32(&l.next, 1) - 1
+		return l.shards[int(i%uint32(len(l.shards)))]
+	}
+
+	go l.run()
+	return l
+}
+
+// ReserveN reserves n bytes of the budget of the shard of the calling P.
+func (l *ShardedLimiter) ReserveN(now time.Time, n int) Reservation {
+	s := l.affinity.Get().(*shard)
+	atomic.AddInt64(&s.demand, int64(n))
+	r := reserveReleased(s.limiter, &s.pool, now, n, l.clock)
+	l.affinity.Put(s)
+	return r
+}
+
+// Release gives n unused bytes back to the ShardedLimiter.
+// Released bytes are not tied to the shard they were reserved from, as the caller may run on another P by now,
+// they go back to the shard of the calling P, see releaseTo.
+func (l *ShardedLimiter) Release(n int) {
+	s := l.affinity.Get().(*shard)
+	releaseTo(s.limiter, &s.pool, l.clock.Now(), n)
+	l.affinity.Put(s)
+}
+
+// Limit returns the bytes per second limit of all shards combined.
+func (l *ShardedLimiter) Limit() int {
+	return int(atomic.LoadInt64(&l.limit))
+}
+
+// Burst returns the maximum number of bytes that can be reserved at once, that is the burst of a single shard.
+func (l *ShardedLimiter) Burst() int {
+	return l.shardBurst(atomic.LoadInt64(&l.limit))
+}
+
+// SetLimit sets the bytes per second limit of all shards combined and rebalances shards right away.
+func (l *ShardedLimiter) SetLimit(limit int) {
+	atomic.StoreInt64(&l.limit, int64(limit))
+	l.rebalance()
+}
+
+// SetRebalanceInterval sets the time between rebalances, 100ms by default.
+// Shorter intervals follow changes of demand faster at the cost of locking every shard more often.
+func (l *ShardedLimiter) SetRebalanceInterval(interval time.Duration) {
+	l.mu.Lock()
+	l.interval = interval
+	l.mu.Unlock()
+}
+
+// SetClock replaces the clock of the ShardedLimiter, e.g. with a fake clock in tests.
+// SetClock must be called before the first reservation.
+func (l *ShardedLimiter) SetClock(c Clock) {
+	l.mu.Lock()
+	l.clock = c
+	l.mu.Unlock()
+	select {
+	case l.clockChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops rebalancing, shards keep their last rates.
+func (l *ShardedLimiter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *ShardedLimiter) run() {
+	for {
+		l.mu.Lock()
+		interval, clock := l.interval, l.clock
+		l.mu.Unlock()
+
+		timer := clock.NewTimer(interval)
+		select {
+		case <-timer.C():
+			l.rebalance()
+		case <-l.clockChanged:
+			timer.Stop()
+		case <-l.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// rebalance splits the global rate between shards, every shard gets a floor and the rest is split
+// proportionally to the moving average of demand of shards.
+func (l *ShardedLimiter) rebalance() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := atomic.LoadInt64(&l.limit)
+	n := int64(len(l.shards))
+	floor := limit / n / shardFloorDivisor
+
+	total := 0.0
+	for _, s := range l.shards {
+		// reservations waiting longer than an interval leave gaps in demand, the average smooths them out
+		s.average = (s.average + float64(atomic.SwapInt64(&s.demand, 0))) / 2
+		total += s.average
+	}
+
+	// rounding down keeps the sum of shares within limit
+	spare := limit - floor*n
+	shares := make([]int64, n)
+	for i, s := range l.shards {
+		shares[i] = floor
+		if total == 0 {
+			shares[i] += spare / n
+		} else {
+			shares[i] += int64(float64(spare) * s.average / total)
+		}
+	}
+
+	// a reservation waiting on a shard is due at the current rate of the shard, if the rate is lowered
+	// it is granted delay*(old-new) bytes ahead of the new rate, they are charged to the shards that grow
+	now := l.clock.Now()
+	ahead := make([]float64, n)
+	excess, growth := 0.0, 0.0
+	for i, s := range l.shards {
+		old, share := float64(s.limiter.Limit()), float64(shares[i])
+		if share >= old {
+			growth += share - old
+			continue
+		}
+		// a reservation of no bytes is due once all reservations waiting on the shard are
+		delay := s.limiter.ReserveN(now, 0).DelayFrom(now)
+		ahead[i] = delay.Seconds() * (old - share)
+		excess += ahead[i]
+	}
+
+	burst := l.shardBurst(limit)
+	for i, s := range l.shards {
+		old := float64(s.limiter.Limit())
+		s.limiter.SetLimitAt(now, rate.Limit(shares[i]))
+		s.limiter.SetBurstAt(now, burst)
+
+		// no shard grows when SetLimit lowers the limit, every shard is charged its own bytes then
+		charge := ahead[i]
+		if growth > 0 {
+			charge = 0
+			if share := float64(shares[i]); share > old {
+				charge = excess * (share - old) / growth
+			}
+		}
+		chargeShard(s.limiter, now, int(math.Ceil(charge)), burst)
+	}
+}
+
+// chargeShard reserves n bytes of lim that are never sent, in reservations of at most burst bytes.
+func chargeShard(lim *rate.Limiter, now time.Time, n, burst int) {
+	for n > 0 {
+		r := n
+		if r > burst {
+			r = burst
+		}
+		lim.ReserveN(now, r)
+		n -= r
+	}
+}
+
+// shardBurst returns the burst of a single shard, bursts of all shards add up to limit.
+func (l *ShardedLimiter) shardBurst(limit int64) int {
+	burst := limit / int64(len(l.shards))
+	if burst < 1 {
+		return 1
+	}
+	return int(burst)
+}
@@ -0,0 +1,213 @@
+package netlimit_test
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+	"golang.org/x/time/rate"
+)
+
+func TestShardedLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		shards    int
+		callers   int
+		limit     int
+		wantAbove int
+	}{
+		{
+			name:      "single caller gets most of the budget once rebalanced",
+			shards:    4,
+			callers:   1,
+			limit:     1000,
+			wantAbove: 1400,
+		},
+		{
+			name:      "many callers do not exceed the global limit",
+			shards:    4,
+			callers:   16,
+			limit:     1000,
+			wantAbove: 1400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := netlimittest.NewClock(time.Unix(0, 0))
+			l := netlimit.NewShardedLimiter(tt.limit, tt.shards)
+			defer l.Close()
+			l.SetRebalanceInterval(50 * time.Millisecond)
+			l.SetClock(clock)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			var (
+				wg      sync.WaitGroup
+				granted int64
+			)
+			for i := 0; i < tt.callers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					a := netlimit.NewDefaultAllocatorWithLimiter(l, tt.limit)
+					a.SetClock(clock)
+					for {
+						n, err := a.Alloc(ctx, 50)
+						if err != nil {
+							return
+						}
+						atomic.AddInt64(&granted, int64(n))
+					}
+				}()
+			}
+
+			// the clock moves to the next deadline only once every caller and the rebalance wait for a timer
+			const period = 2 * time.Second
+			end := clock.Now().Add(period)
+			for {
+				clock.BlockUntil(tt.callers + 1)
+				next, _ := clock.Next()
+				if next.After(end) {
+					break
+				}
+				clock.Advance(next.Sub(clock.Now()))
+			}
+			got := atomic.LoadInt64(&granted)
+			cancel()
+			wg.Wait()
+
+			// a single limiter grants at most limit*T + limit bytes over T
+			wantBelow := int64(tt.limit) * int64(period/time.Second+1)
+			if got < int64(tt.wantAbove) || got > wantBelow {
+				t.Errorf("granted %d bytes in %v, want between %d and %d", got, period, tt.wantAbove, wantBelow)
+			}
+		})
+	}
+}
+
+func TestShardedLimiter_Burst(t *testing.T) {
+	l := netlimit.NewShardedLimiter(1000, 4)
+	defer l.Close()
+
+	if got := l.Burst(); got != 250 {
+		t.Errorf("Burst() = %d, want 250", got)
+	}
+	l.SetLimit(2000)
+	if got := l.Limit(); got != 2000 {
+		t.Errorf("Limit() = %d, want 2000", got)
+	}
+	if got := l.Burst(); got != 500 {
+		t.Errorf("Burst() = %d, want 500", got)
+	}
+	if r := l.ReserveN(time.Now(), 501); r.OK() {
+		t.Errorf("ReserveN() over the burst of a shard is OK, want not OK")
+	}
+}
+
+func TestShardedLimiter_SetLimitWaiting(t *testing.T) {
+	clock := netlimittest.NewClock(time.Unix(0, 0))
+	l := netlimit.NewShardedLimiter(1000, 1)
+	defer l.Close()
+	l.SetClock(clock)
+	now := clock.Now()
+
+	l.ReserveN(now, 1000)
+	// due in 250ms at 1000 bytes per second, that is 125 bytes ahead of 500 bytes per second
+	if got, want := l.ReserveN(now, 250).DelayFrom(now), 250*time.Millisecond; got != want {
+		t.Fatalf("DelayFrom() = %v, want %v", got, want)
+	}
+	l.SetLimit(500)
+
+	// 250 waiting bytes, 125 bytes charged ahead and 250 more bytes at 500 bytes per second
+	if got, want := l.ReserveN(now, 250).DelayFrom(now), 1250*time.Millisecond; got != want {
+		t.Errorf("DelayFrom() = %v, want %v", got, want)
+	}
+}
+
+func TestShardedLimiter_Release(t *testing.T) {
+	clock := netlimittest.NewClock(time.Unix(0, 0))
+	l := netlimit.NewShardedLimiter(1000, 1)
+	defer l.Close()
+	l.SetClock(clock)
+	now := clock.Now()
+
+	l.ReserveN(now, 1000)
+	waiting := l.ReserveN(now, 500)
+	l.Release(100)
+	// cancelling a reservation still waiting after Release gives back no more than its own bytes
+	waiting.Cancel()
+	if got := l.ReserveN(now, 100).DelayFrom(now); got != 0 {
+		t.Errorf("DelayFrom() = %v, want released bytes spent right away", got)
+	}
+	if got, want := l.ReserveN(now, 500).DelayFrom(now), 500*time.Millisecond; got != want {
+		t.Errorf("DelayFrom() = %v, want %v", got, want)
+	}
+}
+
+func TestShardedLimiter_ReleaseBound(t *testing.T) {
+	clock := netlimittest.NewClock(time.Unix(0, 0))
+	l := netlimit.NewShardedLimiter(1000, 4)
+	defer l.Close()
+	l.SetClock(clock)
+	now := clock.Now()
+
+	// shards are full, released bytes must not be granted on top of their bursts
+	for i := 0; i < 4; i++ {
+		l.Release(1000)
+	}
+	granted := 0
+	for i := 0; i < 100; i++ {
+		r := l.ReserveN(now, 50)
+		if r.DelayFrom(now) > 0 {
+			r.Cancel()
+			continue
+		}
+		granted += 50
+	}
+	if granted > 1000 {
+		t.Errorf("ShardedLimiter granted %v bytes at once, want at most the limit of %v", granted, 1000)
+	}
+}
+
+// benchmarkReserveParallel reserves single bytes from all Ps, the limit is high enough for no reservation to wait.
+func benchmarkReserveParallel(b *testing.B, l netlimit.GlobalLimiter) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.ReserveN(time.Now(), 1)
+		}
+	})
+}
+
+func BenchmarkGlobalLimiter_ReserveParallel(b *testing.B) {
+	benchmarkReserveParallel(b, netlimit.WrapLimiter(rate.NewLimiter(rate.Limit(math.MaxInt32), math.MaxInt32)))
+}
+
+func BenchmarkShardedLimiter_ReserveParallel(b *testing.B) {
+	l := netlimit.NewShardedLimiter(math.MaxInt32, 0)
+	defer l.Close()
+	benchmarkReserveParallel(b, l)
+}
+
+func BenchmarkShardedLimiter_AllocParallel(b *testing.B) {
+	l := netlimit.NewShardedLimiter(math.MaxInt32, 0)
+	defer l.Close()
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// every goroutine models a separate connection sharing the global limiter
+		a := netlimit.NewDefaultAllocatorWithLimiter(l, math.MaxInt32)
+		for pb.Next() {
+			if _, err := a.Alloc(ctx, 64); err != nil {
+				b.Errorf("Alloc() error = %v", err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package netlimit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	_ GlobalLimiter = (*SharedLimiter)(nil)
+	_ Releaser      = (*SharedLimiter)(nil)
+)
+
+var (
+	// ErrSharedLimiterUnsupported is returned by OpenSharedLimiter on platforms without memory-mapped files.
+	ErrSharedLimiterUnsupported = errors.New("shared limiter is not supported on this platform")
+
+	// ErrSharedLimiterCorrupted is returned by OpenSharedLimiter when the file does not hold a shared limiter.
+	ErrSharedLimiterCorrupted = errors.New("file does not hold a shared limiter")
+
+	// ErrSharedLimiterClosed is returned by Close of a SharedLimiter that is already closed.
+	// Reservations of a closed SharedLimiter are never OK.
+	ErrSharedLimiterClosed = errors.New("shared limiter closed")
+)
+
+const (
+	// sharedLimiterSize is the size of the memory-mapped file
+	sharedLimiterSize = 4096
+
+	sharedLimiterMagic = 0x6e65746c696d6974 // "netlimit"
+
+	// sharedLimiterLockTimeout is the maximum time OpenSharedLimiter waits for another process initializing the file
+	sharedLimiterLockTimeout = 5 * time.Second
+)
+
+// sharedState is the layout of the memory-mapped file, all fields are accessed atomically.
+// The token bucket is implemented as GCRA, so its whole state is a single word updated with CAS.
+type sharedState struct {
+	// magic is sharedLimiterMagic once the state is initialized
+	magic uint64
+
+	// limit is the bytes per second limit
+	limit int64
+
+	// burst is the maximum number of bytes that can be reserved at once
+	burst int64
+
+	// tat is the theoretical arrival time, in unix nanoseconds, of the next byte
+	tat int64
+}
+
+// SharedLimiter is a GlobalLimiter whose token bucket lives in a memory-mapped file, so that processes
+// co-located on a single host, e.g. workers accepting on the same port with SO_REUSEPORT, share one budget.
+type SharedLimiter struct {
+	// f is the memory-mapped file
+	f *os.File
+
+	// mem is the memory-mapped content of f
+	mem []byte
+
+	// state points to the beginning of mem, it is nil once the limiter is closed
+	state unsafe.Pointer
+
+	// clock tells the time bytes are released and reservations cancelled at
+	clock Clock
+}
+
+// OpenSharedLimiter opens or creates the shared limiter kept in the file at path.
+// limit is used only when the file is created, processes opening an existing file join its budget.
+func OpenSharedLimiter(path string, limit int) (*SharedLimiter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared limiter: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat shared limiter: %w", err)
+	}
+	if info.Size() < sharedLimiterSize {
+		if err := f.Truncate(sharedLimiterSize); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to grow shared limiter: %w", err)
+		}
+	}
+
+	mem, err := mmap(f, sharedLimiterSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &SharedLimiter{
+		f:     f,
+		mem:   mem,
+		state: unsafe.Pointer(&mem[0]),
+		clock: realClock{},
+	}
+	if err := l.init(limit); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// init initializes the state unless another process already did. The state is initialized under an exclusive
+// lock of the file, the lock is released by the kernel if the process crashes, so that a crash while initializing
+// does not leave the file half initialized for good.
+func (l *SharedLimiter) init(limit int) error {
+	state := l.load()
+	if atomic.LoadUint64(&state.magic) == sharedLimiterMagic {
+		return nil
+	}
+
+	if err := lockFile(l.f, sharedLimiterLockTimeout); err != nil {
+		return err
+	}
+	defer unlockFile(l.f)
+	switch atomic.LoadUint64(&state.magic) {
+	case sharedLimiterMagic:
+		// another process initialized the state while we were waiting for the lock
+		return nil
+	case 0:
+		atomic.StoreInt64(&state.limit, int64(limit))
+		atomic.StoreInt64(&state.burst, int64(limit))
+		// a theoretical arrival time in the past lets the whole burst through, whatever clock processes use
+		atomic.StoreInt64(&state.tat, 0)
+		atomic.StoreUint64(&state.magic, sharedLimiterMagic)
+		return nil
+	default:
+		return ErrSharedLimiterCorrupted
+	}
+}
+
+// load returns the shared state, nil once the limiter is closed.
+func (l *SharedLimiter) load() *sharedState {
+	return (*sharedState)(atomic.LoadPointer(&l.state))
+}
+
+// ReserveN reserves n bytes of the host-wide budget.
+func (l *SharedLimiter) ReserveN(now time.Time, n int) Reservation {
+	state := l.load()
+	if state == nil {
+		return &sharedReservation{}
+	}
+	limit := atomic.LoadInt64(&state.limit)
+	burst := atomic.LoadInt64(&state.burst)
+	if int64(n) > burst || limit <= 0 {
+		return &sharedReservation{}
+	}
+
+	nowNano := now.UnixNano()
+	increment := l.increment(n, limit)
+	tolerance := l.increment(int(burst), limit)
+	for {
+		old := atomic.LoadInt64(&state.tat)
+		tat := old
+		if tat < nowNano {
+			tat = nowNano
+		}
+		newTat := tat + increment
+		if atomic.CompareAndSwapInt64(&state.tat, old, newTat) {
+			return &sharedReservation{
+				limiter:   l,
+				ok:        true,
+				increment: increment,
+				timeToAct: time.Unix(0, newTat-tolerance),
+			}
+		}
+	}
+}
+
+// Release gives n unused bytes back to the host-wide budget, the budget never goes back beyond the present.
+func (l *SharedLimiter) Release(n int) {
+	state := l.load()
+	if state == nil {
+		return
+	}
+	limit := atomic.LoadInt64(&state.limit)
+	if limit <= 0 {
+		return
+	}
+
+	increment := l.increment(n, limit)
+	nowNano := l.clock.Now().UnixNano()
+	for {
+		old := atomic.LoadInt64(&state.tat)
+		if old <= nowNano {
+			return
+		}
+		tat := old - increment
+		if tat < nowNano {
+			tat = nowNano
+		}
+		if atomic.CompareAndSwapInt64(&state.tat, old, tat) {
+			return
+		}
+	}
+}
+
+// increment returns the time it takes to earn n bytes at limit bytes per second.
+func (l *SharedLimiter) increment(n int, limit int64) int64 {
+	return int64(n) * int64(time.Second) / limit
+}
+
+// Limit returns the bytes per second limit shared by all processes, 0 once the limiter is closed.
+func (l *SharedLimiter) Limit() int {
+	state := l.load()
+	if state == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&state.limit))
+}
+
+// Burst returns the maximum number of bytes that can be reserved at once, 0 once the limiter is closed.
+func (l *SharedLimiter) Burst() int {
+	state := l.load()
+	if state == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&state.burst))
+}
+
+// SetLimit sets the bytes per second limit, and the burst, of all processes sharing the limiter.
+func (l *SharedLimiter) SetLimit(limit int) {
+	state := l.load()
+	if state == nil {
+		return
+	}
+	atomic.StoreInt64(&state.limit, int64(limit))
+	atomic.StoreInt64(&state.burst, int64(limit))
+}
+
+// SetClock replaces the clock of the SharedLimiter, e.g. with a fake clock in tests.
+// All processes sharing the file have to agree on the time, SetClock must be called before the first reservation.
+func (l *SharedLimiter) SetClock(c Clock) {
+	l.clock = c
+}
+
+// Close unmaps the shared limiter, the file is kept so that other processes can keep using it.
+// The limiter must not be in use by other goroutines while it is being closed.
+func (l *SharedLimiter) Close() error {
+	if atomic.SwapPointer(&l.state, nil) == nil {
+		return ErrSharedLimiterClosed
+	}
+	err := munmap(l.mem)
+	l.mem = nil
+	if cerr := l.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sharedReservation is a Reservation of a SharedLimiter.
+type sharedReservation struct {
+	limiter   *SharedLimiter
+	ok        bool
+	increment int64
+	timeToAct time.Time
+}
+
+func (r *sharedReservation) OK() bool {
+	return r.ok
+}
+
+func (r *sharedReservation) DelayFrom(now time.Time) time.Duration {
+	if !r.ok {
+		return rate.InfDuration
+	}
+	delay := r.timeToAct.Sub(now)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Cancel gives reserved bytes back unless they could have already been sent.
+func (r *sharedReservation) Cancel() {
+	if !r.ok {
+		return
+	}
+	now := r.limiter.clock.Now()
+	if !now.Before(r.timeToAct) {
+		return
+	}
+
+	state := r.limiter.load()
+	if state == nil {
+		return
+	}
+	nowNano := now.UnixNano()
+	for {
+		tat := atomic.LoadInt64(&state.tat)
+		newTat := tat - r.increment
+		if newTat < nowNano {
+			newTat = nowNano
+		}
+		if atomic.CompareAndSwapInt64(&state.tat, tat, newTat) {
+			return
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package netlimit
+
+import (
+	"os"
+	"time"
+)
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, ErrSharedLimiterUnsupported
+}
+
+func munmap(mem []byte) error {
+	return nil
+}
+
+func lockFile(f *os.File, timeout time.Duration) error {
+	return ErrSharedLimiterUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,181 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package netlimit_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+func TestSharedLimiter_ReserveN(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		first     int
+		second    int
+		wantDelay time.Duration
+		wantOK    bool
+	}{
+		{
+			name:      "second process waits for the budget used by the first",
+			limit:     100,
+			first:     100,
+			second:    50,
+			wantDelay: 500 * time.Millisecond,
+			wantOK:    true,
+		},
+		{
+			name:      "both processes fit in the burst",
+			limit:     100,
+			first:     50,
+			second:    50,
+			wantDelay: 0,
+			wantOK:    true,
+		},
+		{
+			name:   "reservation greater than burst",
+			limit:  100,
+			first:  0,
+			second: 101,
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "limiter")
+			first, err := netlimit.OpenSharedLimiter(path, tt.limit)
+			if err != nil {
+				t.Fatalf("OpenSharedLimiter() error = %v", err)
+			}
+			defer first.Close()
+			// the limit of an existing limiter is kept
+			second, err := netlimit.OpenSharedLimiter(path, tt.limit*10)
+			if err != nil {
+				t.Fatalf("OpenSharedLimiter() error = %v", err)
+			}
+			defer second.Close()
+			if got := second.Limit(); got != tt.limit {
+				t.Errorf("Limit() = %v, want %v", got, tt.limit)
+			}
+
+			now := time.Now()
+			first.ReserveN(now, tt.first)
+			r := second.ReserveN(now, tt.second)
+			if r.OK() != tt.wantOK {
+				t.Fatalf("ReserveN() ok = %v, want %v", r.OK(), tt.wantOK)
+			}
+			if !tt.wantOK {
+				return
+			}
+			if got := r.DelayFrom(now); got != tt.wantDelay {
+				t.Errorf("DelayFrom() = %v, want %v", got, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestSharedLimiter_Cancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limiter")
+	l, err := netlimit.OpenSharedLimiter(path, 100)
+	if err != nil {
+		t.Fatalf("OpenSharedLimiter() error = %v", err)
+	}
+	defer l.Close()
+
+	l.ReserveN(time.Now(), 100)
+	r := l.ReserveN(time.Now(), 100)
+	r.Cancel()
+	if got := l.ReserveN(time.Now(), 10).DelayFrom(time.Now()); got > 150*time.Millisecond {
+		t.Errorf("DelayFrom() = %v, want at most %v", got, 150*time.Millisecond)
+	}
+}
+
+func TestSharedLimiter_Alloc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limiter")
+	l, err := netlimit.OpenSharedLimiter(path, 100)
+	if err != nil {
+		t.Fatalf("OpenSharedLimiter() error = %v", err)
+	}
+	defer l.Close()
+
+	a := netlimit.NewDefaultAllocatorWithLimiter(l, 100)
+	got, err := a.Alloc(context.Background(), 200)
+	if err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	if got != 100 {
+		t.Errorf("Alloc() got = %v, want %v", got, 100)
+	}
+}
+
+func TestOpenSharedLimiter_CrashedInitializer(t *testing.T) {
+	tests := []struct {
+		name    string
+		magic   uint64
+		wantErr error
+	}{
+		{
+			// the magic is stored last, a crash while initializing leaves it unset
+			name:  "crashed while initializing",
+			magic: 0,
+		},
+		{
+			name:    "not a shared limiter",
+			magic:   42,
+			wantErr: netlimit.ErrSharedLimiterCorrupted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "limiter")
+			b := make([]byte, 4096)
+			*(*uint64)(unsafe.Pointer(&b[0])) = tt.magic
+			if err := os.WriteFile(path, b, 0o644); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+
+			l, err := netlimit.OpenSharedLimiter(path, 100)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("OpenSharedLimiter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer l.Close()
+			if got := l.Limit(); got != 100 {
+				t.Errorf("Limit() = %v, want %v", got, 100)
+			}
+		})
+	}
+}
+
+func TestSharedLimiter_Close(t *testing.T) {
+	l, err := netlimit.OpenSharedLimiter(filepath.Join(t.TempDir(), "limiter"), 100)
+	if err != nil {
+		t.Fatalf("OpenSharedLimiter() error = %v", err)
+	}
+	r := l.ReserveN(time.Now(), 100)
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	r.Cancel()
+	l.Release(10)
+	if r := l.ReserveN(time.Now(), 10); r.OK() {
+		t.Errorf("ReserveN() ok = %v after Close, want %v", r.OK(), false)
+	}
+	a := netlimit.NewDefaultAllocatorWithLimiter(l, 100)
+	if _, err := a.Alloc(context.Background(), 10); err == nil {
+		t.Errorf("Alloc() error = nil after Close, want an error")
+	}
+	if err := l.Close(); !errors.Is(err, netlimit.ErrSharedLimiterClosed) {
+		t.Errorf("Close() error = %v, wantErr %v", err, netlimit.ErrSharedLimiterClosed)
+	}
+}
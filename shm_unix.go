@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package netlimit
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	mem, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map shared limiter: %w", err)
+	}
+	return mem, nil
+}
+
+func munmap(mem []byte) error {
+	return syscall.Munmap(mem)
+}
+
+// lockFile takes an exclusive lock of f, waiting for it at most timeout.
+func lockFile(f *os.File, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return fmt.Errorf("failed to lock shared limiter: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("failed to lock shared limiter: timed out after %v", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,315 @@
+// Package sim is a discrete-event simulator of limiter policies. It runs synthetic clients through a
+// netlimit.Allocator on virtual time and reports fairness, wait times and utilization, so that a pair of
+// global and local limits can be evaluated under load before it is deployed.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/internal/fakeclock"
+	"github.com/charconstpointer/netlimit/internal/stats"
+)
+
+var (
+	// ErrInvalidConfig is returned by Run for configurations that cannot be simulated.
+	ErrInvalidConfig = errors.New("invalid simulation config")
+)
+
+// Clients describes a group of identical synthetic clients.
+type Clients struct {
+	// N is the number of clients of the group
+	N int
+
+	// Arrivals is the mean number of transfers per second every client starts, arrivals follow a Poisson process.
+	// Transfers of a client run one after another, a transfer arriving while the previous one runs waits for it.
+	// 0 means clients start transfers back to back.
+	Arrivals float64
+
+	// Size is the size of every transfer in bytes
+	Size int
+
+	// MaxSize makes transfer sizes uniformly distributed between Size and MaxSize if it is greater than Size
+	MaxSize int
+}
+
+// NewAllocator returns the Allocator of a simulated client. global is the limiter shared by all clients and clock
+// is the virtual clock of the simulation. The Allocator has to block only on a single timer of clock at a time,
+// virtual time moves on once every client waits for a timer, so blocking on anything else stalls the simulation.
+type NewAllocator func(global netlimit.GlobalLimiter, clock netlimit.Clock) (netlimit.Allocator, error)
+
+// Config configures a simulation.
+type Config struct {
+	// Clients are the groups of clients of the simulation
+	Clients []Clients
+
+	// Duration is the virtual time the simulation runs for
+	Duration time.Duration
+
+	// GlobalLimit is the bytes per second limit of all clients combined
+	GlobalLimit int
+
+	// LocalLimit is the bytes per second limit of every client
+	LocalLimit int
+
+	// NewAllocator makes the Allocator of every client, a DefaultAllocator limited to LocalLimit is used if it is nil.
+	// Allocations that wait must wait on a single timer of the clock, as DefaultAllocator does, so that the
+	// simulator knows when all clients are blocked and virtual time can move on.
+	NewAllocator NewAllocator
+
+	// Seed seeds arrivals and transfer sizes, simulations with the same Seed draw the same workload
+	Seed int64
+}
+
+// ClientReport is the outcome of a single simulated client.
+type ClientReport struct {
+	// Group is the index of the Clients group of the client in Config.Clients
+	Group int
+
+	// Bytes is the number of bytes allocated to the client
+	Bytes int64
+
+	// Transfers is the number of transfers the client completed
+	Transfers int
+
+	// Throughput is the bytes per second rate of the client
+	Throughput float64
+}
+
+// Report is the outcome of a simulation.
+type Report struct {
+	// Duration is the virtual time the simulation ran for
+	Duration time.Duration
+
+	// Bytes is the number of bytes allocated to all clients
+	Bytes int64
+
+	// Transfers is the number of completed transfers
+	Transfers int
+
+	// Utilization is the fraction of the global limit, including its burst, allocated to clients
+	Utilization float64
+
+	// Fairness is Jain's fairness index of throughputs of clients, 1 when all clients get the same throughput
+	// and 1/n when a single client out of n gets everything
+	Fairness float64
+
+	// MinMaxRatio is the throughput of the slowest client divided by the throughput of the fastest one
+	MinMaxRatio float64
+
+	// MeanWait is the mean time from the arrival of a transfer until it completed
+	MeanWait time.Duration
+
+	// P50Wait, P95Wait and P99Wait are percentiles of the wait of transfers
+	P50Wait time.Duration
+	P95Wait time.Duration
+	P99Wait time.Duration
+
+	// MaxWait is the longest wait of a transfer
+	MaxWait time.Duration
+
+	// Clients are the outcomes of every client
+	Clients []ClientReport
+}
+
+// client is a simulated client.
+type client struct {
+	// group is the index of the Clients group of the client in Config.Clients
+	group int
+	Clients
+	a    netlimit.Allocator
+	rand *rand.Rand
+
+	bytes     int64
+	transfers int
+	waits     []time.Duration
+	err       error
+}
+
+// Run runs the simulation configured by cfg. The simulation runs as fast as the clients do and
+// its outcome depends only on cfg, up to the order of allocations made at the same virtual time.
+func Run(cfg Config) (Report, error) {
+	if err := cfg.validate(); err != nil {
+		return Report{}, err
+	}
+	newAllocator := cfg.NewAllocator
+	if newAllocator == nil {
+		newAllocator = defaultAllocator(cfg.LocalLimit)
+	}
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := fakeclock.New(start)
+	global := netlimit.NewGlobalLimiterWithClock(cfg.GlobalLimit, clock)
+	var clients []*client
+	for group, g := range cfg.Clients {
+		for i := 0; i < g.N; i++ {
+			a, err := newAllocator(global, clock)
+			if err != nil {
+				return Report{}, fmt.Errorf("failed to create allocator: %w", err)
+			}
+			seed := cfg.Seed + int64(len(clients))
+			clients = append(clients, &client{group: group, Clients: g, a: a, rand: rand.New(rand.NewSource(seed))})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// stopped is cancelled once a client stops, before the end of the simulation only a failed allocation does that
+	stopped, stop := context.WithCancel(context.Background())
+	defer stop()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			defer stop()
+			c.run(ctx, clock)
+		}(c)
+	}
+
+	end := start.Add(cfg.Duration)
+	for {
+		// every client waits on a single timer once it is blocked, virtual time moves on only then
+		if err := clock.BlockUntilContext(stopped, len(clients)); err != nil {
+			break
+		}
+		next, ok := clock.Next()
+		if !ok || next.After(end) {
+			break
+		}
+		clock.Advance(next.Sub(clock.Now()))
+	}
+
+	// clients stop once the context is cancelled and their pending timers have fired
+	cancel()
+	finished, finish := context.WithCancel(context.Background())
+	go func() {
+		wg.Wait()
+		finish()
+	}()
+	for clock.BlockUntilContext(finished, 1) == nil && finished.Err() == nil {
+		clock.Advance(cfg.Duration)
+	}
+
+	return report(cfg, clients)
+}
+
+func (cfg Config) validate() error {
+	if cfg.Duration <= 0 {
+		return fmt.Errorf("%w: duration must be positive", ErrInvalidConfig)
+	}
+	if cfg.GlobalLimit <= 0 || (cfg.NewAllocator == nil && cfg.LocalLimit <= 0) {
+		return fmt.Errorf("%w: limits must be positive", ErrInvalidConfig)
+	}
+	clients := 0
+	for _, g := range cfg.Clients {
+		if g.N < 0 || g.Size <= 0 || g.Arrivals < 0 {
+			return fmt.Errorf("%w: clients must have a positive size and non-negative arrivals", ErrInvalidConfig)
+		}
+		clients += g.N
+	}
+	if clients == 0 {
+		return fmt.Errorf("%w: no clients", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func defaultAllocator(limit int) NewAllocator {
+	return func(global netlimit.GlobalLimiter, clock netlimit.Clock) (netlimit.Allocator, error) {
+		a := netlimit.NewDefaultAllocatorWithLimiter(global, limit)
+		a.SetClock(clock)
+		return a, nil
+	}
+}
+
+// run starts transfers of the client until ctx is cancelled.
+func (c *client) run(ctx context.Context, clock netlimit.Clock) {
+	arrival := clock.Now()
+	for {
+		if c.Arrivals > 0 {
+			arrival = arrival.Add(time.Duration(c.rand.ExpFloat64() / c.Arrivals * float64(time.Second)))
+			if d := arrival.Sub(clock.Now()); d > 0 {
+				clock.Sleep(d)
+			}
+		} else {
+			arrival = clock.Now()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		for remaining := c.size(); remaining > 0; {
+			n, err := c.a.Alloc(ctx, remaining)
+			if ctx.Err() != nil {
+				// allocations granted after the end of the simulation do not count
+				return
+			}
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.bytes += int64(n)
+			remaining -= n
+		}
+		c.transfers++
+		c.waits = append(c.waits, clock.Now().Sub(arrival))
+	}
+}
+
+func (c *client) size() int {
+	if c.MaxSize > c.Size {
+		return c.Size + c.rand.Intn(c.MaxSize-c.Size+1)
+	}
+	return c.Size
+}
+
+func report(cfg Config, clients []*client) (Report, error) {
+	r := Report{Duration: cfg.Duration}
+	var waits []time.Duration
+	sum, squares := 0.0, 0.0
+	slowest, fastest := math.Inf(1), 0.0
+	for _, c := range clients {
+		if c.err != nil {
+			return Report{}, fmt.Errorf("failed to allocate quota: %w", c.err)
+		}
+		throughput := float64(c.bytes) / cfg.Duration.Seconds()
+		r.Clients = append(r.Clients, ClientReport{Group: c.group, Bytes: c.bytes, Transfers: c.transfers, Throughput: throughput})
+		r.Bytes += c.bytes
+		r.Transfers += c.transfers
+		waits = append(waits, c.waits...)
+		sum += throughput
+		squares += throughput * throughput
+		if throughput < slowest {
+			slowest = throughput
+		}
+		if throughput > fastest {
+			fastest = throughput
+		}
+	}
+
+	r.Utilization = float64(r.Bytes) / (float64(cfg.GlobalLimit) * (1 + cfg.Duration.Seconds()))
+	if squares > 0 {
+		r.Fairness = sum * sum / (float64(len(clients)) * squares)
+		r.MinMaxRatio = slowest / fastest
+	}
+	if len(waits) > 0 {
+		sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+		total := time.Duration(0)
+		for _, w := range waits {
+			total += w
+		}
+		r.MeanWait = total / time.Duration(len(waits))
+		r.P50Wait = stats.Percentile(waits, 50)
+		r.P95Wait = stats.Percentile(waits, 95)
+		r.P99Wait = stats.Percentile(waits, 99)
+		r.MaxWait = waits[len(waits)-1]
+	}
+	return r, nil
+}
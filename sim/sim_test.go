@@ -0,0 +1,188 @@
+package sim_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/sim"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name            string
+		cfg             sim.Config
+		wantBytes       int64
+		wantUtilization float64
+		minFairness     float64
+		wantMaxWait     time.Duration
+	}{
+		{
+			name: "local limit",
+			cfg: sim.Config{
+				Clients:     []sim.Clients{{N: 1, Size: 100}},
+				Duration:    10 * time.Second,
+				GlobalLimit: 10000,
+				LocalLimit:  1000,
+			},
+			// the burst and 10s at the local limit
+			wantBytes:   11000,
+			minFairness: 1,
+			wantMaxWait: 100 * time.Millisecond,
+		},
+		{
+			name: "global limit shared fairly",
+			cfg: sim.Config{
+				Clients:     []sim.Clients{{N: 4, Size: 100}},
+				Duration:    10 * time.Second,
+				GlobalLimit: 1000,
+				LocalLimit:  1000,
+			},
+			wantBytes:       11000,
+			wantUtilization: 1,
+			// allocations made at the same virtual time are ordered by the scheduler
+			minFairness: 0.9,
+			wantMaxWait: time.Second,
+		},
+		{
+			name: "arrivals within the limits do not wait",
+			cfg: sim.Config{
+				Clients:     []sim.Clients{{N: 4, Arrivals: 1, Size: 100, MaxSize: 200}},
+				Duration:    10 * time.Second,
+				GlobalLimit: 10000,
+				LocalLimit:  1000,
+				Seed:        1,
+			},
+		},
+		{
+			name: "custom allocator",
+			cfg: sim.Config{
+				Clients:     []sim.Clients{{N: 2, Size: 100}},
+				Duration:    10 * time.Second,
+				GlobalLimit: 1000,
+				NewAllocator: func(global netlimit.GlobalLimiter, clock netlimit.Clock) (netlimit.Allocator, error) {
+					a := netlimit.NewDefaultAllocatorWithLimiter(global, 1000)
+					a.SetClock(clock)
+					return netlimit.NewPrefetchAllocator(a), nil
+				},
+			},
+			wantBytes:       11000,
+			wantUtilization: 1,
+			wantMaxWait:     time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := sim.Run(tt.cfg)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			clients := 0
+			for _, g := range tt.cfg.Clients {
+				clients += g.N
+			}
+			if len(report.Clients) != clients {
+				t.Errorf("Run() reported %d clients, want %d", len(report.Clients), clients)
+			}
+			if report.Transfers == 0 {
+				t.Errorf("Run() completed no transfers")
+			}
+			// transfers in flight at the end of the simulation are allocated in part
+			if tt.wantBytes > 0 && math.Abs(float64(report.Bytes-tt.wantBytes)) > float64(tt.wantBytes)*0.02 {
+				t.Errorf("Run() Bytes = %d, want %d", report.Bytes, tt.wantBytes)
+			}
+			if tt.wantUtilization > 0 && math.Abs(report.Utilization-tt.wantUtilization) > 0.02 {
+				t.Errorf("Run() Utilization = %.3f, want %.3f", report.Utilization, tt.wantUtilization)
+			}
+			if report.Fairness < tt.minFairness {
+				t.Errorf("Run() Fairness = %.3f, want at least %.3f", report.Fairness, tt.minFairness)
+			}
+			if report.MaxWait > tt.wantMaxWait {
+				t.Errorf("Run() MaxWait = %v, want at most %v", report.MaxWait, tt.wantMaxWait)
+			}
+			if report.P50Wait > report.P95Wait || report.P95Wait > report.P99Wait || report.P99Wait > report.MaxWait {
+				t.Errorf("Run() percentiles %v, %v, %v, %v are not ordered", report.P50Wait, report.P95Wait, report.P99Wait, report.MaxWait)
+			}
+		})
+	}
+}
+
+func TestRun_Unfair(t *testing.T) {
+	// heavy clients transfer back to back, light clients once a second
+	report, err := sim.Run(sim.Config{
+		Clients:     []sim.Clients{{N: 1, Size: 1000}, {N: 3, Arrivals: 1, Size: 10}},
+		Duration:    10 * time.Second,
+		GlobalLimit: 1000,
+		LocalLimit:  1000,
+		Seed:        1,
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Fairness > 0.5 {
+		t.Errorf("Run() Fairness = %.3f, want the heavy client to get most of the limit", report.Fairness)
+	}
+	if got := report.Clients[0]; got.Group != 0 || got.Throughput < 10*report.Clients[1].Throughput {
+		t.Errorf("Run() Clients[0] = %+v, want the heavy client of group 0", got)
+	}
+	if report.MinMaxRatio <= 0 || report.MinMaxRatio > 0.1 {
+		t.Errorf("Run() MinMaxRatio = %.3f, want below 0.1", report.MinMaxRatio)
+	}
+}
+
+// failingAllocator fails every allocation.
+type failingAllocator struct{}
+
+var errAllocFailed = errors.New("allocation failed")
+
+func (failingAllocator) Alloc(ctx context.Context, n int) (int, error) { return 0, errAllocFailed }
+func (failingAllocator) SetLimit(limit int) error                      { return nil }
+
+func TestRun_AllocationFailed(t *testing.T) {
+	clients := 0
+	_, err := sim.Run(sim.Config{
+		Clients:     []sim.Clients{{N: 3, Size: 100}},
+		Duration:    10 * time.Second,
+		GlobalLimit: 1000,
+		NewAllocator: func(global netlimit.GlobalLimiter, clock netlimit.Clock) (netlimit.Allocator, error) {
+			// the last client stops while the others wait for quota
+			if clients++; clients == 3 {
+				return failingAllocator{}, nil
+			}
+			a := netlimit.NewDefaultAllocatorWithLimiter(global, 100)
+			a.SetClock(clock)
+			return a, nil
+		},
+	})
+	if !errors.Is(err, errAllocFailed) {
+		t.Errorf("Run() error = %v, want %v", err, errAllocFailed)
+	}
+}
+
+func TestRun_InvalidConfig(t *testing.T) {
+	valid := sim.Config{Clients: []sim.Clients{{N: 1, Size: 100}}, Duration: time.Second, GlobalLimit: 1000, LocalLimit: 1000}
+	tests := []struct {
+		name   string
+		modify func(cfg *sim.Config)
+	}{
+		{"no clients", func(cfg *sim.Config) { cfg.Clients = nil }},
+		{"zero duration", func(cfg *sim.Config) { cfg.Duration = 0 }},
+		{"zero global limit", func(cfg *sim.Config) { cfg.GlobalLimit = 0 }},
+		{"zero local limit", func(cfg *sim.Config) { cfg.LocalLimit = 0 }},
+		{"zero size", func(cfg *sim.Config) { cfg.Clients[0].Size = 0 }},
+		{"negative arrivals", func(cfg *sim.Config) { cfg.Clients[0].Arrivals = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			cfg.Clients = append([]sim.Clients(nil), valid.Clients...)
+			tt.modify(&cfg)
+			if _, err := sim.Run(cfg); !errors.Is(err, sim.ErrInvalidConfig) {
+				t.Errorf("Run() error = %v, want %v", err, sim.ErrInvalidConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build go1.21
+
+package netlimit_test
+
+import (
+	"log/slog"
+
+	"github.com/charconstpointer/netlimit"
+)
+
+var _ netlimit.Logger = (*slog.Logger)(nil)
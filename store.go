@@ -0,0 +1,253 @@
+package netlimit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var _ Store = (*FileStore)(nil)
+
+// Record is the persisted state of a single key.
+type Record struct {
+	// Key is the key the state belongs to
+	Key string `json:"key"`
+
+	// Used is the number of bytes charged against the key in Window
+	Used int64 `json:"used"`
+
+	// Carried is the number of bytes carried over into Window from the previous window
+	Carried int64 `json:"carried,omitempty"`
+
+	// Window is the beginning of the window Used is accounted for
+	Window time.Time `json:"window"`
+
+	// Limit overrides the default limit of the key, 0 means there is no override
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// Store persists per key state so that it survives process restarts.
+type Store interface {
+	// Load returns the latest Record of every key known to the Store.
+	Load() ([]Record, error)
+
+	// Save persists r, replacing the previous Record of r.Key.
+	Save(r Record) error
+
+	// Close flushes and releases resources held by the Store.
+	Close() error
+}
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "log.jsonl"
+
+	// defaultCompactEvery is the number of log entries after which FileStore writes a new snapshot
+	defaultCompactEvery = 4096
+)
+
+// FileStore is a Store backed by an append-only log and periodic snapshots kept in a directory.
+// Every Save appends a single line to the log, once the log grows past compactEvery entries
+// the current state is written to a snapshot and the log is truncated.
+type FileStore struct {
+	mu sync.Mutex
+
+	// dir is the directory holding the snapshot and the log
+	dir string
+
+	// log is the append-only log of records saved since the last snapshot
+	log *os.File
+
+	// entries is the number of records in log
+	entries int
+
+	// logSize is the size of the records of the log that were read when the store was opened
+	logSize int64
+
+	// compactEvery is the number of log entries after which a new snapshot is written
+	compactEvery int
+
+	// records is the latest Record of every key
+	records map[string]Record
+}
+
+// OpenFileStore opens or creates a FileStore in dir.
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	s := &FileStore{
+		dir:          dir,
+		compactEvery: defaultCompactEvery,
+		records:      make(map[string]Record),
+	}
+	if err := s.readSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayLog(); err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store log: %w", err)
+	}
+	// a truncated trailing record left behind by a crash is dropped, so that records appended from now on
+	// do not follow its partial bytes
+	if err := log.Truncate(s.logSize); err != nil {
+		log.Close()
+		return nil, fmt.Errorf("failed to truncate store log: %w", err)
+	}
+	s.log = log
+	return s, nil
+}
+
+// SetCompactEvery sets the number of log entries after which a new snapshot is written.
+func (s *FileStore) SetCompactEvery(n int) {
+	s.mu.Lock()
+	s.compactEvery = n
+	s.mu.Unlock()
+}
+
+// Load returns the latest Record of every key known to the FileStore.
+func (s *FileStore) Load() ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Save appends r to the log and compacts the log once it grows too long.
+func (s *FileStore) Save(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.log.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to append record: %w", err)
+	}
+	s.records[r.Key] = r
+	s.entries++
+
+	if s.entries < s.compactEvery {
+		return nil
+	}
+	return s.compact()
+}
+
+// Close writes a final snapshot and closes the log.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.compact(); err != nil {
+		s.log.Close()
+		return err
+	}
+	return s.log.Close()
+}
+
+// compact writes all records to a new snapshot and truncates the log.
+// compact must be called with s.mu held.
+func (s *FileStore) compact() error {
+	tmp, err := os.CreateTemp(s.dir, snapshotFile+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range s.records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, snapshotFile)); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	// the snapshot already contains everything the log does, it is safe to drop it now
+	if err := s.log.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate store log: %w", err)
+	}
+	s.entries = 0
+	return nil
+}
+
+func (s *FileStore) readSnapshot() error {
+	f, err := os.Open(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+	_, _, err = s.decode(f)
+	return err
+}
+
+func (s *FileStore) replayLog() error {
+	f, err := os.Open(filepath.Join(s.dir, logFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open store log: %w", err)
+	}
+	defer f.Close()
+	s.entries, s.logSize, err = s.decode(f)
+	return err
+}
+
+// decode reads records from r into s.records and returns the number of records read
+// and the offset of the end of the last one, including its newline.
+// A truncated trailing record, e.g. left behind by a crash during Save, is ignored.
+func (s *FileStore) decode(r io.Reader) (int, int64, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+	offset := int64(0)
+	for {
+		var record Record
+		err := dec.Decode(&record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, offset, nil
+		}
+		if err != nil {
+			return n, offset, fmt.Errorf("failed to decode record: %w", err)
+		}
+		s.records[record.Key] = record
+		n++
+
+		offset = dec.InputOffset()
+		var next [1]byte
+		if _, err := dec.Buffered().Read(next[:]); err == nil && next[0] == '\n' {
+			offset++
+		}
+	}
+}
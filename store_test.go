@@ -0,0 +1,156 @@
+package netlimit_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"golang.org/x/time/rate"
+)
+
+func TestFileStore_Reopen(t *testing.T) {
+	tests := []struct {
+		name         string
+		compactEvery int
+		saves        int
+	}{
+		{
+			name:         "restore from log",
+			compactEvery: 100,
+			saves:        10,
+		},
+		{
+			name:         "restore from snapshot and log",
+			compactEvery: 3,
+			saves:        10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := netlimit.OpenFileStore(dir)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			s.SetCompactEvery(tt.compactEvery)
+			window := time.Date(2022, time.June, 16, 0, 0, 0, 0, time.UTC)
+			for i := 1; i <= tt.saves; i++ {
+				err := s.Save(netlimit.Record{Key: "key", Used: int64(i), Window: window, Limit: 42})
+				if err != nil {
+					t.Fatalf("Save() error = %v", err)
+				}
+			}
+			if err := s.Save(netlimit.Record{Key: "other", Used: 1, Window: window}); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			// reopen without Close to simulate a crash
+			reopened, err := netlimit.OpenFileStore(dir)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			defer reopened.Close()
+			records, err := reopened.Load()
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if len(records) != 2 {
+				t.Fatalf("Load() got %v records, want %v", len(records), 2)
+			}
+			for _, r := range records {
+				if r.Key != "key" {
+					continue
+				}
+				if r.Used != int64(tt.saves) || r.Limit != 42 || !r.Window.Equal(window) {
+					t.Errorf("Load() got = %+v, want used %v and limit %v", r, tt.saves, 42)
+				}
+			}
+		})
+	}
+}
+
+func TestQuota_SetStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := netlimit.OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	q := netlimit.NewQuota(netlimit.Daily, 10)
+	if err := q.SetStore(s); err != nil {
+		t.Fatalf("SetStore() error = %v", err)
+	}
+	if err := q.SetLimit("key", 20); err != nil {
+		t.Fatalf("SetLimit() error = %v", err)
+	}
+	a := netlimit.NewQuotaAllocator(netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 10), 10), q, "key")
+	if _, err := a.Alloc(context.Background(), 5); err != nil {
+		t.Fatalf("Alloc() error = %v", err)
+	}
+	if err := q.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s, err = netlimit.OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	defer s.Close()
+	restored := netlimit.NewQuota(netlimit.Daily, 10)
+	if err := restored.SetStore(s); err != nil {
+		t.Fatalf("SetStore() error = %v", err)
+	}
+	if got := restored.Remaining("key"); got != 15 {
+		t.Errorf("Remaining() = %v, want %v", got, 15)
+	}
+}
+
+func TestFileStore_ReopenAfterPartialSave(t *testing.T) {
+	dir := t.TempDir()
+	s, err := netlimit.OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	window := time.Date(2022, time.June, 16, 0, 0, 0, 0, time.UTC)
+	if err := s.Save(netlimit.Record{Key: "key", Used: 1, Window: window}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// a crash during Save leaves a partial record at the end of the log
+	log, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := log.WriteString(`{"key":"key","us`); err != nil {
+		t.Fatalf("WriteString() error = %v", err)
+	}
+	log.Close()
+
+	for used := int64(2); used <= 3; used++ {
+		reopened, err := netlimit.OpenFileStore(dir)
+		if err != nil {
+			t.Fatalf("OpenFileStore() error = %v", err)
+		}
+		if err := reopened.Save(netlimit.Record{Key: "key", Used: used, Window: window}); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	reopened, err := netlimit.OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	defer reopened.Close()
+	records, err := reopened.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(records) != 1 || records[0].Used != 3 {
+		t.Errorf("Load() got = %+v, want a single record with used %v", records, 3)
+	}
+}
@@ -0,0 +1,86 @@
+package netlimit
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrTCPInfoUnsupported is returned when TCP_INFO is not available for a connection,
+	// either because of the platform or because the underlying connection is not a TCP socket.
+	ErrTCPInfoUnsupported = errors.New("tcp info is not supported")
+)
+
+// TCPInfo is a sample of the TCP_INFO of the socket underlying a Conn.
+type TCPInfo struct {
+	// RTT is the smoothed round trip time
+	RTT time.Duration
+
+	// RTTVar is the round trip time variance
+	RTTVar time.Duration
+
+	// MinRTT is the lowest round trip time observed
+	MinRTT time.Duration
+
+	// DeliveryRate is the most recent delivery rate sample in bytes per second
+	DeliveryRate uint64
+
+	// AppLimited reports whether DeliveryRate was limited by the sender not having data to send,
+	// i.e. by the Allocator, rather than by the network path
+	AppLimited bool
+
+	// PacingRate is the pacing rate of the socket in bytes per second
+	PacingRate uint64
+
+	// Retransmits is the total number of retransmitted segments
+	Retransmits uint32
+
+	// Lost is the number of segments currently considered lost
+	Lost uint32
+
+	// BytesInFlight is an estimate of the bytes sent but not yet acknowledged
+	BytesInFlight uint64
+
+	// NotSentBytes is the number of bytes written to the socket but not yet sent
+	NotSentBytes uint32
+
+	// SndCwnd is the congestion window in segments
+	SndCwnd uint32
+
+	// BytesSent is the number of bytes sent, including retransmissions
+	BytesSent uint64
+
+	// BytesRetrans is the number of bytes retransmitted
+	BytesRetrans uint64
+
+	// BytesAcked is the number of bytes acknowledged by the peer
+	BytesAcked uint64
+}
+
+// TCPInfo samples TCP_INFO of the socket underlying the connection.
+// It returns ErrTCPInfoUnsupported on platforms other than Linux and for connections that are not TCP sockets.
+func (c *Conn) TCPInfo() (TCPInfo, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return TCPInfo{}, ErrTCPInfoUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return TCPInfo{}, fmt.Errorf("failed to access socket: %w", err)
+	}
+
+	var info TCPInfo
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		info, serr = tcpInfo(fd)
+	})
+	if err != nil {
+		return TCPInfo{}, fmt.Errorf("failed to access socket: %w", err)
+	}
+	if serr != nil {
+		return TCPInfo{}, serr
+	}
+	return info, nil
+}
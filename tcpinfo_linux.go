@@ -0,0 +1,118 @@
+//go:build linux && !386
+
+package netlimit
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// rawTCPInfo mirrors struct tcp_info of linux/tcp.h, older kernels fill in only a prefix of it.
+type rawTCPInfo struct {
+	state       uint8
+	caState     uint8
+	retransmits uint8
+	probes      uint8
+	backoff     uint8
+	options     uint8
+	wscale      uint8
+	// appLimited holds tcpi_delivery_rate_app_limited in its lowest bit
+	appLimited uint8
+
+	rto    uint32
+	ato    uint32
+	sndMss uint32
+	rcvMss uint32
+
+	unacked uint32
+	sacked  uint32
+	lost    uint32
+	retrans uint32
+	fackets uint32
+
+	lastDataSent uint32
+	lastAckSent  uint32
+	lastDataRecv uint32
+	lastAckRecv  uint32
+
+	pmtu        uint32
+	rcvSsthresh uint32
+	rtt         uint32
+	rttvar      uint32
+	sndSsthresh uint32
+	sndCwnd     uint32
+	advmss      uint32
+	reordering  uint32
+
+	rcvRtt   uint32
+	rcvSpace uint32
+
+	totalRetrans uint32
+
+	pacingRate    uint64
+	maxPacingRate uint64
+	bytesAcked    uint64
+	bytesReceived uint64
+	segsOut       uint32
+	segsIn        uint32
+
+	notsentBytes uint32
+	minRtt       uint32
+	dataSegsIn   uint32
+	dataSegsOut  uint32
+
+	deliveryRate uint64
+
+	busyTime      uint64
+	rwndLimited   uint64
+	sndbufLimited uint64
+
+	delivered   uint32
+	deliveredCe uint32
+
+	bytesSent    uint64
+	bytesRetrans uint64
+}
+
+func tcpInfo(fd uintptr) (TCPInfo, error) {
+	var raw rawTCPInfo
+	size := uint32(unsafe.Sizeof(raw))
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_GETSOCKOPT,
+		fd,
+		syscall.IPPROTO_TCP,
+		syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&raw)),
+		uintptr(unsafe.Pointer(&size)),
+		0,
+	)
+	if errno == syscall.EOPNOTSUPP || errno == syscall.ENOPROTOOPT {
+		return TCPInfo{}, ErrTCPInfoUnsupported
+	}
+	if errno != 0 {
+		return TCPInfo{}, fmt.Errorf("failed to read tcp info: %w", errno)
+	}
+
+	inFlight := int64(raw.unacked) - int64(raw.sacked) - int64(raw.lost) + int64(raw.retrans)
+	if inFlight < 0 {
+		inFlight = 0
+	}
+	return TCPInfo{
+		RTT:           time.Duration(raw.rtt) * time.Microsecond,
+		RTTVar:        time.Duration(raw.rttvar) * time.Microsecond,
+		MinRTT:        time.Duration(raw.minRtt) * time.Microsecond,
+		DeliveryRate:  raw.deliveryRate,
+		AppLimited:    raw.appLimited&1 == 1,
+		PacingRate:    raw.pacingRate,
+		Retransmits:   raw.totalRetrans,
+		Lost:          raw.lost,
+		BytesInFlight: uint64(inFlight) * uint64(raw.sndMss),
+		NotSentBytes:  raw.notsentBytes,
+		SndCwnd:       raw.sndCwnd,
+		BytesSent:     raw.bytesSent,
+		BytesRetrans:  raw.bytesRetrans,
+		BytesAcked:    raw.bytesAcked,
+	}, nil
+}
@@ -0,0 +1,64 @@
+//go:build linux && !386
+
+package netlimit_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/charconstpointer/netlimit"
+	"golang.org/x/time/rate"
+)
+
+func TestConn_TCPInfo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn, _ := netlimit.NewConn(tcp, netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Inf, 1<<20), 1<<20))
+	defer conn.Close()
+
+	if _, err := conn.Write(make([]byte, 1<<16)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	info, err := conn.TCPInfo()
+	if err != nil {
+		t.Fatalf("TCPInfo() error = %v", err)
+	}
+	if info.BytesSent == 0 && info.BytesAcked == 0 {
+		t.Errorf("TCPInfo() = %+v, want bytes sent", info)
+	}
+	if info.RTT <= 0 {
+		t.Errorf("TCPInfo() RTT = %v, want positive", info.RTT)
+	}
+	if stats := conn.Stats(); stats.TCP == nil {
+		t.Errorf("Stats() TCP = nil, want sample")
+	}
+}
+
+func TestConn_TCPInfoUnsupported(t *testing.T) {
+	recv, sender := net.Pipe()
+	defer recv.Close()
+	defer sender.Close()
+	conn, _ := netlimit.NewConn(sender, netlimit.NewDefaultAllocator(rate.NewLimiter(1000, 1000), 100))
+	if _, err := conn.TCPInfo(); err != netlimit.ErrTCPInfoUnsupported {
+		t.Errorf("TCPInfo() error = %v, wantErr %v", err, netlimit.ErrTCPInfoUnsupported)
+	}
+	if stats := conn.Stats(); stats.TCP != nil {
+		t.Errorf("Stats() TCP = %+v, want nil", stats.TCP)
+	}
+}
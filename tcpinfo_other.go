@@ -0,0 +1,7 @@
+//go:build !linux || 386
+
+package netlimit
+
+func tcpInfo(fd uintptr) (TCPInfo, error) {
+	return TCPInfo{}, ErrTCPInfoUnsupported
+}
@@ -0,0 +1,202 @@
+package netlimit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidTrace is returned by TraceReader for data that is not a trace written by TraceWriter.
+	ErrInvalidTrace = errors.New("invalid trace")
+)
+
+// traceMagic starts every trace, followed by traceVersion
+const (
+	traceMagic   = "nltr"
+	traceVersion = 1
+)
+
+// Direction is the direction of traffic of a TraceEvent.
+type Direction uint8
+
+const (
+	// DirectionRead is data read from a connection
+	DirectionRead Direction = iota + 1
+
+	// DirectionWrite is data written to a connection
+	DirectionWrite
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionRead:
+		return "read"
+	case DirectionWrite:
+		return "write"
+	default:
+		return fmt.Sprintf("Direction(%d)", uint8(d))
+	}
+}
+
+// TraceEvent is a single read or write of a traced connection.
+type TraceEvent struct {
+	// Time is the time the read or write was issued at, before waiting for quota
+	Time time.Time
+
+	// Conn identifies the connection within the trace
+	Conn uint64
+
+	// Direction is the direction of the traffic
+	Direction Direction
+
+	// Size is the number of bytes read or written
+	Size int
+
+	// Granted is the quota granted by the Allocator of the connection
+	Granted int
+}
+
+// TraceWriter records TraceEvents of connections in a compact binary form: every event takes a few bytes,
+// fields are varints and times are deltas from the previous event. TraceWriter is safe for concurrent use,
+// errors of the underlying writer are kept and returned by Flush.
+type TraceWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+
+	// last is the time of the previous event, times are encoded as deltas from it
+	last time.Time
+
+	// conns is the number of connections traced so far, their ids
+	conns uint64
+
+	// err is the first error of the underlying writer
+	err error
+
+	// header is set once the header of the trace has been written
+	header bool
+}
+
+// NewTraceWriter returns a TraceWriter that writes a trace to w.
+func NewTraceWriter(w io.Writer) *TraceWriter {
+	return &TraceWriter{w: bufio.NewWriter(w), last: time.Unix(0, 0)}
+}
+
+// Record writes ev to the trace.
+func (t *TraceWriter) Record(ev TraceEvent) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	if !t.header {
+		t.header = true
+		t.write([]byte{traceMagic[0], traceMagic[1], traceMagic[2], traceMagic[3], traceVersion})
+	}
+
+	var buf [4*binary.MaxVarintLen64 + 1]byte
+	n := binary.PutVarint(buf[:], int64(ev.Time.Sub(t.last)))
+	n += binary.PutUvarint(buf[n:], ev.Conn)
+	buf[n] = byte(ev.Direction)
+	n++
+	n += binary.PutUvarint(buf[n:], uint64(ev.Size))
+	n += binary.PutUvarint(buf[n:], uint64(ev.Granted))
+	t.write(buf[:n])
+	t.last = ev.Time
+	return t.err
+}
+
+func (t *TraceWriter) write(b []byte) {
+	if _, err := t.w.Write(b); err != nil {
+		t.err = fmt.Errorf("failed to write trace: %w", err)
+	}
+}
+
+// Flush writes buffered events to the underlying writer.
+func (t *TraceWriter) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	if err := t.w.Flush(); err != nil {
+		t.err = fmt.Errorf("failed to flush trace: %w", err)
+	}
+	return t.err
+}
+
+// conn returns the id of a newly traced connection.
+func (t *TraceWriter) conn() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns++
+	return t.conns
+}
+
+// TraceReader reads TraceEvents written by TraceWriter.
+type TraceReader struct {
+	r    *bufio.Reader
+	last time.Time
+
+	// header is set once the header of the trace has been read
+	header bool
+}
+
+// NewTraceReader returns a TraceReader that reads a trace from r.
+func NewTraceReader(r io.Reader) *TraceReader {
+	return &TraceReader{r: bufio.NewReader(r), last: time.Unix(0, 0)}
+}
+
+// Next returns the next event of the trace, it returns io.EOF at the end of the trace
+// and an error wrapping io.ErrUnexpectedEOF if the trace ends within an event, e.g. when its writer did not flush.
+func (t *TraceReader) Next() (TraceEvent, error) {
+	if !t.header {
+		var header [len(traceMagic) + 1]byte
+		if _, err := io.ReadFull(t.r, header[:]); err != nil {
+			if err == io.EOF {
+				// an empty trace has no events
+				return TraceEvent{}, io.EOF
+			}
+			return TraceEvent{}, fmt.Errorf("failed to read trace header: %w", traceError(err))
+		}
+		if string(header[:len(traceMagic)]) != traceMagic || header[len(traceMagic)] != traceVersion {
+			return TraceEvent{}, fmt.Errorf("failed to read trace header: %w", ErrInvalidTrace)
+		}
+		t.header = true
+	}
+
+	delta, err := binary.ReadVarint(t.r)
+	if err == io.EOF {
+		return TraceEvent{}, io.EOF
+	}
+	if err != nil {
+		return TraceEvent{}, fmt.Errorf("failed to read trace event: %w", traceError(err))
+	}
+	ev := TraceEvent{Time: t.last.Add(time.Duration(delta))}
+	direction, size, granted := byte(0), uint64(0), uint64(0)
+	if ev.Conn, err = binary.ReadUvarint(t.r); err == nil {
+		if direction, err = t.r.ReadByte(); err == nil {
+			if size, err = binary.ReadUvarint(t.r); err == nil {
+				granted, err = binary.ReadUvarint(t.r)
+			}
+		}
+	}
+	if err != nil {
+		return TraceEvent{}, fmt.Errorf("failed to read trace event: %w", traceError(err))
+	}
+	ev.Direction, ev.Size, ev.Granted = Direction(direction), int(size), int(granted)
+	t.last = ev.Time
+	return ev, nil
+}
+
+// traceError returns io.ErrUnexpectedEOF if err is the end of a truncated trace and ErrInvalidTrace otherwise.
+func traceError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.ErrUnexpectedEOF
+	}
+	return ErrInvalidTrace
+}
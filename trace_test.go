@@ -0,0 +1,140 @@
+package netlimit_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/charconstpointer/netlimit"
+	"github.com/charconstpointer/netlimit/netlimittest"
+	"golang.org/x/time/rate"
+)
+
+func TestTraceWriter(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		events []netlimit.TraceEvent
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "single",
+			events: []netlimit.TraceEvent{
+				{Time: start, Conn: 1, Direction: netlimit.DirectionWrite, Size: 1500, Granted: 1500},
+			},
+		},
+		{
+			name: "interleaved connections out of order",
+			events: []netlimit.TraceEvent{
+				{Time: start, Conn: 1, Direction: netlimit.DirectionRead, Size: 100, Granted: 4096},
+				{Time: start.Add(time.Millisecond), Conn: 2, Direction: netlimit.DirectionWrite, Size: 1 << 20, Granted: 1 << 20},
+				{Time: start.Add(time.Microsecond), Conn: 1, Direction: netlimit.DirectionWrite, Size: 0, Granted: 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := netlimit.NewTraceWriter(&buf)
+			for _, ev := range tt.events {
+				if err := w.Record(ev); err != nil {
+					t.Fatalf("Record() error = %v", err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+
+			r := netlimit.NewTraceReader(&buf)
+			for _, want := range tt.events {
+				got, err := r.Next()
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				if !got.Time.Equal(want.Time) || got.Conn != want.Conn || got.Direction != want.Direction ||
+					got.Size != want.Size || got.Granted != want.Granted {
+					t.Errorf("Next() = %+v, want %+v", got, want)
+				}
+			}
+			if _, err := r.Next(); err != io.EOF {
+				t.Errorf("Next() error = %v, want %v at the end of the trace", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestTraceReader_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		trace   []byte
+		wantErr error
+	}{
+		{name: "bad magic", trace: []byte("json{}"), wantErr: netlimit.ErrInvalidTrace},
+		{name: "bad version", trace: []byte("nltr\x02\x00"), wantErr: netlimit.ErrInvalidTrace},
+		{name: "truncated header", trace: []byte("nl"), wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated event", trace: []byte("nltr\x01\x02\x01"), wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated varint", trace: []byte("nltr\x01\x80"), wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := netlimit.NewTraceReader(bytes.NewReader(tt.trace)).Next()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Next() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConn_SetTrace(t *testing.T) {
+	var buf bytes.Buffer
+	w := netlimit.NewTraceWriter(&buf)
+
+	clock := netlimittest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	recv, sender := net.Pipe()
+	a := netlimit.NewDefaultAllocator(rate.NewLimiter(rate.Limit(1000), 1000), 1000)
+	a.SetClock(clock)
+	conn, _ := netlimit.NewConn(sender, a)
+	conn.SetClock(clock)
+	conn.SetTrace(w)
+	go func() {
+		b := make([]byte, 100)
+		n, _ := recv.Read(b)
+		recv.Write(b[:n])
+		recv.Close()
+	}()
+
+	if _, err := conn.Write([]byte("hi there")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 100)); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	conn.Close()
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	r := netlimit.NewTraceReader(&buf)
+	want := []netlimit.TraceEvent{
+		{Conn: 1, Direction: netlimit.DirectionWrite, Size: 8, Granted: 8},
+		{Conn: 1, Direction: netlimit.DirectionRead, Size: 8, Granted: 100},
+	}
+	for _, want := range want {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if got.Conn != want.Conn || got.Direction != want.Direction || got.Size != want.Size || got.Granted != want.Granted {
+			t.Errorf("Next() = %+v, want %+v", got, want)
+		}
+		// events are timed by the clock of the connection
+		if !got.Time.Equal(clock.Now()) {
+			t.Errorf("Next() Time = %v, want %v", got.Time, clock.Now())
+		}
+	}
+}